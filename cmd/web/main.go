@@ -3,8 +3,16 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lewisdalwin/echo/internal/ws"
 )
@@ -13,12 +21,204 @@ func handlerHome(w http.ResponseWriter, r *http.Request){
     w.Write([]byte("WebSockets!\n"))
 }
 
+// envInt returns the integer value of the named environment variable, or def if unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", name, v, err)
+	}
+	return n
+}
+
+// envFloat returns the float value of the named environment variable, or def if unset
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", name, v, err)
+	}
+	return f
+}
+
+// envDuration returns the duration value (e.g. "30s") of the named environment variable, or def if unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", name, v, err)
+	}
+	return d
+}
+
+// envBool reports whether the named environment variable is set to a true value
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s=%q: %v", name, v, err)
+	}
+	return b
+}
+
+// envHeaders parses the named environment variable as "Name: value" pairs separated by semicolons
+func envHeaders(name string) http.Header {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	h := http.Header{}
+	for _, pair := range strings.Split(v, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			log.Fatalf("invalid %s entry %q: expected Name: value", name, pair)
+		}
+		h.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return h
+}
+
+// envList splits the named environment variable on commas, dropping empty entries
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// loadConfig builds the WebSocket server configuration from the environment
+func loadConfig() ws.Config {
+	c := ws.DefaultConfig()
+	c.ShedMaxGoroutines = envInt("ECHO_SHED_MAX_GOROUTINES", c.ShedMaxGoroutines)
+	c.ShedMaxConnections = int64(envInt("ECHO_SHED_MAX_CONNECTIONS", int(c.ShedMaxConnections)))
+	c.ShedMaxMessageRate = envFloat("ECHO_SHED_MAX_RATE", c.ShedMaxMessageRate)
+	c.WriteWait = envDuration("ECHO_WRITE_WAIT", c.WriteWait)
+	c.PongWait = envDuration("ECHO_PONG_WAIT", c.PongWait)
+	c.PingPeriod = envDuration("ECHO_PING_PERIOD", c.PingPeriod)
+	c.SendQueueSize = envInt("ECHO_SEND_QUEUE_SIZE", c.SendQueueSize)
+	c.WriteBufferPool = envBool("ECHO_WRITE_BUFFER_POOL", c.WriteBufferPool)
+	c.MaxTimersPerConnection = envInt("ECHO_MAX_TIMERS", c.MaxTimersPerConnection)
+	c.MaxMessageBytes = envInt("ECHO_MAX_MESSAGE_BYTES", c.MaxMessageBytes)
+	c.IPMaxMessages = envInt("ECHO_IP_MAX_MESSAGES", c.IPMaxMessages)
+	c.IPRateWindow = envDuration("ECHO_IP_RATE_WINDOW", c.IPRateWindow)
+	c.TrustProxy = envBool("ECHO_TRUST_PROXY", c.TrustProxy)
+	c.AuthToken = os.Getenv("ECHO_AUTH_TOKEN")
+	c.AllowEmptyOrigin = envBool("ECHO_ALLOW_EMPTY_ORIGIN", c.AllowEmptyOrigin)
+	c.Compression = envBool("ECHO_COMPRESSION", c.Compression)
+	c.CompressionThreshold = envInt("ECHO_COMPRESSION_THRESHOLD", c.CompressionThreshold)
+	c.CompressionLevel = envInt("ECHO_COMPRESSION_LEVEL", c.CompressionLevel)
+	c.BroadcastEchoToSender = envBool("ECHO_BROADCAST_TO_SENDER", c.BroadcastEchoToSender)
+	if v, ok := os.LookupEnv("ECHO_RESPONSE_TEMPLATE"); ok {
+		c.ResponseTemplate = v // set but empty means raw echoes
+	}
+	c.Subprotocols = envList("ECHO_SUBPROTOCOLS")
+	c.EnabledCommands = envList("ECHO_ENABLED_COMMANDS")
+	c.DisabledCommands = envList("ECHO_DISABLED_COMMANDS")
+	c.EchoDelay = time.Duration(envInt("ECHO_DELAY_MS", int(c.EchoDelay/time.Millisecond))) * time.Millisecond
+	c.ErrorRate = envFloat("ECHO_ERROR_RATE", c.ErrorRate)
+	c.DropRate = envFloat("ECHO_DROP_RATE", c.DropRate)
+	c.FaultSeed = uint64(envInt("ECHO_FAULT_SEED", int(c.FaultSeed)))
+	c.PerConnectionCounter = envBool("ECHO_PER_CONNECTION_COUNTER", c.PerConnectionCounter)
+	c.PerConnectionStats = envBool("ECHO_PER_CONNECTION_STATS", c.PerConnectionStats)
+	c.ConformanceMode = envBool("ECHO_CONFORMANCE", c.ConformanceMode)
+	c.StrictSubprotocol = envBool("ECHO_STRICT_SUBPROTOCOL", c.StrictSubprotocol)
+	c.HandshakeHeaders = envHeaders("ECHO_HANDSHAKE_HEADERS")
+	if name := os.Getenv("ECHO_CORRELATION_HEADER"); name != "" {
+		c.HandshakeHeaderFunc = ws.CorrelationHeader(name)
+	}
+	return c
+}
+
+// listen serves srv over TLS when ECHO_TLS_CERT and ECHO_TLS_KEY are both
+// set, so clients can connect with wss://, and over plain HTTP otherwise
+func listen(srv *http.Server) error {
+	certFile, keyFile := os.Getenv("ECHO_TLS_CERT"), os.Getenv("ECHO_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		log.Printf("Starting server on %s with TLS", srv.Addr)
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	}
+	if certFile != "" || keyFile != "" {
+		log.Print("ECHO_TLS_CERT and ECHO_TLS_KEY must both be set for TLS; serving plain HTTP")
+	}
+	log.Printf("Starting server on %s", srv.Addr)
+	return srv.ListenAndServe()
+}
+
 func main() {
+	if os.Getenv("ECHO_LOG_FORMAT") == "json" {
+		ws.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+	if err := ws.Configure(loadConfig()); err != nil {
+		log.Fatal(err)
+	}
+
+	// Comma-separated production front-ends get the stricter profile
+	for _, origin := range strings.Split(os.Getenv("ECHO_PRODUCTION_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			ws.SetOriginProfile(origin, ws.ProductionProfile)
+		}
+	}
+
+	// Start the broadcast hub explicitly rather than on first use
+	hub := ws.NewHub()
+	go hub.Run()
+	ws.SetHub(hub)
+
 	mux := http.NewServeMux()
 	mux.Handle("/", http.FileServer(http.Dir("./web")))
 	mux.HandleFunc("/test", handlerHome)
 	mux.HandleFunc("/ws", ws.HandleWebSocket)
-	log.Print("Starting server on :4000")
-	err := http.ListenAndServe(":4000", mux)
-	log.Fatal(err)
+	// Without a token anyone could change every client's responses
+	if ws.CurrentConfig().AuthToken != "" {
+		mux.HandleFunc("/admin/variants", ws.HandleAdminVariants)
+	}
+	mux.HandleFunc("/metrics", ws.HandleMetrics)
+	mux.HandleFunc("/healthz", ws.HandleHealthz)
+	mux.HandleFunc("/debug/connections", ws.HandleDebugConnections)
+	mux.HandleFunc("/events", ws.HandleEvents)
+	mux.HandleFunc("/send", ws.HandleSend)
+	mux.HandleFunc("/poll/session", ws.HandlePollSession)
+	mux.HandleFunc("/poll/send", ws.HandlePollSend)
+	mux.HandleFunc("/poll/recv", ws.HandlePollRecv)
+
+	srv := &http.Server{Addr: ":4000", Handler: mux}
+	go func() {
+		if err := listen(srv); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On SIGINT/SIGTERM, tell WebSocket clients we're going away, then stop
+	// accepting requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Print("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		log.Printf("hub shutdown: %v", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
 }
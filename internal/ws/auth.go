@@ -0,0 +1,40 @@
+// Filename: internal/ws/auth.go
+
+package ws
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requestToken returns the token a client presented, from an
+// "Authorization: Bearer <token>" header or else the token query parameter.
+// Browsers can't set headers on a WebSocket handshake, hence the fallback.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorized reports whether r carries the configured token. Every request
+// is authorized when no token is configured.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(token)) == 1
+}
+
+// requireToken answers 401 unless r carries the configured token, for the
+// HTTP endpoints that sit beside the WebSocket one
+func requireToken(w http.ResponseWriter, r *http.Request) bool {
+	if authorized(r, cfg().AuthToken) {
+		return true
+	}
+	logger().Warn("unauthorized request", "event", "unauthorized", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
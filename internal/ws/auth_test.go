@@ -0,0 +1,53 @@
+// Filename: internal/ws/auth_test.go
+
+package ws
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAuthToken(t *testing.T) {
+	c := DefaultConfig()
+	c.AuthToken = "s3cret"
+	withConfig(t, c)
+	srv := newTestServer(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	tests := []struct {
+		name   string
+		query  string
+		auth   string
+		status int
+	}{
+		{"bearer header", "", "Bearer s3cret", http.StatusSwitchingProtocols},
+		{"query parameter", "?token=s3cret", "", http.StatusSwitchingProtocols},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong header", "", "Bearer guess", http.StatusUnauthorized},
+		{"wrong query parameter", "?token=guess", "", http.StatusUnauthorized},
+		{"other scheme", "", "Basic s3cret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("Origin", "http://localhost:4000")
+		if tt.auth != "" {
+			header.Set("Authorization", tt.auth)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+tt.query, header)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != tt.status {
+			t.Errorf("%s: got %v, %v expected status %d", tt.name, resp, err, tt.status)
+		}
+	}
+}
+
+func TestNoAuthTokenAllowsEveryone(t *testing.T) {
+	if got := roundTrip(t, dialTestServer(t, newTestServer(t)), "open"); got != "open" {
+		t.Errorf("got %q expected %q", got, "open")
+	}
+}
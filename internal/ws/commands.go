@@ -0,0 +1,315 @@
+// Filename: internal/ws/commands.go
+
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Process start; monotonic readings and uptime are measured from here
+var serverStart = time.Now()
+
+// Version is the build version reported by server_info, set at link time with
+// -ldflags "-X github.com/lewisdalwin/echo/internal/ws.Version=v1.2.3"
+var Version = "dev"
+
+// Repeating pattern used to fill pad responses; plain ASCII so JSON encoding
+// never escapes it and the byte count stays exact
+const padPattern = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// processPad responds with a JSON object that is exactly req.A bytes long
+// once the request's id is added, letting clients probe how they handle a
+// given frame size
+func processPad(req CommandRequest) ([]byte, error) {
+	resp := CommandResponse{
+		Command: req.Command,
+	}
+
+	size := req.A
+	limit := cfg().MaxWriteBytes
+	// The smallest pad response still carries a one-byte padding field
+	resp.Padding = "0"
+	base, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	minSize := len(withRequestID(base, req.ID))
+
+	switch {
+	case size != math.Trunc(size):
+		resp.Error = "pad size must be a whole number of bytes"
+	case size > float64(limit):
+		resp.Error = fmt.Sprintf("pad size exceeds the write limit of %d bytes", limit)
+	case size < float64(minSize):
+		resp.Error = fmt.Sprintf("pad size must be at least %d bytes", minSize)
+	}
+	if resp.Error != "" {
+		resp.Padding = ""
+		return json.Marshal(resp)
+	}
+
+	n := int(size) - minSize + 1
+	resp.Padding = strings.Repeat(padPattern, n/len(padPattern)+1)[:n]
+	return json.Marshal(resp)
+}
+
+// Largest number of rows or columns accepted by matmul
+const maxMatrixDim = 16
+
+// matrixShape validates that m is a non-empty rectangular matrix within
+// maxMatrixDim and returns its dimensions
+func matrixShape(name string, m [][]float64) (rows, cols int, err error) {
+	if len(m) == 0 || len(m[0]) == 0 {
+		return 0, 0, fmt.Errorf("%s must be a non-empty matrix", name)
+	}
+	rows, cols = len(m), len(m[0])
+	if rows > maxMatrixDim || cols > maxMatrixDim {
+		return 0, 0, fmt.Errorf("%s exceeds the maximum size of %dx%d", name, maxMatrixDim, maxMatrixDim)
+	}
+	for i, row := range m {
+		if len(row) != cols {
+			return 0, 0, fmt.Errorf("%s row %d has %d columns, expected %d", name, i, len(row), cols)
+		}
+	}
+	return rows, cols, nil
+}
+
+// processMatMul multiplies req.M1 by req.M2
+func processMatMul(req CommandRequest) ([]byte, error) {
+	resp := CommandResponse{
+		Command: req.Command,
+	}
+
+	rows1, cols1, err := matrixShape("m1", req.M1)
+	if err != nil {
+		resp.Error = err.Error()
+		return json.Marshal(resp)
+	}
+	rows2, cols2, err := matrixShape("m2", req.M2)
+	if err != nil {
+		resp.Error = err.Error()
+		return json.Marshal(resp)
+	}
+	if cols1 != rows2 {
+		resp.Error = fmt.Sprintf("dimension mismatch: m1 is %dx%d but m2 is %dx%d (columns of m1 must equal rows of m2)", rows1, cols1, rows2, cols2)
+		return json.Marshal(resp)
+	}
+
+	product := make([][]float64, rows1)
+	for i := range product {
+		product[i] = make([]float64, cols2)
+		for j := 0; j < cols2; j++ {
+			var sum float64
+			for k := 0; k < cols1; k++ {
+				sum += req.M1[i][k] * req.M2[k][j]
+			}
+			if resp.Error = nonFiniteError(sum); resp.Error != "" {
+				return json.Marshal(resp)
+			}
+			product[i][j] = sum
+		}
+	}
+	resp.Matrix = product
+	return json.Marshal(resp)
+}
+
+// NowResponse reports the server clock in several formats at once
+type NowResponse struct {
+	Command     string `json:"command"`
+	RFC3339     string `json:"rfc3339"`
+	Unix        int64  `json:"unix"`
+	UnixMilli   int64  `json:"unix_ms"`
+	UnixNano    int64  `json:"unix_ns"`
+	MonotonicNs int64  `json:"monotonic_ns"` // nanoseconds since server start, unaffected by wall clock changes
+}
+
+// processNow responds with the current server time
+func processNow(req CommandRequest) ([]byte, error) {
+	now := time.Now()
+	return json.Marshal(NowResponse{
+		Command:     req.Command,
+		RFC3339:     now.Format(time.RFC3339Nano),
+		Unix:        now.Unix(),
+		UnixMilli:   now.UnixMilli(),
+		UnixNano:    now.UnixNano(),
+		MonotonicNs: now.Sub(serverStart).Nanoseconds(),
+	})
+}
+
+// processServerInfo responds with when the server started, how long it has
+// been up, and the Go and build versions it is running
+func processServerInfo(req CommandRequest) ([]byte, error) {
+	uptime := time.Since(serverStart)
+	return json.Marshal(struct {
+		Command       string  `json:"command"`
+		StartedAt     string  `json:"started_at"`
+		Uptime        string  `json:"uptime"`
+		UptimeSeconds float64 `json:"uptime_seconds"`
+		GoVersion     string  `json:"go_version"`
+		Version       string  `json:"version"`
+	}{
+		Command:       req.Command,
+		StartedAt:     serverStart.Format(time.RFC3339Nano),
+		Uptime:        uptime.Round(time.Millisecond).String(),
+		UptimeSeconds: uptime.Seconds(),
+		GoVersion:     runtime.Version(),
+		Version:       Version,
+	})
+}
+
+// processPing answers an application-level ping with a pong carrying the
+// client's timestamp back unchanged and the server's clock in Unix
+// milliseconds, for measuring latency where control frames don't get through
+func processPing(req CommandRequest) ([]byte, error) {
+	return json.Marshal(struct {
+		Command  string      `json:"command"`
+		TS       json.Number `json:"ts,omitempty"`
+		ServerTS int64       `json:"server_ts"`
+	}{
+		Command:  "pong",
+		TS:       req.TS,
+		ServerTS: time.Now().UnixMilli(),
+	})
+}
+
+// Deepest nesting jsontree will describe
+const maxJSONTreeDepth = 32
+
+// jsonTypeName names the JSON type of a scalar decoded into interface{}
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return "unknown"
+}
+
+// jsonTypeTree describes the shape of a decoded JSON value. Objects map each
+// key to the shape of its value, scalars become their type name, and arrays
+// list the distinct shapes of their elements. An array holding only scalars
+// is summarised as ["array of [number, string]"].
+func jsonTypeTree(v interface{}, depth int) (interface{}, error) {
+	if depth > maxJSONTreeDepth {
+		return nil, fmt.Errorf("JSON is nested deeper than %d levels", maxJSONTreeDepth)
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		tree := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			sub, err := jsonTypeTree(elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			tree[k] = sub
+		}
+		return tree, nil
+
+	case []interface{}:
+		shapes := make([]interface{}, 0)
+		names := make([]string, 0)
+		seen := make(map[string]bool)
+		allScalar := true
+		for _, elem := range val {
+			sub, err := jsonTypeTree(elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			key, _ := json.Marshal(sub)
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			shapes = append(shapes, sub)
+			if name, ok := sub.(string); ok {
+				names = append(names, name)
+			} else {
+				allScalar = false
+			}
+		}
+		if allScalar {
+			return []interface{}{"array of [" + strings.Join(names, ", ") + "]"}, nil
+		}
+		return shapes, nil
+	}
+
+	return jsonTypeName(v), nil
+}
+
+// processJSONTree parses req.Text as JSON and responds with its type tree
+func processJSONTree(req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command string      `json:"command"`
+		Tree    interface{} `json:"tree,omitempty"`
+		Error   string      `json:"error,omitempty"`
+	}{
+		Command: req.Command,
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(req.Text), &v); err != nil {
+		resp.Error = fmt.Sprintf("text is not valid JSON: %v", err)
+		return json.Marshal(resp)
+	}
+	tree, err := jsonTypeTree(v, 0)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Tree = tree
+	}
+	return json.Marshal(resp)
+}
+
+// Bytes of input shown on each side of a parse error
+const snippetRadius = 15
+
+// jsonErrorDiagnostics explains why payload failed to decode: the byte offset
+// of the problem, the input around it, and a hint at the likely cause. The
+// offset is nil when the error doesn't carry one.
+func jsonErrorDiagnostics(payload []byte, err error) (*int64, string, string) {
+	var offset int64
+	var hint string
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+		switch {
+		case syntaxErr.Error() == "unexpected end of JSON input" || offset < 1:
+			hint = "input ended early; check for an unclosed brace, bracket or string"
+		case payload[offset-1] == '\'':
+			hint = "JSON strings must use double quotes"
+		case payload[offset-1] == '}' || payload[offset-1] == ']':
+			hint = "check for a trailing comma before the closing bracket"
+		default:
+			hint = "check for a missing comma, colon or quote near the offset"
+		}
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		hint = fmt.Sprintf("field %q expects a %s but got a %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	default:
+		return nil, "", ""
+	}
+
+	start := max(offset-snippetRadius, 0)
+	end := min(offset+snippetRadius, int64(len(payload)))
+	snippet := string(payload[start:end])
+	if !utf8.ValidString(snippet) {
+		snippet = strings.ToValidUTF8(snippet, "\uFFFD")
+	}
+	return &offset, snippet, hint
+}
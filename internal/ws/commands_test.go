@@ -0,0 +1,774 @@
+// Filename: internal/ws/commands_test.go
+
+package ws
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeResponse unmarshals a command response, failing the test on error
+func decodeResponse(t *testing.T, data []byte) CommandResponse {
+	t.Helper()
+	var resp CommandResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("invalid response JSON %q: %v", data, err)
+	}
+	return resp
+}
+
+func TestProcessPadExactSize(t *testing.T) {
+	for _, size := range []int{43, 100, 1000, 4096} {
+		out, err := processCommand([]byte(`{"command":"pad","a":` + strconv.Itoa(size) + `}`))
+		if err != nil {
+			t.Fatalf("pad %d: unexpected error %v", size, err)
+		}
+		if len(out) != size {
+			t.Errorf("pad %d: got %d bytes", size, len(out))
+		}
+		if resp := decodeResponse(t, out); resp.Error != "" {
+			t.Errorf("pad %d: unexpected error field %q", size, resp.Error)
+		}
+	}
+}
+
+func TestProcessPadExactSizeWithID(t *testing.T) {
+	for _, id := range []string{`7`, `"req-1"`} {
+		for _, size := range []int{60, 1000} {
+			out, err := processCommand([]byte(`{"command":"pad","a":` + strconv.Itoa(size) + `,"id":` + id + `}`))
+			if err != nil {
+				t.Fatalf("pad %d: unexpected error %v", size, err)
+			}
+			if len(out) != size {
+				t.Errorf("pad %d with id %s: got %d bytes", size, id, len(out))
+			}
+			var resp struct {
+				Error string          `json:"error"`
+				ID    json.RawMessage `json:"id"`
+			}
+			if err := json.Unmarshal(out, &resp); err != nil || resp.Error != "" || string(resp.ID) != id {
+				t.Errorf("pad %d with id %s: got %s, %v", size, id, out, err)
+			}
+		}
+	}
+
+	// The minimum grows with the id
+	out, _ := processCommand([]byte(`{"command":"pad","a":43,"id":"req-1"}`))
+	if resp := decodeResponse(t, out); !strings.Contains(resp.Error, "at least") {
+		t.Errorf("got %s expected the minimum size error", out)
+	}
+}
+
+func TestProcessPadRejectsBadSizes(t *testing.T) {
+	tests := map[string]string{
+		`{"command":"pad","a":10}`:    "at least",
+		`{"command":"pad","a":1e9}`:   "write limit",
+		`{"command":"pad","a":100.5}`: "whole number",
+	}
+	for payload, want := range tests {
+		out, err := processCommand([]byte(payload))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", payload, err)
+		}
+		if resp := decodeResponse(t, out); !strings.Contains(resp.Error, want) {
+			t.Errorf("%s: got error %q expected it to mention %q", payload, resp.Error, want)
+		}
+	}
+}
+
+func TestProcessMatMul(t *testing.T) {
+	out, err := processCommand([]byte(`{"command":"matmul","m1":[[1,2],[3,4]],"m2":[[5,6],[7,8]]}`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := `{"command":"matmul","matrix":[[19,22],[43,50]]}`
+	if string(out) != want {
+		t.Errorf("got %s expected %s", out, want)
+	}
+}
+
+func TestProcessMatMulRejectsBadShapes(t *testing.T) {
+	tests := map[string]string{
+		`{"command":"matmul","m1":[[1,2,3]],"m2":[[1],[2]]}`:                                   "dimension mismatch",
+		`{"command":"matmul","m1":[[1,2],[3]],"m2":[[1],[2]]}`:                                 "row 1",
+		`{"command":"matmul","m1":[],"m2":[[1]]}`:                                              "non-empty",
+		`{"command":"matmul","m1":[[` + strings.Repeat("1,", maxMatrixDim) + `1]],"m2":[[1]]}`: "maximum size",
+	}
+	for payload, want := range tests {
+		out, err := processCommand([]byte(payload))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", payload, err)
+		}
+		if resp := decodeResponse(t, out); !strings.Contains(resp.Error, want) {
+			t.Errorf("%s: got error %q expected it to mention %q", payload, resp.Error, want)
+		}
+	}
+}
+
+func TestProcessNowFormatsAgree(t *testing.T) {
+	out, err := processCommand([]byte(`{"command":"now"}`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var resp NowResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, resp.RFC3339)
+	if err != nil {
+		t.Fatalf("bad rfc3339 %q: %v", resp.RFC3339, err)
+	}
+	if parsed.UnixNano() != resp.UnixNano || resp.UnixNano/1e6 != resp.UnixMilli || resp.UnixNano/1e9 != resp.Unix {
+		t.Errorf("formats disagree: %+v", resp)
+	}
+	if resp.MonotonicNs <= 0 {
+		t.Errorf("got monotonic reading %d expected a positive value", resp.MonotonicNs)
+	}
+}
+
+func TestProcessJSONTree(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{"a":[1,"x"]}`, `{"command":"jsontree","tree":{"a":["array of [number, string]"]}}`},
+		{`[{"id":1},{"id":2},{"id":"x"}]`, `{"command":"jsontree","tree":[{"id":"number"},{"id":"string"}]}`},
+		{`{"ok":true,"n":null,"s":"hi"}`, `{"command":"jsontree","tree":{"n":"null","ok":"boolean","s":"string"}}`},
+		{`[]`, `{"command":"jsontree","tree":["array of []"]}`},
+		{`42`, `{"command":"jsontree","tree":"number"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: "jsontree", Text: tt.text})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.text, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("jsontree %s got %s expected %s", tt.text, out, tt.want)
+		}
+	}
+}
+
+func TestProcessJSONTreeErrors(t *testing.T) {
+	deep := strings.Repeat("[", maxJSONTreeDepth+2) + strings.Repeat("]", maxJSONTreeDepth+2)
+	for text, want := range map[string]string{`{"a":`: "not valid JSON", deep: "nested deeper"} {
+		payload, _ := json.Marshal(CommandRequest{Command: "jsontree", Text: text})
+		out, _ := processCommand(payload)
+		if resp := decodeResponse(t, out); !strings.Contains(resp.Error, want) {
+			t.Errorf("jsontree %.20q got error %q expected it to mention %q", text, resp.Error, want)
+		}
+	}
+}
+
+func TestProcessCommandParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		payload string
+		offset  int64
+		hint    string
+	}{
+		{`{"command":"add","a":1,}`, 24, "trailing comma"},
+		{`{'command':"add"}`, 2, "double quotes"},
+		{`{"command":"add","a":1`, 22, "ended early"},
+		{`{"command":"add","a":"one"}`, 26, `field "a" expects a float64`},
+	}
+	for _, tt := range tests {
+		out, err := processCommand([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.payload, err)
+		}
+		resp := decodeResponse(t, out)
+		if resp.Offset == nil || *resp.Offset != tt.offset {
+			t.Errorf("%s: got offset %v expected %d", tt.payload, resp.Offset, tt.offset)
+		}
+		if !strings.Contains(resp.Hint, tt.hint) {
+			t.Errorf("%s: got hint %q expected it to mention %q", tt.payload, resp.Hint, tt.hint)
+		}
+		if resp.Snippet == "" || !strings.Contains(tt.payload, resp.Snippet) {
+			t.Errorf("%s: got snippet %q", tt.payload, resp.Snippet)
+		}
+	}
+}
+
+func TestProcessCommandPower(t *testing.T) {
+	tests := []struct {
+		a, b float64
+		want string
+	}{
+		{2, 10, `{"result":1024,"command":"power"}`},
+		{0, 0, `{"result":1,"command":"power"}`},
+		{9, 0.5, `{"result":3,"command":"power"}`},
+		{2, -1, `{"result":0.5,"command":"power"}`},
+		{-8, 1.0 / 3, `{"command":"power","error":"result is not a number"}`},
+		{10, 400, `{"command":"power","error":"result is out of range"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: "power", A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("power(%v, %v) got %s expected %s", tt.a, tt.b, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandModulo(t *testing.T) {
+	tests := []struct {
+		a, b float64
+		want string
+	}{
+		{7, 3, `{"result":1,"command":"modulo"}`},
+		{-7, 3, `{"result":-1,"command":"modulo"}`},
+		{7, -3, `{"result":1,"command":"modulo"}`},
+		{5.5, 2, `{"result":1.5,"command":"modulo"}`},
+		{6, 3, `{"command":"modulo"}`},
+		{1, 0, `{"command":"modulo","error":"modulo by zero"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: "modulo", A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("modulo(%v, %v) got %s expected %s", tt.a, tt.b, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandPercent(t *testing.T) {
+	tests := []struct {
+		command string
+		a, b    float64
+		want    string
+	}{
+		{"percent", 15, 200, `{"result":30,"command":"percent"}`},
+		{"percent", 50, -8, `{"result":-4,"command":"percent"}`},
+		{"percent", 10, 0, `{"command":"percent"}`},
+		{"percent_of", 30, 200, `{"result":15,"command":"percent_of"}`},
+		{"percent_of", 3, 2, `{"result":150,"command":"percent_of"}`},
+		{"percent_of", 0, 5, `{"command":"percent_of"}`},
+		{"percent_of", 1, 0, `{"command":"percent_of","error":"division by zero"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: tt.command, A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s(%v, %v) got %s expected %s", tt.command, tt.a, tt.b, out, tt.want)
+		}
+	}
+}
+
+func TestCommandAliases(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"command":"+","a":1,"b":2}`, `{"result":3,"command":"add"}`},
+		{`{"command":"-","a":5,"b":2}`, `{"result":3,"command":"subtract"}`},
+		{`{"command":"*","a":3,"b":4}`, `{"result":12,"command":"multiply"}`},
+		{`{"command":"x","a":3,"b":4}`, `{"result":12,"command":"multiply"}`},
+		{`{"command":"/","a":8,"b":2}`, `{"result":4,"command":"divide"}`},
+		{`{"command":"/","a":1,"b":0}`, `{"command":"divide","error":"division by zero"}`},
+		{`{"command":"%","a":7,"b":3}`, `{"command":"%","error":"unknown command: %"}`},
+	}
+	for _, tt := range tests {
+		out, err := processCommand([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s got %s expected %s", tt.payload, out, tt.want)
+		}
+	}
+}
+
+func TestCommandAliasesOverConnection(t *testing.T) {
+	c := DefaultConfig()
+	c.DisabledCommands = []string{"divide"}
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	for _, tt := range []struct{ msg, want string }{
+		{`{"command":"x","a":2,"b":3}`, `{"result":6,"command":"multiply"}`},
+		{`[{"command":"+","a":1,"b":1},{"command":"-","a":1,"b":1}]`, `[{"result":2,"command":"add"},{"command":"subtract"}]`},
+		// Disabling a command disables its aliases too
+		{`{"command":"/","a":4,"b":2}`, `{"command":"divide","error":"command disabled"}`},
+		{`{"jsonrpc":"2.0","method":"*","params":{"a":2,"b":5},"id":1}`, `{"jsonrpc":"2.0","result":10,"id":1}`},
+	} {
+		if got := roundTrip(t, conn, tt.msg); got != tt.want {
+			t.Errorf("%s got %q expected %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	tests := []struct {
+		payload, want string
+	}{
+		{
+			`[{"command":"add","a":1,"b":2},{"command":"divide","a":1,"b":0},{"command":"multiply","a":3,"b":4}]`,
+			`[{"result":3,"command":"add"},{"command":"divide","error":"division by zero"},{"result":12,"command":"multiply"}]`,
+		},
+		{`[{"command":"nope"},"x"]`, `[{"command":"nope","error":"unknown command: nope"},`},
+		{`[]`, `[]`},
+		{`[1,`, `{"command":"batch","error":"invalid JSON: unexpected end of JSON input"}`},
+	}
+	for _, tt := range tests {
+		out, err := processBatch([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !strings.HasPrefix(string(out), tt.want) {
+			t.Errorf("batch %s got %s expected %s", tt.payload, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandSqrt(t *testing.T) {
+	tests := []struct {
+		a    float64
+		want string
+	}{
+		{16, `{"result":4,"command":"sqrt"}`},
+		{0, `{"command":"sqrt"}`},
+		{2, `{"result":1.4142135623730951,"command":"sqrt"}`},
+		{-4, `{"command":"sqrt","error":"cannot take square root of negative number"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: "sqrt", A: tt.a, B: 99})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("sqrt(%v) got %s expected %s", tt.a, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandMinMax(t *testing.T) {
+	tests := []struct {
+		command string
+		a, b    float64
+		want    string
+	}{
+		{"min", 3, 7, `{"result":3,"command":"min"}`},
+		{"max", 3, 7, `{"result":7,"command":"max"}`},
+		{"min", -2.5, -1, `{"result":-2.5,"command":"min"}`},
+		{"max", 4, 4, `{"result":4,"command":"max"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: tt.command, A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s(%v, %v) got %s expected %s", tt.command, tt.a, tt.b, out, tt.want)
+		}
+	}
+
+	// JSON can't carry NaN, so check the guard directly
+	for _, command := range []string{"min", "max"} {
+		if _, errMsg := minMax(command, math.NaN(), 1); errMsg != "operand is not a number" {
+			t.Errorf("%s with NaN got error %q expected %q", command, errMsg, "operand is not a number")
+		}
+	}
+}
+
+func TestProcessCommandEval(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"command":"eval","expr":"(1+2)*3"}`, `{"result":9,"command":"eval"}`},
+		{`{"command":"eval","expr":"1 + 2 * 3"}`, `{"result":7,"command":"eval"}`},
+		{`{"command":"eval","expr":"1 +"}`, `{"command":"eval","error":"unexpected end of expression"}`},
+		{`{"command":"eval","expr":"4 / 0"}`, `{"command":"eval","error":"division by zero"}`},
+	}
+	for _, tt := range tests {
+		out, err := processCommand([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s got %s expected %s", tt.payload, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandNonFiniteResults(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"command":"add","a":1e308,"b":1e308}`, `{"command":"add","error":"result is out of range"}`},
+		{`{"command":"subtract","a":-1e308,"b":1e308}`, `{"command":"subtract","error":"result is out of range"}`},
+		{`{"command":"multiply","a":1e200,"b":1e200}`, `{"command":"multiply","error":"result is out of range"}`},
+		{`{"command":"divide","a":1e308,"b":1e-308}`, `{"command":"divide","error":"result is out of range"}`},
+		{`{"command":"eval","expr":"0/0"}`, `{"command":"eval","error":"division by zero"}`},
+		{`{"command":"matmul","m1":[[1e200]],"m2":[[1e200]]}`, `{"command":"matmul","error":"result is out of range"}`},
+		{`{"command":"eval","expr":"` + strings.Repeat("9", 200) + ` * ` + strings.Repeat("9", 200) + `"}`, `{"command":"eval","error":"result is out of range"}`},
+	}
+	for _, tt := range tests {
+		out, err := processCommand([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.payload, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s got %s expected %s", tt.payload, out, tt.want)
+		}
+	}
+}
+
+func TestProcessMovingAverageOverflow(t *testing.T) {
+	avg := &MovingAverage{}
+	req := CommandRequest{Command: "movingavg", A: math.MaxFloat64, Window: 2}
+	if _, err := processMovingAverage(avg, req); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	out, err := processMovingAverage(avg, req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := `{"command":"movingavg","count":2,"error":"result is out of range"}`; string(out) != want {
+		t.Errorf("got %s expected %s", out, want)
+	}
+}
+
+func TestRequestIDIsEchoed(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"command":"add","a":1,"b":2,"id":"req-1"}`, `{"result":3,"command":"add","id":"req-1"}`},
+		{`{"command":"divide","a":1,"b":0,"id":"req-2"}`, `{"command":"divide","error":"division by zero","id":"req-2"}`},
+		{`{"command":"nope","id":42}`, `{"command":"nope","error":"unknown command: nope","id":42}`},
+		{`{"command":"qr","text":"","id":"q"}`, `{"command":"qr","error":"text must be 1 to 17 bytes","id":"q"}`},
+		{`{"command":"add","a":1,"b":2}`, `{"result":3,"command":"add"}`},
+		{`{"command":"add","a":1,"b":2,"id":null}`, `{"result":3,"command":"add"}`},
+	}
+	for _, tt := range tests {
+		out, err := processCommand([]byte(tt.payload))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.payload, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s got %s expected %s", tt.payload, out, tt.want)
+		}
+	}
+}
+
+func TestRequestIDRejectsOtherTypes(t *testing.T) {
+	out, err := processCommand([]byte(`{"command":"add","id":true}`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp := decodeResponse(t, out); !strings.Contains(resp.Error, "id must be a string or a number") {
+		t.Errorf("got %q expected an id type error", resp.Error)
+	}
+}
+
+func TestRequestIDIsEchoedByStatefulCommands(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	payload := `{"command":"movingavg","a":4,"window":2,"id":"m1"}`
+	if got := c.respond(payload, []byte(payload)).body; got != `{"result":4,"command":"movingavg","count":1,"id":"m1"}` {
+		t.Errorf("got %s expected the id echoed", got)
+	}
+}
+
+func TestProcessCommandFactorial(t *testing.T) {
+	tests := []struct {
+		a    float64
+		want string
+	}{
+		{0, `{"result":1,"command":"factorial"}`},
+		{1, `{"result":1,"command":"factorial"}`},
+		{10, `{"result":3628800,"command":"factorial"}`},
+		{170, `{"result":7.257415615307994e+306,"command":"factorial"}`},
+		{171, `{"command":"factorial","error":"factorial input too large"}`},
+		{2.5, `{"command":"factorial","error":"factorial needs a non-negative whole number"}`},
+		{-3, `{"command":"factorial","error":"factorial needs a non-negative whole number"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: "factorial", A: tt.a})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("factorial(%v) got %s expected %s", tt.a, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandGCDAndLCM(t *testing.T) {
+	tests := []struct {
+		command string
+		a, b    float64
+		want    string
+	}{
+		{"gcd", 9, 28, `{"result":1,"command":"gcd"}`},
+		{"lcm", 9, 28, `{"result":252,"command":"lcm"}`},
+		{"gcd", 12, 18, `{"result":6,"command":"gcd"}`},
+		{"lcm", 12, 18, `{"result":36,"command":"lcm"}`},
+		{"gcd", -12, 18, `{"result":6,"command":"gcd"}`},
+		{"lcm", 12, -18, `{"result":36,"command":"lcm"}`},
+		{"gcd", 0, 0, `{"command":"gcd"}`},
+		{"gcd", 0, 7, `{"result":7,"command":"gcd"}`},
+		{"lcm", 0, 7, `{"command":"lcm"}`},
+		{"lcm", 7, 0, `{"command":"lcm"}`},
+		{"lcm", 0, 0, `{"command":"lcm"}`},
+		{"lcm", 1 << 53, (1 << 53) - 1, `{"command":"lcm","error":"result is out of range"}`},
+		{"gcd", 1.5, 3, `{"command":"gcd","error":"operands must be whole numbers up to 9007199254740992 in magnitude"}`},
+		{"lcm", 4, 1e300, `{"command":"lcm","error":"operands must be whole numbers up to 9007199254740992 in magnitude"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: tt.command, A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s(%v, %v) got %s expected %s", tt.command, tt.a, tt.b, out, tt.want)
+		}
+	}
+}
+
+func TestPingSeqInOrder(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	for _, seq := range []string{"1", "2", "3"} {
+		payload := `{"command":"ping_seq","seq":` + seq + `}`
+		if got, want := c.respond(payload, []byte(payload)).body, `{"command":"ack","seq":`+seq+`}`; got != want {
+			t.Errorf("got %s expected %s", got, want)
+		}
+	}
+}
+
+func TestPingSeqFlagsGapsAndRepeats(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"command":"ping_seq","seq":5}`, `{"command":"ack","seq":5}`},
+		{`{"command":"ping_seq","seq":8}`, `{"command":"ack","seq":8,"gap_detected":true,"expected":6}`},
+		{`{"command":"ping_seq","seq":9}`, `{"command":"ack","seq":9}`},
+		{`{"command":"ping_seq","seq":7}`, `{"command":"ack","seq":7,"out_of_order":true,"expected":10}`},
+		{`{"command":"ping_seq","seq":10,"id":"p"}`, `{"command":"ack","seq":10,"id":"p"}`},
+	}
+	for _, tt := range tests {
+		if got := c.respond(tt.payload, []byte(tt.payload)).body; got != tt.want {
+			t.Errorf("%s: got %s expected %s", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandRound(t *testing.T) {
+	tests := []struct {
+		a, b float64
+		want string
+	}{
+		{2.5, 0, `{"result":3,"command":"round"}`},
+		{-2.5, 0, `{"result":-3,"command":"round"}`},
+		{2.4, 0, `{"result":2,"command":"round"}`},
+		{3.14159, 2, `{"result":3.14,"command":"round"}`},
+		{0.125, 2, `{"result":0.13,"command":"round"}`},
+		{1234.5678, 0, `{"result":1235,"command":"round"}`},
+		{1.5, 100, `{"result":1.5,"command":"round"}`},
+		{1e300, 15, `{"result":1e+300,"command":"round"}`},
+		{1.5, -1, `{"command":"round","error":"places must be a non-negative whole number"}`},
+		{1.5, 1.5, `{"command":"round","error":"places must be a non-negative whole number"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: "round", A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("round(%v, %v) got %s expected %s", tt.a, tt.b, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandFloorCeilTrunc(t *testing.T) {
+	tests := []struct {
+		command string
+		a       float64
+		want    float64
+	}{
+		{"floor", 2.5, 2},
+		{"ceil", 2.5, 3},
+		{"trunc", 2.5, 2},
+		{"floor", -2.5, -3},
+		{"ceil", -2.5, -2},
+		{"trunc", -2.5, -2},
+		{"floor", -3, -3},
+		{"ceil", 0.1, 1},
+		{"trunc", -0.9, 0},
+	}
+	for _, tt := range tests {
+		// b is ignored
+		payload, _ := json.Marshal(CommandRequest{Command: tt.command, A: tt.a, B: 7})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if resp := decodeResponse(t, out); resp.Result != tt.want || resp.Error != "" {
+			t.Errorf("%s(%v) got %s expected %v", tt.command, tt.a, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandAbsAndNegate(t *testing.T) {
+	tests := []struct {
+		command string
+		a       float64
+		want    string
+	}{
+		{"abs", 3.5, `{"result":3.5,"command":"abs"}`},
+		{"abs", -3.5, `{"result":3.5,"command":"abs"}`},
+		{"abs", 0, `{"command":"abs"}`},
+		{"abs", -math.MaxFloat64, `{"result":1.7976931348623157e+308,"command":"abs"}`},
+		{"negate", 3.5, `{"result":-3.5,"command":"negate"}`},
+		{"negate", -3.5, `{"result":3.5,"command":"negate"}`},
+		{"negate", 0, `{"command":"negate"}`},
+		{"negate", math.MaxFloat64, `{"result":-1.7976931348623157e+308,"command":"negate"}`},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: tt.command, A: tt.a})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s(%v) got %s expected %s", tt.command, tt.a, out, tt.want)
+		}
+	}
+}
+
+func TestProcessCommandLogarithms(t *testing.T) {
+	tests := []struct {
+		command string
+		a, b    float64
+		want    float64
+		err     string
+	}{
+		{command: "ln", a: math.E, want: 1},
+		{command: "ln", a: 1, want: 0},
+		{command: "log", a: 8, b: 2, want: 3},
+		{command: "log", a: 0.01, b: 10, want: -2},
+		{command: "ln", a: 0, err: "logarithm of non-positive number"},
+		{command: "log", a: -8, b: 2, err: "logarithm of non-positive number"},
+		{command: "log", a: 8, b: 1, err: "logarithm base must be positive and not 1"},
+		{command: "log", a: 8, b: 0, err: "logarithm base must be positive and not 1"},
+		{command: "log", a: 8, b: -2, err: "logarithm base must be positive and not 1"},
+	}
+	for _, tt := range tests {
+		payload, _ := json.Marshal(CommandRequest{Command: tt.command, A: tt.a, B: tt.b})
+		out, err := processCommand(payload)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp := decodeResponse(t, out)
+		if resp.Error != tt.err || math.Abs(resp.Result-tt.want) > 1e-12 {
+			t.Errorf("%s(%v, %v) got %s expected result %v, error %q", tt.command, tt.a, tt.b, out, tt.want, tt.err)
+		}
+	}
+}
+
+func TestProcessPingEchoesTimestamp(t *testing.T) {
+	for _, ts := range []string{"1700000000123", "12.75", ""} {
+		payload := `{"command":"ping"}`
+		if ts != "" {
+			payload = `{"command":"ping","ts":` + ts + `}`
+		}
+		before := time.Now().UnixMilli()
+		out, err := processCommand([]byte(payload))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var resp struct {
+			Command  string          `json:"command"`
+			TS       json.RawMessage `json:"ts"`
+			ServerTS int64           `json:"server_ts"`
+		}
+		if err := json.Unmarshal(out, &resp); err != nil {
+			t.Fatalf("invalid JSON %q: %v", out, err)
+		}
+		if resp.Command != "pong" || string(resp.TS) != ts {
+			t.Errorf("%s: got %s expected a pong with ts %q", payload, out, ts)
+		}
+		if resp.ServerTS < before || resp.ServerTS > time.Now().UnixMilli() {
+			t.Errorf("%s: got server_ts %d expected the current time", payload, resp.ServerTS)
+		}
+	}
+}
+
+func TestProcessServerInfo(t *testing.T) {
+	out, err := processCommand([]byte(`{"command":"server_info"}`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var resp struct {
+		StartedAt     string  `json:"started_at"`
+		Uptime        string  `json:"uptime"`
+		UptimeSeconds float64 `json:"uptime_seconds"`
+		GoVersion     string  `json:"go_version"`
+		Version       *string `json:"version"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+	if resp.UptimeSeconds < 0 {
+		t.Errorf("got uptime %v expected it to be non-negative", resp.UptimeSeconds)
+	}
+	if _, err := time.ParseDuration(resp.Uptime); err != nil {
+		t.Errorf("got uptime %q expected a duration: %v", resp.Uptime, err)
+	}
+	if started, err := time.Parse(time.RFC3339Nano, resp.StartedAt); err != nil || started.After(time.Now()) {
+		t.Errorf("got started_at %q expected a time in the past", resp.StartedAt)
+	}
+	if resp.Version == nil || *resp.Version == "" || !strings.HasPrefix(resp.GoVersion, "go") {
+		t.Errorf("got %s expected the build and Go versions", out)
+	}
+}
+
+func TestCommandAllowAndDenyLists(t *testing.T) {
+	const divide = `{"command":"divide","a":6,"b":3,"id":1}`
+	disabled := `{"command":"divide","error":"command disabled","id":1}`
+	for _, tt := range []struct {
+		name              string
+		enabled, disabled []string
+		msg, want         string
+	}{
+		{"default", nil, nil, divide, `{"result":2,"command":"divide","id":1}`},
+		{"denied", nil, []string{"divide"}, divide, disabled},
+		{"other command", nil, []string{"divide"}, `{"command":"add","a":1,"b":2}`, `{"result":3,"command":"add"}`},
+		{"allowed", []string{"divide"}, nil, divide, `{"result":2,"command":"divide","id":1}`},
+		{"not allowed", []string{"add"}, nil, divide, disabled},
+		{"denylist wins", []string{"divide"}, []string{"divide"}, divide, disabled},
+		{"stateful", nil, []string{"whoami"}, `{"command":"whoami"}`, `{"command":"whoami","error":"command disabled"}`},
+		{"batch", nil, []string{"divide"}, `[{"command":"divide","a":6,"b":3}]`, `[{"command":"divide","error":"command disabled"}]`},
+		{"json-rpc", nil, []string{"divide"}, `{"jsonrpc":"2.0","method":"divide","params":{"a":6,"b":3},"id":1}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"command disabled"},"id":1}`},
+	} {
+		c := DefaultConfig()
+		c.EnabledCommands, c.DisabledCommands = tt.enabled, tt.disabled
+		withConfig(t, c)
+		conn := dialTestServer(t, newTestServer(t))
+		if got := roundTrip(t, conn, tt.msg); got != tt.want {
+			t.Errorf("%s: got %q expected %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Filename: internal/ws/config.go
+
+package ws
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the tunable server settings. A zero threshold disables the
+// check it controls.
+type Config struct {
+	// Load shedding: new upgrades are rejected with 503 while any of these
+	// signals is above its threshold.
+	ShedMaxGoroutines  int           // runtime.NumGoroutine()
+	ShedMaxConnections int64         // currently open WebSocket connections
+	ShedMaxMessageRate float64       // moving average of messages per second
+	ShedRetryAfter     time.Duration // value advertised in the Retry-After header
+
+	// Heartbeat: a ping is sent every PingPeriod and the connection closes if
+	// no pong arrives within PongWait. Writes give up after WriteWait.
+	WriteWait  time.Duration
+	PongWait   time.Duration
+	PingPeriod time.Duration
+
+	// Outgoing messages queued per connection. A client that falls this far
+	// behind on broadcasts is disconnected as a slow consumer.
+	SendQueueSize int
+
+	// Share write buffers between connections instead of giving each one its
+	// own for its lifetime. Saves memory with many mostly idle clients.
+	WriteBufferPool bool
+
+	// Maximum timers a single connection may have active; each delayed
+	// response holds one until it is sent
+	MaxTimersPerConnection int
+
+	// Largest response payload the server will generate, in bytes
+	MaxWriteBytes int
+
+	// Per-IP rate limit shared by all of a client's connections, applied on
+	// top of the per-connection limit. TrustProxy takes the client IP from
+	// X-Forwarded-For, which is only safe behind a proxy that sets it.
+	IPMaxMessages int
+	IPRateWindow  time.Duration
+	TrustProxy    bool
+
+	// Shared secret clients must present as "Authorization: Bearer <token>"
+	// or ?token=<token> to connect; empty allows everyone
+	AuthToken string
+
+	// Largest message a client may send, in bytes; bigger messages close the
+	// connection with 1009
+	MaxMessageBytes int
+
+	// permessage-deflate (RFC 7692), negotiated with clients that offer it.
+	// Compression costs CPU, so it's off by default and only data frames of
+	// at least CompressionThreshold bytes are compressed, at
+	// CompressionLevel (flate levels -2 to 9).
+	Compression          bool
+	CompressionThreshold int
+	CompressionLevel     int
+
+	// Whether BROADCAST:, SAMPLEBROADCAST: and ROOM: messages are also sent
+	// back to their sender
+	BroadcastEchoToSender bool
+
+	// Format of every response, with the placeholders {id} and {body}. Empty
+	// sends the body alone, for clients that want a pure echo.
+	ResponseTemplate string
+
+	// Hold every response back this long, to simulate a slow link
+	EchoDelay time.Duration
+
+	// Fault injection for testing client retries: each message is answered
+	// with an injected error with probability ErrorRate, or dropped without a
+	// reply with probability DropRate. A non-zero FaultSeed makes the choice
+	// of messages repeatable.
+	ErrorRate float64
+	DropRate  float64
+	FaultSeed uint64
+
+	// Number each connection's responses #1, #2, ... on its own instead of
+	// from the server-wide message counter, which still counts every message
+	PerConnectionCounter bool
+
+	// Whether the stats command reports the connection's own command counts
+	// rather than the server-wide ones
+	PerConnectionStats bool
+
+	// Run every connection as a strict RFC 6455 echo server for conformance
+	// testing
+	ConformanceMode bool
+
+	// Offer the echo.strict subprotocol so clients can opt in to strict echo
+	// per connection. Strict connections skip rate limits and the hub, so
+	// it is off by default.
+	StrictSubprotocol bool
+
+	// JSON commands clients may use. If EnabledCommands is set only those
+	// are allowed; commands in DisabledCommands never are. Others get
+	// "command disabled".
+	EnabledCommands  []string
+	DisabledCommands []string
+
+	// Accept upgrade requests with no Origin header, as sent by CLIs and load
+	// testers. They get the development profile.
+	AllowEmptyOrigin bool
+
+	// Subprotocols accepted on top of the built-in echo.strict, json.v1 and
+	// echo.v1, with no behaviour of their own
+	Subprotocols []string
+
+	// Extra headers sent on the 101 handshake response: HandshakeHeaders on
+	// every upgrade, plus whatever HandshakeHeaderFunc returns for the request
+	HandshakeHeaders    http.Header
+	HandshakeHeaderFunc func(r *http.Request) http.Header
+}
+
+// DefaultConfig returns the settings used when Configure is never called.
+func DefaultConfig() Config {
+	return Config{
+		ShedRetryAfter:         5 * time.Second,
+		WriteWait:              defaultWriteWait,
+		PongWait:               defaultPongWait,
+		PingPeriod:             defaultPingPeriod,
+		SendQueueSize:          sendQueueSize,
+		MaxTimersPerConnection: 10,
+		MaxWriteBytes:          64 * 1024,
+		MaxMessageBytes:        4 * 1024,
+		IPRateWindow:           time.Minute,
+		CompressionThreshold:   1024,
+		CompressionLevel:       flate.BestSpeed,
+		ResponseTemplate:       defaultTemplate,
+	}
+}
+
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	c := DefaultConfig()
+	currentConfig.Store(&c)
+}
+
+// cfg returns the active configuration
+func cfg() *Config {
+	return currentConfig.Load()
+}
+
+// Configure validates c and makes it the active configuration
+func Configure(c Config) error {
+	if c.ShedMaxGoroutines < 0 || c.ShedMaxConnections < 0 || c.ShedMaxMessageRate < 0 {
+		return errors.New("load shedding thresholds must not be negative")
+	}
+	if c.ShedRetryAfter < 0 {
+		return errors.New("shed retry-after must not be negative")
+	}
+	if c.WriteWait <= 0 || c.PongWait <= 0 || c.PingPeriod <= 0 {
+		return errors.New("write wait, pong wait and ping period must be positive")
+	}
+	if c.PingPeriod >= c.PongWait {
+		return errors.New("ping period must be shorter than pong wait")
+	}
+	if c.SendQueueSize < 1 {
+		return errors.New("send queue size must be positive")
+	}
+	if c.MaxTimersPerConnection < 0 {
+		return errors.New("max timers per connection must not be negative")
+	}
+	if c.MaxWriteBytes < 1 {
+		return errors.New("max write bytes must be positive")
+	}
+	if c.IPMaxMessages < 0 {
+		return errors.New("per-IP message limit must not be negative")
+	}
+	if c.IPMaxMessages > 0 && c.IPRateWindow <= 0 {
+		return errors.New("per-IP rate window must be positive")
+	}
+	if c.MaxMessageBytes < 1 {
+		return errors.New("max message bytes must be positive")
+	}
+	if c.ResponseTemplate != "" && !strings.Contains(c.ResponseTemplate, "{body}") {
+		return errors.New("response template must contain {body}")
+	}
+	if c.EchoDelay < 0 || c.EchoDelay > maxEchoDelay {
+		return fmt.Errorf("echo delay must be between 0 and %v", maxEchoDelay)
+	}
+	if c.ErrorRate < 0 || c.DropRate < 0 || c.ErrorRate+c.DropRate > 1 {
+		return errors.New("error and drop rates must not be negative and must add up to at most 1")
+	}
+	if c.CompressionThreshold < 0 {
+		return errors.New("compression threshold must not be negative")
+	}
+	if c.CompressionLevel < flate.HuffmanOnly || c.CompressionLevel > flate.BestCompression {
+		return fmt.Errorf("compression level must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+	for name := range c.HandshakeHeaders {
+		if reservedHandshakeHeader(name) {
+			return fmt.Errorf("handshake header %s is set by the server", name)
+		}
+	}
+	for _, p := range c.Subprotocols {
+		if !validSubprotocol(p) {
+			return fmt.Errorf("invalid subprotocol %q", p)
+		}
+	}
+	c.HandshakeHeaders = c.HandshakeHeaders.Clone()
+	c.Subprotocols = append([]string(nil), c.Subprotocols...)
+	c.EnabledCommands = append([]string(nil), c.EnabledCommands...)
+	c.DisabledCommands = append([]string(nil), c.DisabledCommands...)
+	currentConfig.Store(&c)
+	return nil
+}
+
+// CurrentConfig returns a copy of the active configuration
+func CurrentConfig() Config {
+	return *cfg()
+}
@@ -0,0 +1,839 @@
+// Filename: internal/ws/connection.go
+
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Longest group name accepted by the join command
+const maxGroupName = 64
+
+// Outgoing frames buffered per connection; Config.SendQueueSize overrides
+// the data queue
+const (
+	sendQueueSize    = 64
+	controlQueueSize = 8
+)
+
+var (
+	// ErrConnectionClosed is returned when sending on a connection whose writer has stopped
+	ErrConnectionClosed = errors.New("connection closed")
+
+	// ErrSendQueueFull is returned by TrySend when a slow client has too many frames queued
+	ErrSendQueueFull = errors.New("send queue full")
+
+	errCloseTimeout    = errors.New("timed out sending close frame")
+	errMessageTooLarge = errors.New("message too large")
+	errInvalidUTF8     = errors.New("invalid UTF-8 in text frame")
+)
+
+// Source of connection ids
+var connectionCounter uint64
+
+// ConnectionMetrics counts the traffic on a single connection
+type ConnectionMetrics struct {
+	MessagesIn  uint64    `json:"messagesIn"`
+	MessagesOut uint64    `json:"messagesOut"`
+	BytesIn     uint64    `json:"bytesIn"`
+	BytesOut    uint64    `json:"bytesOut"`
+	Connected   time.Time `json:"connected"`
+}
+
+// Connection holds everything the server keeps for one WebSocket client
+type Connection struct {
+	ID         uint64
+	RemoteAddr string
+	Profile    OriginProfile
+
+	conn *websocket.Conn
+	hub  *ClientHub
+
+	// Set when the client negotiated json.v1
+	jsonOnly bool
+
+	// Group joined with the join command, rooms joined with JOIN: and the
+	// name taken with NAME:, all guarded by the hub's mutex
+	group string
+	rooms map[string]bool
+	name  string
+
+	// Frames from the handler, the hub and the control handlers are queued
+	// on send and control and written by writePump alone; gorilla/websocket
+	// allows only one concurrent writer. quit asks the writer to flush and
+	// stop; done is closed when it has.
+	send      chan dataFrame
+	control   chan controlFrame
+	quit      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+	closeSent bool // owned by writePump
+
+	// When the client last sent a message or pong, in Unix nanoseconds and
+	// updated atomically, and the activity time writePump last sent an
+	// idle warning for (owned by writePump)
+	lastActive int64
+	idleWarned int64
+
+	// Responses are held back by echoDelay, or a DELAY: prefix's value; held
+	// responses wait in delayed, oldest first, each on one of the timers
+	echoDelay time.Duration
+	delayed   []delayedFrame
+	delayMu   sync.Mutex
+
+	// Heartbeat settings from the configuration when the connection opened
+	writeWait, pongWait, pingPeriod time.Duration
+
+	// Data frames of at least compressMin bytes are compressed when compress
+	// is set; owned by writePump
+	compress    bool
+	compressMin int
+
+	// Traffic counters, updated atomically
+	messagesIn  uint64
+	messagesOut uint64
+	bytesIn     uint64
+	bytesOut    uint64
+	connected   time.Time
+
+	rateLimiter    MessageLimiter
+	controlLimiter MessageLimiter
+	ipLimiter      *RateLimiter // shared with the client's other connections; nil when off
+	history        *CommandHistory
+	flags          *FeatureFlags
+	movingAvg      *MovingAverage
+	seqs           *SeqTracker
+	stats          *CommandStats
+	acks           *AckWindow
+	digest         *ChunkDigest
+	trace          *TraceBuffer
+	sent           *ReplayBuffer
+	dialog         *Dialog
+	variants       *VariantRotator
+	timers         *TimerSet
+	faults         *FaultInjector
+}
+
+// NewConnection wraps conn with fresh per-connection state. Limits and
+// features come from profile.
+func NewConnection(conn *websocket.Conn, remoteAddr string, profile OriginProfile) *Connection {
+	return &Connection{
+		ID:             atomic.AddUint64(&connectionCounter, 1),
+		RemoteAddr:     remoteAddr,
+		Profile:        profile,
+		conn:           conn,
+		send:           make(chan dataFrame, cfg().SendQueueSize),
+		control:        make(chan controlFrame, controlQueueSize),
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
+		connected:      time.Now(),
+		lastActive:     time.Now().UnixNano(),
+		writeWait:      cfg().WriteWait,
+		pongWait:       cfg().PongWait,
+		pingPeriod:     cfg().PingPeriod,
+		echoDelay:      cfg().EchoDelay,
+		compress:       cfg().Compression,
+		compressMin:    cfg().CompressionThreshold,
+		rateLimiter:    profile.limiter(),
+		controlLimiter: NewRateLimiter(controlMaxMessages, controlWindow),
+		history:        NewCommandHistory(profile.HistorySize),
+		flags:          NewFeatureFlags(),
+		movingAvg:      NewMovingAverage(),
+		seqs:           NewSeqTracker(),
+		stats:          NewCommandStats(),
+		acks:           NewAckWindow(),
+		digest:         NewChunkDigest(),
+		trace:          NewTraceBuffer(),
+		sent:           NewReplayBuffer(),
+		dialog:         NewDialog(),
+		variants:       NewVariantRotator(),
+		timers:         NewTimerSet(cfg().MaxTimersPerConnection),
+		faults:         NewFaultInjector(cfg().ErrorRate, cfg().DropRate, faultSeed(cfg())),
+		rooms:          make(map[string]bool),
+	}
+}
+
+// Name identifies the connection in logs and broadcast receipts
+func (c *Connection) Name() string {
+	return fmt.Sprintf("id%d", c.ID)
+}
+
+// dataFrame is a text or binary message queued for writePump
+type dataFrame struct {
+	kind int
+	data []byte
+}
+
+// Send queues a text message for the client, waiting while the queue is full
+func (c *Connection) Send(data []byte) error {
+	return c.queue(dataFrame{websocket.TextMessage, data})
+}
+
+// SendBinary queues a binary message for the client, waiting while the queue is full
+func (c *Connection) SendBinary(data []byte) error {
+	return c.queue(dataFrame{websocket.BinaryMessage, data})
+}
+
+// queue waits for room in the send queue
+func (c *Connection) queue(f dataFrame) error {
+	select {
+	case <-c.quit:
+		return ErrConnectionClosed
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+	}
+	select {
+	case c.send <- f:
+		return nil
+	case <-c.quit:
+		return ErrConnectionClosed
+	case <-c.done:
+		return ErrConnectionClosed
+	}
+}
+
+// TrySend queues a text message without waiting, so one slow client can't
+// hold up a broadcast
+func (c *Connection) TrySend(data []byte) error {
+	select {
+	case <-c.quit:
+		return ErrConnectionClosed
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+	}
+	select {
+	case c.send <- dataFrame{websocket.TextMessage, data}:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// controlFrame is a ping, pong or close frame queued for writePump. If
+// result is set it receives the outcome of the write. An abort close drops
+// the queued data instead of flushing it and hangs up once written.
+type controlFrame struct {
+	kind     int
+	data     []byte
+	deadline time.Time
+	result   chan error
+	abort    bool
+}
+
+// writePump owns every write to the connection: queued control frames first,
+// then data frames, plus a ping every pingPeriod. When stopWriter is called it
+// flushes what is queued and returns. On a write error it closes the
+// connection so the read loop ends too.
+func (c *Connection) writePump() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.pingPeriod)
+	defer ticker.Stop()
+	idle := time.NewTimer(c.idleWarnAfter())
+	defer idle.Stop()
+	for {
+		// Control frames jump ahead of queued data
+		select {
+		case f := <-c.control:
+			if !c.writeControl(f) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case f := <-c.control:
+			if !c.writeControl(f) {
+				return
+			}
+		case f := <-c.send:
+			if !c.write(f) {
+				return
+			}
+		case <-ticker.C:
+			if !c.writeControl(controlFrame{kind: websocket.PingMessage, deadline: time.Now().Add(c.writeWait)}) {
+				return
+			}
+			logger().Info("ping sent", "event", "ping", "remote_addr", c.RemoteAddr)
+		case <-idle.C:
+			warning, next := c.checkIdle(time.Now())
+			if warning != nil {
+				if !c.write(dataFrame{kind: websocket.TextMessage, data: warning}) {
+					return
+				}
+				logger().Info("idle warning sent", "event", "idle_warning", "remote_addr", c.RemoteAddr)
+			}
+			idle.Reset(next)
+		case <-c.quit:
+			c.flush()
+			return
+		}
+	}
+}
+
+// touch records activity from the client and extends the read deadline
+func (c *Connection) touch() {
+	now := time.Now()
+	atomic.StoreInt64(&c.lastActive, now.UnixNano())
+	_ = c.conn.SetReadDeadline(now.Add(c.pongWait))
+}
+
+// idleWarnAfter is how long a client may be silent before it is warned
+func (c *Connection) idleWarnAfter() time.Duration {
+	return c.pongWait * idleWarningPercent / 100
+}
+
+// checkIdle returns the idle warning to send if the client has been silent
+// long enough and hasn't been warned about this stretch yet, and how long
+// to wait before checking again
+func (c *Connection) checkIdle(now time.Time) ([]byte, time.Duration) {
+	last := atomic.LoadInt64(&c.lastActive)
+	warnAt := time.Unix(0, last).Add(c.idleWarnAfter())
+	if now.Before(warnAt) {
+		return nil, warnAt.Sub(now)
+	}
+	if c.idleWarned == last {
+		return nil, c.idleWarnAfter()
+	}
+	c.idleWarned = last
+	closingIn := max(time.Unix(0, last).Add(c.pongWait).Sub(now), 0)
+	return []byte(fmt.Sprintf(`{"warning":"idle","closing_in_ms":%d}`, closingIn/time.Millisecond)), c.idleWarnAfter()
+}
+
+// flush writes whatever is still queued without waiting for more
+func (c *Connection) flush() {
+	for {
+		select {
+		case f := <-c.control:
+			if !c.writeControl(f) {
+				return
+			}
+		case f := <-c.send:
+			if !c.write(f) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flushData writes the data frames queued so far, reporting whether the connection is still usable
+func (c *Connection) flushData() bool {
+	for {
+		select {
+		case f := <-c.send:
+			if !c.write(f) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// discardData drops the data frames queued so far
+func (c *Connection) discardData() {
+	for {
+		select {
+		case <-c.send:
+		default:
+			return
+		}
+	}
+}
+
+// write sends one data frame, reporting whether the connection is still usable
+func (c *Connection) write(f dataFrame) bool {
+	if c.closeSent {
+		return true // the client is going away; drop it
+	}
+	if c.compress {
+		// Only takes effect if the client negotiated permessage-deflate
+		c.conn.EnableWriteCompression(len(f.data) >= c.compressMin)
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
+	if err := c.conn.WriteMessage(f.kind, f.data); err != nil {
+		logger().Warn("write failed", "event", "write_error", "remote_addr", c.RemoteAddr, "error", err)
+		_ = c.conn.Close()
+		return false
+	}
+	atomic.AddUint64(&c.messagesOut, 1)
+	atomic.AddUint64(&c.bytesOut, uint64(len(f.data)))
+	return true
+}
+
+// writeControl sends one control frame, reporting whether the connection is still usable
+func (c *Connection) writeControl(f controlFrame) bool {
+	// Pings and pongs may overtake data, but a close goes after what is queued
+	if f.abort {
+		c.discardData()
+	} else if f.kind == websocket.CloseMessage {
+		if !c.flushData() {
+			if f.result != nil {
+				f.result <- ErrConnectionClosed
+			}
+			return false
+		}
+	}
+	err := c.conn.WriteControl(f.kind, f.data, f.deadline)
+	if err == websocket.ErrCloseSent {
+		err = nil
+	}
+	if f.result != nil {
+		f.result <- err
+	}
+	if err != nil {
+		logger().Warn("control write failed", "event", "write_error", "remote_addr", c.RemoteAddr, "frame", controlName(f.kind), "error", err)
+		_ = c.conn.Close()
+		return false
+	}
+	if f.kind == websocket.CloseMessage {
+		c.closeSent = true
+	}
+	if f.abort {
+		_ = c.conn.Close()
+		return false
+	}
+	return true
+}
+
+// controlName names a control frame type for logs
+func controlName(kind int) string {
+	switch kind {
+	case websocket.PingMessage:
+		return "ping"
+	case websocket.PongMessage:
+		return "pong"
+	}
+	return "close"
+}
+
+// stopWriter flushes queued frames and waits for writePump to return
+func (c *Connection) stopWriter() {
+	c.stopOnce.Do(func() { close(c.quit) })
+	<-c.done
+}
+
+// Close sends a close frame with the given code and reason. The underlying
+// connection is closed when HandleWebSocket returns.
+func (c *Connection) Close(code int, reason string) error {
+	return c.closeBefore(code, reason, time.Now().Add(c.writeWait))
+}
+
+// closeSlow disconnects a client that can't keep up with code 1011, without
+// waiting and without writing what it still has queued
+func (c *Connection) closeSlow() error {
+	f := controlFrame{
+		kind:     websocket.CloseMessage,
+		data:     websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "slow consumer"),
+		deadline: time.Now().Add(c.writeWait),
+		abort:    true,
+	}
+	select {
+	case c.control <- f:
+		return nil
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// closeBefore queues a close frame and waits for it to be written, giving up at deadline
+func (c *Connection) closeBefore(code int, reason string, deadline time.Time) error {
+	f := controlFrame{
+		kind:     websocket.CloseMessage,
+		data:     websocket.FormatCloseMessage(code, reason),
+		deadline: deadline,
+		result:   make(chan error, 1),
+	}
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	select {
+	case c.control <- f:
+	case <-c.done:
+		return ErrConnectionClosed
+	case <-timeout.C:
+		return errCloseTimeout
+	}
+	select {
+	case err := <-f.result:
+		return err
+	case <-c.done:
+		return ErrConnectionClosed
+	case <-timeout.C:
+		return errCloseTimeout
+	}
+}
+
+// Metrics returns a snapshot of the connection's traffic counters
+func (c *Connection) Metrics() ConnectionMetrics {
+	return ConnectionMetrics{
+		MessagesIn:  atomic.LoadUint64(&c.messagesIn),
+		MessagesOut: atomic.LoadUint64(&c.messagesOut),
+		BytesIn:     atomic.LoadUint64(&c.bytesIn),
+		BytesOut:    atomic.LoadUint64(&c.bytesOut),
+		Connected:   c.connected,
+	}
+}
+
+// readMessage reads the next message, streaming a fragmented one frame by
+// frame. It returns errMessageTooLarge once the reassembled message passes
+// limit bytes and errInvalidUTF8 for text that RFC 6455 forbids.
+func (c *Connection) readMessage(limit int) (int, []byte, error) {
+	msgType, r, err := c.conn.NextReader()
+	if err != nil {
+		return msgType, nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return msgType, nil, err
+	}
+	if len(data) > limit {
+		return msgType, nil, errMessageTooLarge
+	}
+	if msgType == websocket.TextMessage && !utf8.Valid(data) {
+		return msgType, nil, errInvalidUTF8
+	}
+	return msgType, data, nil
+}
+
+// received counts an incoming message in the metrics
+func (c *Connection) received(payload []byte) {
+	atomic.AddUint64(&c.messagesIn, 1)
+	atomic.AddUint64(&c.bytesIn, uint64(len(payload)))
+}
+
+// allowMessage applies the connection's rate limit and then the limit it
+// shares with its IP, if any. A rejected message reports which limit it hit
+// and how long until that limit lets another through.
+func (c *Connection) allowMessage() (scope string, retry time.Duration, ok bool) {
+	if !c.rateLimiter.AllowMessage() {
+		return "connection", c.rateLimiter.RetryAfter(), false
+	}
+	if c.ipLimiter != nil && !c.ipLimiter.AllowMessage() {
+		return "ip", c.ipLimiter.RetryAfter(), false
+	}
+	return "", 0, true
+}
+
+// reply is the outcome of handling one text message
+type reply struct {
+	body string
+
+	// Frames released from the ack window by this message, and earlier
+	// responses being re-sent by the replay command
+	released, resent [][]byte
+
+	// silent messages get no response; untracked responses bypass the ack window
+	silent, untracked bool
+
+	// JSON command name, for logs
+	command string
+
+	// Delay asked for with a DELAY: prefix, replacing the configured one
+	delay    time.Duration
+	hasDelay bool
+}
+
+// respond handles a text message with the connection's state and returns
+// the response body before formatting
+func (c *Connection) respond(message string, payload []byte) reply {
+	if c.jsonOnly && !isJSONText(message) {
+		return reply{body: notJSONError}
+	}
+
+	if rest, ok := strings.CutPrefix(message, "DELAY:"); ok {
+		return c.respondDelay(rest)
+	}
+
+	// Check for special commands
+	if body, ok := applyTransform(message); ok {
+		c.history.Add(message)
+		return reply{body: body}
+	}
+
+	if (strings.HasPrefix(message, "BROADCAST:") || strings.HasPrefix(message, "SAMPLEBROADCAST:") || strings.HasPrefix(message, "ROOM:")) && !c.Profile.AllowBroadcast {
+		return reply{body: errorJSON("broadcast is not enabled for this origin")}
+	}
+
+	if strings.HasPrefix(message, "JOIN:") || strings.HasPrefix(message, "LEAVE:") || strings.HasPrefix(message, "ROOM:") {
+		return c.respondRoom(message)
+	}
+
+	if message == "WHO" || strings.HasPrefix(message, "WHO:") {
+		return c.respondWho(message)
+	}
+
+	if strings.HasPrefix(message, "NAME:") || strings.HasPrefix(message, "TO:") {
+		return c.respondDirect(message)
+	}
+
+	if strings.HasPrefix(message, "BROADCAST:") {
+		text := strings.TrimPrefix(message, "BROADCAST:")
+		broadcastMsg := fmt.Sprintf("[BROADCAST from %s] %s", c.RemoteAddr, text)
+		result := c.hub.BroadcastWithReceipt([]byte(broadcastMsg), c)
+		c.history.Add("BROADCAST:" + text)
+		body, _ := json.Marshal(result)
+		return reply{body: string(body)}
+	}
+
+	if strings.HasPrefix(message, "SAMPLEBROADCAST:") {
+		rest := strings.TrimPrefix(message, "SAMPLEBROADCAST:")
+		pctStr, text, _ := strings.Cut(rest, ":")
+		percent, err := strconv.ParseFloat(pctStr, 64)
+		if err != nil || math.IsNaN(percent) || percent < 0 || percent > 100 {
+			return reply{body: `{"error":"usage: SAMPLEBROADCAST:<percent 0-100>:<text>"}`}
+		}
+		broadcastMsg := fmt.Sprintf("[BROADCAST from %s] %s", c.RemoteAddr, text)
+		delivered := c.hub.BroadcastSample([]byte(broadcastMsg), c, percent)
+		c.history.Add("SAMPLEBROADCAST:" + rest)
+		return reply{body: fmt.Sprintf(`{"delivered":%d,"percent":%g}`, delivered, percent)}
+	}
+
+	if strings.ToUpper(strings.TrimSpace(message)) == "HISTORY" {
+		return reply{body: c.history.GetHistoryJSON()}
+	}
+
+	if strings.ToUpper(strings.TrimSpace(message)) == "WHOAMI" {
+		return reply{body: c.whoamiJSON()}
+	}
+
+	if strings.ToUpper(strings.TrimSpace(message)) == "CLEAR" {
+		c.history.Clear()
+		return reply{body: clearedHistoryJSON}
+	}
+
+	if len(message) > 0 && strings.HasPrefix(message, "{") {
+		if isJSONRPC(payload) {
+			return c.respondRPC(payload)
+		}
+		return c.respondCommand(payload)
+	}
+
+	if strings.HasPrefix(message, "[") {
+		countBatch(c.stats, payload)
+		resp, err := processBatch(payload)
+		if err != nil {
+			return reply{body: errorJSON(err.Error())}
+		}
+		c.history.Add("JSON:batch")
+		return reply{body: string(resp), command: "batch"}
+	}
+
+	// Echo back as-is
+	return reply{body: message}
+}
+
+// respondCommand handles a JSON command. Stateful commands are handled here
+// with this connection's state; the rest go to processCommand.
+func (c *Connection) respondCommand(payload []byte) reply {
+	atomic.AddUint64(&commandCounter, 1)
+	var cmd CommandRequest
+	parsed := json.Unmarshal(payload, &cmd) == nil
+
+	if parsed {
+		cmd.Command = canonicalCommand(cmd.Command)
+		countCommand(c.stats, cmd.Command)
+	}
+
+	var r reply
+	r.command = cmd.Command
+	var resp []byte
+	var err error
+	switch {
+	case parsed && !commandEnabled(cmd.Command):
+		resp, err = runCommand(cmd) // answers with the disabled error
+	case parsed && cmd.Command == "movingavg":
+		resp, err = processMovingAverage(c.movingAvg, cmd)
+	case parsed && cmd.Command == "ping_seq":
+		resp, err = processPingSeq(c.seqs, cmd)
+	case parsed && cmd.Command == "trace":
+		resp, err = processTrace(c.trace, cmd)
+	case parsed && cmd.Command == "chunk":
+		resp, err = processChunk(c.digest, cmd)
+	case parsed && cmd.Command == "finalize":
+		resp, err = processFinalize(c.digest, cmd)
+	case parsed && cmd.Command == "dialog":
+		resp, err = processDialog(c.dialog, cmd)
+	case parsed && cmd.Command == "flags":
+		resp, err = processFlags(c.flags, cmd)
+	case parsed && cmd.Command == "join":
+		resp, err = processJoin(c, cmd)
+	case parsed && cmd.Command == "groupstats":
+		resp, err = json.Marshal(struct {
+			Command string `json:"command"`
+			GroupStats
+		}{cmd.Command, c.hub.GroupStats(cmd.Group)})
+	case parsed && cmd.Command == "stats" && cfg().PerConnectionStats:
+		resp, err = processStats(c.stats)
+	case parsed && cmd.Command == "history":
+		// Same response as the HISTORY text command
+		resp = []byte(c.history.GetHistoryJSON())
+	case parsed && cmd.Command == "whoami":
+		// Same response as the WHOAMI text command
+		resp = []byte(c.whoamiJSON())
+	case parsed && cmd.Command == "clear":
+		// Same response as the CLEAR text command, and not itself recorded
+		c.history.Clear()
+		r.body = string(withRequestID([]byte(clearedHistoryJSON), cmd.ID))
+		return r
+	case parsed && cmd.Command == "replay":
+		resp, r.resent, err = processReplay(c.sent, cmd)
+		r.untracked = true
+	case parsed && cmd.Command == "ackmode":
+		resp, r.released, err = processAckMode(c.acks, cmd)
+		r.untracked = true
+	case parsed && cmd.Command == "ack":
+		// Successful acks get no reply; unknown ids get an untracked error
+		var ok bool
+		if id, valid := cmd.ID.Uint(); valid {
+			r.released, ok = c.acks.Ack(id)
+		}
+		if ok {
+			r.silent = true
+			return r
+		}
+		resp, err = json.Marshal(CommandResponse{
+			Command: cmd.Command,
+			Error:   fmt.Sprintf("id %s is not awaiting acknowledgement", cmd.ID),
+		})
+		r.untracked = true
+	case parsed:
+		resp, err = runCommand(cmd)
+	default:
+		resp, err = processCommand(payload)
+	}
+
+	if err != nil {
+		r.body = fmt.Sprintf(`{"error":"%s"}`, err.Error())
+		return r
+	}
+	if parsed {
+		resp = withRequestID(resp, cmd.ID)
+	}
+	r.body = string(resp)
+	// Track JSON commands in history
+	if parsed {
+		c.history.Add(fmt.Sprintf("JSON:%s", cmd.Command))
+	}
+	return r
+}
+
+// processJoin moves the connection into req.Group
+func processJoin(c *Connection, req CommandRequest) ([]byte, error) {
+	resp := CommandResponse{Command: req.Command}
+	if len(req.Group) > maxGroupName {
+		resp.Error = fmt.Sprintf("group names are limited to %d bytes", maxGroupName)
+		return json.Marshal(resp)
+	}
+	c.hub.JoinGroup(c, req.Group)
+	return json.Marshal(struct {
+		Command string `json:"command"`
+		Group   string `json:"group"`
+	}{req.Command, req.Group})
+}
+
+// closeCodeNames names the close codes registered for RFC 6455
+var closeCodeNames = map[int]string{
+	websocket.CloseNormalClosure:           "normal_closure",
+	websocket.CloseGoingAway:               "going_away",
+	websocket.CloseProtocolError:           "protocol_error",
+	websocket.CloseUnsupportedData:         "unsupported_data",
+	websocket.CloseNoStatusReceived:        "no_status",
+	websocket.CloseAbnormalClosure:         "abnormal_closure",
+	websocket.CloseInvalidFramePayloadData: "invalid_payload",
+	websocket.ClosePolicyViolation:         "policy_violation",
+	websocket.CloseMessageTooBig:           "message_too_big",
+	websocket.CloseMandatoryExtension:      "mandatory_extension",
+	websocket.CloseInternalServerErr:       "internal_error",
+	websocket.CloseServiceRestart:          "service_restart",
+	websocket.CloseTryAgainLater:           "try_again_later",
+	websocket.CloseTLSHandshake:            "tls_handshake",
+}
+
+// closeCodeName names a close code for logs; 4000-4999 are private to applications
+func closeCodeName(code int) string {
+	if name, ok := closeCodeNames[code]; ok {
+		return name
+	}
+	if code >= 4000 && code <= 4999 {
+		return "application"
+	}
+	return "unknown"
+}
+
+// endRead logs why reading stopped. Unless the client closed the connection
+// itself (gorilla/websocket has already answered its close frame), it also
+// tries a graceful close so the client sees 1000 instead of 1006.
+func (c *Connection) endRead(err error) {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &closeErr):
+		level := slog.LevelInfo
+		if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			level = slog.LevelWarn
+		}
+		logger().Log(context.Background(), level, "client closed connection", "event", "client_close", "remote_addr", c.RemoteAddr,
+			"code", closeErr.Code, "code_name", closeCodeName(closeErr.Code), "reason", closeErr.Text)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logger().Info("read timed out", "event", "read_timeout", "remote_addr", c.RemoteAddr)
+		_ = c.Close(websocket.CloseNormalClosure, "idle timeout")
+	default:
+		logger().Warn("read failed", "event", "read_error", "remote_addr", c.RemoteAddr, "error", err)
+		_ = c.Close(websocket.CloseNormalClosure, "")
+	}
+}
+
+// closeControlFlood closes a connection that sent too many control frames
+func (c *Connection) closeControlFlood() error {
+	logger().Warn("control frame flood, closing", "event", "control_flood", "remote_addr", c.RemoteAddr)
+	_ = c.Close(websocket.ClosePolicyViolation, "too many control frames")
+	return errControlFlood
+}
+
+// installControlHandlers counts pings and pongs toward their own limit so a
+// client can't flood control frames past the data rate limiter
+func (c *Connection) installControlHandlers() {
+	// On each pong, extend the read deadline again
+	c.conn.SetPongHandler(func(appData string) error {
+		if !c.controlLimiter.AllowMessage() {
+			return c.closeControlFlood()
+		}
+		c.touch()
+		logger().Info("pong received", "event", "pong", "remote_addr", c.RemoteAddr, "data", appData)
+		return nil
+	})
+
+	// Answer pings like the default handler, but count them first
+	c.conn.SetPingHandler(func(appData string) error {
+		if !c.controlLimiter.AllowMessage() {
+			return c.closeControlFlood()
+		}
+		// Queue the pong, waiting for room like a direct write would
+		select {
+		case c.control <- controlFrame{kind: websocket.PongMessage, data: []byte(appData), deadline: time.Now().Add(c.writeWait)}:
+		case <-c.done:
+		}
+		return nil
+	})
+}
@@ -0,0 +1,217 @@
+// Filename: internal/ws/connection_test.go
+
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnectionSendCountsMetrics(t *testing.T) {
+	metrics := make(chan ConnectionMetrics, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := NewConnection(conn, r.RemoteAddr, DevProfile)
+		go c.writePump()
+		_ = c.Send([]byte("hello"))
+		_ = c.Send([]byte("world!"))
+		_ = c.Close(websocket.CloseNormalClosure, "bye")
+		c.stopWriter()
+		metrics <- c.Metrics()
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"hello", "world!"} {
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("got %q, %v expected %q", data, err, want)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("got %v expected close %d", err, websocket.CloseNormalClosure)
+	}
+
+	m := <-metrics
+	if m.MessagesOut != 2 || m.BytesOut != 11 {
+		t.Errorf("got %d messages, %d bytes expected 2 messages, 11 bytes", m.MessagesOut, m.BytesOut)
+	}
+}
+
+func TestConnectionIDsAreUnique(t *testing.T) {
+	a := NewConnection(nil, "a", DevProfile)
+	b := NewConnection(nil, "b", DevProfile)
+	if a.ID == b.ID {
+		t.Errorf("got duplicate id %d", a.ID)
+	}
+}
+
+func TestSendAfterStopFails(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	go c.writePump()
+	c.stopWriter()
+	if err := c.Send([]byte("x")); err != ErrConnectionClosed {
+		t.Errorf("got %v expected %v", err, ErrConnectionClosed)
+	}
+	if err := c.TrySend([]byte("x")); err != ErrConnectionClosed {
+		t.Errorf("got %v expected %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestTrySendReportsFullQueue(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	for i := 0; i < sendQueueSize; i++ {
+		if err := c.TrySend([]byte("x")); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := c.TrySend([]byte("x")); err != ErrSendQueueFull {
+		t.Errorf("got %v expected %v", err, ErrSendQueueFull)
+	}
+}
+
+// rawClient performs a WebSocket handshake over a plain TCP connection, so
+// tests can send and inspect frames directly. header holds extra request
+// header lines, each ending in \r\n.
+func rawClient(t *testing.T, srv *httptest.Server, header string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	nc, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	req := "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+		header + "Origin: http://localhost:4000\r\n\r\n"
+	if _, err := nc.Write([]byte(req)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %v %v", resp, err)
+	}
+	return nc, br
+}
+
+// rawDeflateClient is a raw client offering permessage-deflate
+func rawDeflateClient(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	return rawClient(t, srv, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+}
+
+// rawTextFrame is a masked client text frame (payloads under 126 bytes)
+func rawTextFrame(payload string) []byte {
+	frame := []byte{0x81, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	return append(frame, payload...) // a zero mask leaves the payload as is
+}
+
+// rawFrame is a masked client frame (payloads under 126 bytes)
+func rawFrame(opcode byte, fin bool, payload []byte) []byte {
+	if fin {
+		opcode |= 0x80
+	}
+	frame := []byte{opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	return append(frame, payload...) // a zero mask leaves the payload as is
+}
+
+// readRawFrame reads one unmasked server frame (payloads under 126 bytes)
+func readRawFrame(t *testing.T, nc net.Conn, br *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	_ = nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		t.Fatalf("read frame header: %v", err)
+	}
+	payload := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("read frame payload: %v", err)
+	}
+	return head[0], payload
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	c := DefaultConfig()
+	c.Compression = true
+	c.CompressionThreshold = 50
+	withConfig(t, c)
+	nc, br := rawDeflateClient(t, newTestServer(t))
+
+	for _, tt := range []struct {
+		msg        string
+		compressed bool
+	}{
+		{"short", false},
+		{strings.Repeat("x", 60), true},
+	} {
+		if _, err := nc.Write(rawTextFrame(tt.msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var head [2]byte
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			t.Fatalf("read frame header: %v", err)
+		}
+		// RSV1 marks a compressed message
+		if got := head[0]&0x40 != 0; got != tt.compressed {
+			t.Errorf("%d byte message: got compressed %v expected %v", len(tt.msg), got, tt.compressed)
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(head[1]&0x7f)); err != nil {
+			t.Fatalf("read frame payload: %v", err)
+		}
+	}
+}
+
+func TestFragmentedMessageIsReassembled(t *testing.T) {
+	c := DefaultConfig()
+	c.MaxMessageBytes = 16
+	c.PerConnectionCounter = true
+	withConfig(t, c)
+	nc, br := rawClient(t, newTestServer(t), "")
+
+	send := func(frames ...[]byte) {
+		t.Helper()
+		for _, f := range frames {
+			if _, err := nc.Write(f); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+	}
+	send(
+		rawFrame(websocket.TextMessage, false, []byte("Hel")),
+		rawFrame(0, false, []byte("lo, ")),
+		rawFrame(0, true, []byte("world")),
+	)
+	if head, payload := readRawFrame(t, nc, br); head != 0x80|websocket.TextMessage || string(payload) != "#1 Hello, world" {
+		t.Errorf("got frame %#x %q expected %q", head, payload, "#1 Hello, world")
+	}
+
+	// The limit applies to the whole message, not each fragment
+	send(
+		rawFrame(websocket.TextMessage, false, []byte("0123456789")),
+		rawFrame(0, true, []byte("0123456789")),
+	)
+	head, payload := readRawFrame(t, nc, br)
+	if head != 0x80|websocket.CloseMessage || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != websocket.CloseMessageTooBig {
+		t.Errorf("got frame %#x %q expected close %d", head, payload, websocket.CloseMessageTooBig)
+	}
+}
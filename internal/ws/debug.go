@@ -0,0 +1,72 @@
+// Filename: internal/ws/debug.go
+
+package ws
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ConnectionInfo describes one live connection for HandleDebugConnections
+type ConnectionInfo struct {
+	ID               uint64    `json:"id"`
+	RemoteAddr       string    `json:"remote_addr"`
+	Name             string    `json:"name,omitempty"`
+	ConnectedSince   time.Time `json:"connected_since"`
+	ConnectedSeconds float64   `json:"connected_seconds"`
+	MessagesIn       uint64    `json:"messages_in"`
+	MessagesOut      uint64    `json:"messages_out"`
+	Rooms            []string  `json:"rooms"`
+}
+
+// Connections snapshots the registered clients, ordered by id
+func (h *ClientHub) Connections() []ConnectionInfo {
+	if h == nil {
+		return []ConnectionInfo{}
+	}
+	now := time.Now()
+	h.mu.RLock()
+	infos := make([]ConnectionInfo, 0, len(h.clients))
+	for c := range h.clients {
+		m := c.Metrics()
+		rooms := make([]string, 0, len(c.rooms))
+		for room := range c.rooms {
+			rooms = append(rooms, room)
+		}
+		slices.Sort(rooms)
+		infos = append(infos, ConnectionInfo{
+			ID:               c.ID,
+			RemoteAddr:       c.RemoteAddr,
+			Name:             c.name,
+			ConnectedSince:   m.Connected,
+			ConnectedSeconds: now.Sub(m.Connected).Seconds(),
+			MessagesIn:       m.MessagesIn,
+			MessagesOut:      m.MessagesOut,
+			Rooms:            rooms,
+		})
+	}
+	h.mu.RUnlock()
+	slices.SortFunc(infos, func(a, b ConnectionInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return infos
+}
+
+// HandleDebugConnections lists the live connections for operators, one JSON
+// object per line. It takes the same token as the WebSocket endpoint when
+// one is configured.
+func HandleDebugConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireToken(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, info := range currentHub().Connections() {
+		_ = enc.Encode(info)
+	}
+}
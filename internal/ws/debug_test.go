@@ -0,0 +1,81 @@
+// Filename: internal/ws/debug_test.go
+
+package ws
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getConnections fetches /debug/connections through HandleDebugConnections
+func getConnections(t *testing.T, token string) (int, []ConnectionInfo) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/debug/connections", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	HandleDebugConnections(rr, req)
+	if rr.Code != http.StatusOK {
+		return rr.Code, nil
+	}
+	var infos []ConnectionInfo
+	for sc := bufio.NewScanner(rr.Body); sc.Scan(); {
+		var info ConnectionInfo
+		if err := json.Unmarshal(sc.Bytes(), &info); err != nil {
+			t.Fatalf("decode %q: %v", sc.Text(), err)
+		}
+		infos = append(infos, info)
+	}
+	return rr.Code, infos
+}
+
+func TestDebugConnectionsListsLiveSockets(t *testing.T) {
+	withHub(t)
+	srv := newTestServer(t)
+	a := dialTestServer(t, srv)
+	b := dialTestServer(t, srv)
+	roundTrip(t, a, "JOIN:red")
+	roundTrip(t, a, "JOIN:blue")
+	roundTrip(t, b, "NAME:bob")
+	roundTrip(t, b, "hello")
+
+	code, infos := getConnections(t, "")
+	if code != http.StatusOK || len(infos) != 2 {
+		t.Fatalf("got status %d and %d connections expected 200 and 2", code, len(infos))
+	}
+	byAddr := map[string]ConnectionInfo{}
+	for _, info := range infos {
+		byAddr[info.RemoteAddr] = info
+	}
+	gotA, gotB := byAddr[a.LocalAddr().String()], byAddr[b.LocalAddr().String()]
+	if len(gotA.Rooms) != 2 || gotA.Rooms[0] != "blue" || gotA.Rooms[1] != "red" || gotA.MessagesIn != 2 || gotA.MessagesOut != 2 {
+		t.Errorf("got %+v expected rooms [blue red] and 2 messages each way", gotA)
+	}
+	if gotB.Name != "bob" || len(gotB.Rooms) != 0 || gotB.MessagesIn != 2 || gotB.ConnectedSince.IsZero() {
+		t.Errorf("got %+v expected bob with no rooms and 2 messages in", gotB)
+	}
+	if infos[0].ID >= infos[1].ID {
+		t.Errorf("got ids %d, %d expected ascending order", infos[0].ID, infos[1].ID)
+	}
+}
+
+func TestDebugConnectionsRequiresToken(t *testing.T) {
+	c := DefaultConfig()
+	c.AuthToken = "s3cret"
+	withConfig(t, c)
+	withHub(t)
+
+	if code, _ := getConnections(t, ""); code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a token expected %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := getConnections(t, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("got status %d with a wrong token expected %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := getConnections(t, "s3cret"); code != http.StatusOK {
+		t.Errorf("got status %d with the token expected %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,102 @@
+// Filename: internal/ws/delay.go
+
+package ws
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Longest delay a DELAY: prefix may ask for
+const maxEchoDelay = 10 * time.Second
+
+// delayedFrame is a response held back until due. Tracked frames are added
+// to the replay buffer once sent.
+type delayedFrame struct {
+	dataFrame
+	due     time.Time
+	tracked bool
+}
+
+// Sent in place of a delayed response when the connection has no timers left
+const tooManyTimersJSON = `{"error":"too many active timers on this connection"}`
+
+// deliver sends f to the client after delay. Frames go straight to the send
+// queue unless they are delayed or earlier delayed frames are still pending,
+// in which case each waits on a timer from the connection's TimerSet and
+// never overtakes the frame ahead, so responses keep their order. The timers
+// are cancelled on disconnect. When the connection has no timers left the
+// client gets an error straight away instead of the response.
+func (c *Connection) deliver(f dataFrame, delay time.Duration, tracked bool) error {
+	c.delayMu.Lock()
+	defer c.delayMu.Unlock()
+	if delay <= 0 && len(c.delayed) == 0 {
+		return c.queueFrame(f, tracked)
+	}
+
+	due := time.Now().Add(delay)
+	if n := len(c.delayed); n > 0 && c.delayed[n-1].due.After(due) {
+		due = c.delayed[n-1].due
+	}
+	err := c.timers.AfterFunc(time.Until(due), c.flushDelayed)
+	if err == ErrTooManyTimers {
+		logger().Warn("delayed response rejected", "event", "too_many_timers", "remote_addr", c.RemoteAddr)
+		return c.queue(dataFrame{websocket.TextMessage, []byte(tooManyTimersJSON)})
+	}
+	if err != nil {
+		return ErrConnectionClosed
+	}
+	c.delayed = append(c.delayed, delayedFrame{dataFrame: f, due: due, tracked: tracked})
+	return nil
+}
+
+// flushDelayed queues the delayed frames that have fallen due, in order
+func (c *Connection) flushDelayed() {
+	c.delayMu.Lock()
+	defer c.delayMu.Unlock()
+	now := time.Now()
+	for len(c.delayed) > 0 && !c.delayed[0].due.After(now) {
+		f := c.delayed[0]
+		c.delayed = c.delayed[1:]
+		if err := c.queueFrame(f.dataFrame, f.tracked); err != nil {
+			c.delayed = nil
+			return
+		}
+	}
+}
+
+// queueFrame queues f for writing, adding tracked frames to the replay buffer
+func (c *Connection) queueFrame(f dataFrame, tracked bool) error {
+	if err := c.queue(f); err != nil {
+		return err
+	}
+	if tracked {
+		c.sent.Add(f.data)
+	}
+	return nil
+}
+
+// respondDelay handles DELAY:<ms>:<text>, responding to text as usual but
+// holding the response back for ms milliseconds instead of the configured delay
+func (c *Connection) respondDelay(rest string) reply {
+	msStr, text, ok := strings.Cut(rest, ":")
+	ms, err := strconv.Atoi(msStr)
+	if !ok || err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > maxEchoDelay {
+		return reply{body: `{"error":"usage: DELAY:<ms 0-10000>:<text>"}`}
+	}
+	rep := c.respond(text, []byte(text))
+	rep.delay, rep.hasDelay = time.Duration(ms)*time.Millisecond, true
+	return rep
+}
+
+// delayFor returns how long to hold rep back: its DELAY: override if it
+// has one, otherwise the configured delay
+func (c *Connection) delayFor(rep reply) time.Duration {
+	if rep.hasDelay {
+		return rep.delay
+	}
+	return c.echoDelay
+}
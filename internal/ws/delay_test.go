@@ -0,0 +1,129 @@
+// Filename: internal/ws/delay_test.go
+
+package ws
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEchoDelay(t *testing.T) {
+	c := DefaultConfig()
+	c.EchoDelay = 200 * time.Millisecond
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	start := time.Now()
+	if got := roundTrip(t, conn, "slow"); got != "slow" {
+		t.Fatalf("got %q expected %q", got, "slow")
+	}
+	if elapsed := time.Since(start); elapsed < c.EchoDelay {
+		t.Errorf("echo arrived after %v expected at least %v", elapsed, c.EchoDelay)
+	}
+}
+
+func TestDelayPrefixOverridesConfiguredDelay(t *testing.T) {
+	c := DefaultConfig()
+	c.EchoDelay = time.Second
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	for _, tt := range []struct {
+		msg      string
+		want     string
+		min, max time.Duration
+	}{
+		{"DELAY:150:UPPER:hello", "HELLO", 150 * time.Millisecond, time.Second},
+		{"DELAY:0:now", "now", 0, 500 * time.Millisecond},
+	} {
+		start := time.Now()
+		if got := roundTrip(t, conn, tt.msg); got != tt.want {
+			t.Fatalf("%s: got %q expected %q", tt.msg, got, tt.want)
+		}
+		if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%s: arrived after %v expected between %v and %v", tt.msg, elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+func TestDelayedResponsesKeepTheirOrder(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	for _, msg := range []string{"DELAY:200:first", "second"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write %q: %v", msg, err)
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"first", "second"} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if _, got, _ := strings.Cut(string(data), " "); got != want {
+			t.Errorf("got %q expected %q", got, want)
+		}
+	}
+}
+
+func TestDelayPrefixRejectsBadValues(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	for _, msg := range []string{"DELAY:x:hi", "DELAY:-1:hi", "DELAY:10001:hi", "DELAY:5"} {
+		if got, want := roundTrip(t, conn, msg), `{"error":"usage: DELAY:<ms 0-10000>:<text>"}`; got != want {
+			t.Errorf("%s: got %s expected %s", msg, got, want)
+		}
+	}
+}
+
+func TestConfigureRejectsLongEchoDelay(t *testing.T) {
+	c := DefaultConfig()
+	c.EchoDelay = maxEchoDelay + time.Millisecond
+	if err := Configure(c); err == nil {
+		t.Error("expected an error for an echo delay above the maximum")
+	}
+}
+
+func TestDelayedResponsesShareTimerLimit(t *testing.T) {
+	c := DefaultConfig()
+	c.MaxTimersPerConnection = 2
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+	for _, msg := range []string{"DELAY:300:a", "DELAY:300:b", "DELAY:300:c"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write %q: %v", msg, err)
+		}
+	}
+	// The third response has no timer left, so its error isn't held back
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{tooManyTimersJSON, "a", "b"} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		got := string(data)
+		if want != tooManyTimersJSON {
+			_, got, _ = strings.Cut(got, " ")
+		}
+		if got != want {
+			t.Errorf("got %q expected %q", got, want)
+		}
+	}
+}
+
+func TestDelayedResponseIsCancelledOnDisconnect(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	if err := c.deliver(dataFrame{websocket.TextMessage, []byte("late")}, 20*time.Millisecond, false); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if n := c.timers.Active(); n != 1 {
+		t.Fatalf("got %d active timers expected 1", n)
+	}
+	// What the handler does when the client goes away
+	c.timers.StopAll()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(c.send); n != 0 {
+		t.Errorf("got %d frames queued after disconnect expected none", n)
+	}
+}
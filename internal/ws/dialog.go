@@ -0,0 +1,138 @@
+// Filename: internal/ws/dialog.go
+
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DialogStep is one state of the guided dialog. After the client answers a
+// step, the dialog moves to Choices[answer] if Choices is set, or to Next
+// otherwise. A step with neither ends the dialog.
+type DialogStep struct {
+	Prompt  string            // shown on entering the step; {var} inserts a saved answer
+	Save    string            // if set, the answer is required and saved under this name
+	Next    string            // step after any valid answer
+	Choices map[string]string // allowed answers (case-insensitive) and the step each leads to
+}
+
+// Every dialog begins at this step
+const dialogStart = "start"
+
+// The default dialog asks for a name and confirms it
+var defaultDialogSteps = map[string]DialogStep{
+	"start":   {Next: "name"},
+	"name":    {Prompt: "What is your name?", Save: "name", Next: "confirm"},
+	"confirm": {Prompt: "Is your name {name}? (yes/no)", Choices: map[string]string{"yes": "done", "no": "name"}},
+	"done":    {Prompt: "Thanks, {name}! The dialog is complete."},
+}
+
+var (
+	dialogSteps   = defaultDialogSteps
+	dialogStepsMu sync.RWMutex
+)
+
+// SetDialogSteps replaces the dialog state machine. It must have a "start"
+// step and every transition must lead to a defined step.
+func SetDialogSteps(steps map[string]DialogStep) error {
+	if _, ok := steps[dialogStart]; !ok {
+		return fmt.Errorf("dialog must have a %q step", dialogStart)
+	}
+	for name, step := range steps {
+		targets := []string{step.Next}
+		for _, next := range step.Choices {
+			targets = append(targets, next)
+		}
+		for _, next := range targets {
+			if _, ok := steps[next]; next != "" && !ok {
+				return fmt.Errorf("step %q leads to undefined step %q", name, next)
+			}
+		}
+	}
+
+	dialogStepsMu.Lock()
+	defer dialogStepsMu.Unlock()
+	dialogSteps = steps
+	return nil
+}
+
+// Dialog tracks one connection's progress through the dialog
+type Dialog struct {
+	current string            // step awaiting an answer; "" before start
+	vars    map[string]string // saved answers
+	mu      sync.Mutex
+}
+
+// NewDialog creates a dialog that has not started yet
+func NewDialog() *Dialog {
+	return &Dialog{vars: make(map[string]string)}
+}
+
+// Advance answers step with input and returns the step the dialog moves to
+// along with its prompt. Sending the start step restarts the dialog at any time.
+func (d *Dialog) Advance(step, input string) (string, string, error) {
+	dialogStepsMu.RLock()
+	steps := dialogSteps
+	dialogStepsMu.RUnlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if step == dialogStart {
+		d.current = dialogStart
+		d.vars = make(map[string]string)
+	}
+	if d.current == "" {
+		return "", "", fmt.Errorf("dialog not started; send step %q", dialogStart)
+	}
+	if step != d.current {
+		return "", "", fmt.Errorf("unexpected step %q; expected %q", step, d.current)
+	}
+
+	s := steps[d.current]
+	answer := strings.TrimSpace(input)
+	var next string
+	switch {
+	case s.Choices != nil:
+		var ok bool
+		if next, ok = s.Choices[strings.ToLower(answer)]; !ok {
+			return "", "", fmt.Errorf("answer must be one of: %s", strings.Join(choiceNames(s.Choices), ", "))
+		}
+	case s.Next != "":
+		next = s.Next
+	default:
+		return "", "", errors.New("dialog is complete; send step \"start\" to begin again")
+	}
+	if s.Save != "" {
+		if answer == "" {
+			return "", "", errors.New("an answer is required for this step")
+		}
+		d.vars[s.Save] = answer
+	}
+
+	d.current = next
+	return next, d.prompt(steps[next].Prompt), nil
+}
+
+// prompt fills saved answers into a prompt template
+func (d *Dialog) prompt(template string) string {
+	pairs := make([]string, 0, len(d.vars)*2)
+	for k, v := range d.vars {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// choiceNames lists the allowed answers of a step in a stable order
+func choiceNames(choices map[string]string) []string {
+	names := make([]string, 0, len(choices))
+	for name := range choices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
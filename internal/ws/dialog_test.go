@@ -0,0 +1,58 @@
+// Filename: internal/ws/dialog_test.go
+
+package ws
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDialogDefaultFlow(t *testing.T) {
+	d := NewDialog()
+	steps := []struct {
+		step, input        string
+		wantStep, wantText string
+	}{
+		{"start", "", "name", "What is your name?"},
+		{"name", "Ann", "confirm", "Is your name Ann? (yes/no)"},
+		{"confirm", "no", "name", "What is your name?"},
+		{"name", "Bo", "confirm", "Is your name Bo? (yes/no)"},
+		{"confirm", "YES", "done", "Thanks, Bo! The dialog is complete."},
+	}
+	for _, s := range steps {
+		next, prompt, err := d.Advance(s.step, s.input)
+		if err != nil {
+			t.Fatalf("Advance(%q, %q): unexpected error %v", s.step, s.input, err)
+		}
+		if next != s.wantStep || prompt != s.wantText {
+			t.Errorf("Advance(%q, %q) got (%q, %q) expected (%q, %q)", s.step, s.input, next, prompt, s.wantStep, s.wantText)
+		}
+	}
+}
+
+func TestDialogRejectsInvalidTransitions(t *testing.T) {
+	d := NewDialog()
+	if _, _, err := d.Advance("name", "Ann"); err == nil || !strings.Contains(err.Error(), "not started") {
+		t.Errorf("got %v expected a not-started error", err)
+	}
+	d.Advance("start", "")
+	if _, _, err := d.Advance("confirm", "yes"); err == nil || !strings.Contains(err.Error(), `expected "name"`) {
+		t.Errorf("got %v expected an unexpected-step error", err)
+	}
+	if _, _, err := d.Advance("name", "  "); err == nil {
+		t.Error("expected an empty name to be rejected")
+	}
+	d.Advance("name", "Ann")
+	if _, _, err := d.Advance("confirm", "maybe"); err == nil || !strings.Contains(err.Error(), "no, yes") {
+		t.Errorf("got %v expected the allowed answers", err)
+	}
+}
+
+func TestSetDialogStepsValidates(t *testing.T) {
+	if err := SetDialogSteps(map[string]DialogStep{"begin": {}}); err == nil {
+		t.Error("expected a missing start step to be rejected")
+	}
+	if err := SetDialogSteps(map[string]DialogStep{"start": {Next: "nowhere"}}); err == nil {
+		t.Error("expected an undefined transition to be rejected")
+	}
+}
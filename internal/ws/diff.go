@@ -0,0 +1,88 @@
+// Filename: internal/ws/diff.go
+
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Most lines diff accepts in each text; the LCS table grows with the product
+const maxDiffLines = 500
+
+// DiffLine is one line of a line-based diff
+type DiffLine struct {
+	Op   string `json:"op"` // "equal", "remove" or "add"
+	Line string `json:"line"`
+}
+
+// splitLines splits text into lines; empty text has none
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffLines computes a line diff from a to b using a longest common subsequence table
+func diffLines(a, b []string) []DiffLine {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	diff := make([]DiffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, DiffLine{Op: "equal", Line: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: "remove", Line: a[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: "add", Line: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, DiffLine{Op: "remove", Line: a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, DiffLine{Op: "add", Line: b[j]})
+	}
+	return diff
+}
+
+// processDiff responds with the line diff from req.Text to req.Text2
+func processDiff(req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command string     `json:"command"`
+		Diff    []DiffLine `json:"diff"`
+		Error   string     `json:"error,omitempty"`
+	}{
+		Command: req.Command,
+		Diff:    []DiffLine{},
+	}
+
+	a, b := splitLines(req.Text), splitLines(req.Text2)
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		resp.Error = fmt.Sprintf("diff inputs are limited to %d lines each", maxDiffLines)
+		return json.Marshal(resp)
+	}
+	resp.Diff = diffLines(a, b)
+	return json.Marshal(resp)
+}
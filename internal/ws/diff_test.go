@@ -0,0 +1,39 @@
+// Filename: internal/ws/diff_test.go
+
+package ws
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProcessDiff(t *testing.T) {
+	tests := []struct {
+		text, text2 string
+		want        string
+	}{
+		{"foo\nbar", "foo\nbaz", `[{"op":"equal","line":"foo"},{"op":"remove","line":"bar"},{"op":"add","line":"baz"}]`},
+		{"", "a", `[{"op":"add","line":"a"}]`},
+		{"a", "", `[{"op":"remove","line":"a"}]`},
+		{"", "", `[]`},
+		{"a\nb\nc", "a\nc\nd", `[{"op":"equal","line":"a"},{"op":"remove","line":"b"},{"op":"equal","line":"c"},{"op":"add","line":"d"}]`},
+	}
+	for _, tt := range tests {
+		out, err := processDiff(CommandRequest{Command: "diff", Text: tt.text, Text2: tt.text2})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		want := `{"command":"diff","diff":` + tt.want + `}`
+		if string(out) != want {
+			t.Errorf("diff(%q, %q) got %s expected %s", tt.text, tt.text2, out, want)
+		}
+	}
+}
+
+func TestProcessDiffCapsInput(t *testing.T) {
+	big := strings.Repeat("x\n", maxDiffLines)
+	out, _ := processDiff(CommandRequest{Command: "diff", Text: big, Text2: "x"})
+	if resp := decodeResponse(t, out); !strings.Contains(resp.Error, "limited") {
+		t.Errorf("got error %q expected a size limit error", resp.Error)
+	}
+}
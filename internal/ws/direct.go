@@ -0,0 +1,169 @@
+// Filename: internal/ws/direct.go
+
+package ws
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Longest name a client can take with NAME:
+const maxClientName = 32
+
+var (
+	errNameTaken    = errors.New("name is taken")
+	errUserNotFound = errors.New("user not found")
+)
+
+// validClientName reports why name can't be taken, or nil if it can
+func validClientName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name must not be empty")
+	case len(name) > maxClientName:
+		return fmt.Errorf("names are limited to %d bytes", maxClientName)
+	case strings.Contains(name, ":"):
+		return errors.New("names must not contain ':'")
+	}
+	return nil
+}
+
+// SetName gives conn a unique name for direct messages, releasing any name
+// it had before
+func (h *ClientHub) SetName(conn *Connection, name string) error {
+	if h == nil {
+		return ErrNoHub
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if owner, ok := h.names[name]; ok && owner != conn {
+		return errNameTaken
+	}
+	h.releaseNameLocked(conn)
+	h.names[name] = conn
+	conn.name = name
+	return nil
+}
+
+// releaseNameLocked frees conn's name; the caller holds h.mu
+func (h *ClientHub) releaseNameLocked(conn *Connection) {
+	if conn.name != "" && h.names[conn.name] == conn {
+		delete(h.names, conn.name)
+	}
+	conn.name = ""
+}
+
+// ClientName returns the name conn took with SetName, if any
+func (h *ClientHub) ClientName(conn *Connection) string {
+	if h == nil {
+		return conn.name
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return conn.name
+}
+
+// SendTo queues payload for the client called name without waiting
+func (h *ClientHub) SendTo(name string, payload []byte) error {
+	if h == nil {
+		return ErrNoHub
+	}
+	h.mu.RLock()
+	target := h.names[name]
+	h.mu.RUnlock()
+	if target == nil {
+		return errUserNotFound
+	}
+	return target.TrySend(payload)
+}
+
+// respondDirect handles NAME:<name> and TO:<name>:<text>
+func (c *Connection) respondDirect(message string) reply {
+	if name, ok := strings.CutPrefix(message, "NAME:"); ok {
+		if err := validClientName(name); err != nil {
+			return reply{body: errorJSON(err.Error())}
+		}
+		if err := c.hub.SetName(c, name); err != nil {
+			return reply{body: errorJSON(fmt.Sprintf("name %s is taken", name))}
+		}
+		c.history.Add(message)
+		body, _ := json.Marshal(struct {
+			Name string `json:"name"`
+		}{name})
+		return reply{body: string(body)}
+	}
+
+	to, text, ok := strings.Cut(strings.TrimPrefix(message, "TO:"), ":")
+	if !ok {
+		return reply{body: errorJSON("usage: TO:<name>:<text>")}
+	}
+	from := c.hub.ClientName(c)
+	if from == "" {
+		return reply{body: errorJSON("set a name with NAME: first")}
+	}
+	c.history.Add("TO:" + to)
+	if err := c.hub.SendTo(to, []byte(fmt.Sprintf("[DM from %s] %s", from, text))); err != nil {
+		return reply{body: errorJSON(err.Error())}
+	}
+	body, _ := json.Marshal(struct {
+		To        string `json:"to"`
+		Delivered bool   `json:"delivered"`
+	}{to, true})
+	return reply{body: string(body)}
+}
+
+// Roster lists the connected clients, or only the members of room if it is
+// set: named clients by name in alphabetical order, then the rest as
+// "anon-<id>" in connection order
+func (h *ClientHub) Roster(room string) []string {
+	if h == nil {
+		return []string{}
+	}
+	h.mu.RLock()
+	members := h.clients
+	if room != "" {
+		members = h.rooms[room]
+	}
+	var named, anon []*Connection
+	for conn := range members {
+		if conn.name != "" {
+			named = append(named, conn)
+		} else {
+			anon = append(anon, conn)
+		}
+	}
+	roster := make([]string, 0, len(members))
+	slices.SortFunc(named, func(a, b *Connection) int { return strings.Compare(a.name, b.name) })
+	for _, conn := range named {
+		roster = append(roster, conn.name)
+	}
+	h.mu.RUnlock()
+
+	slices.SortFunc(anon, func(a, b *Connection) int { return cmp.Compare(a.ID, b.ID) })
+	for _, conn := range anon {
+		roster = append(roster, fmt.Sprintf("anon-%d", conn.ID))
+	}
+	return roster
+}
+
+// respondWho handles WHO and WHO:<room>
+func (c *Connection) respondWho(message string) reply {
+	var room string
+	if rest, ok := strings.CutPrefix(message, "WHO:"); ok {
+		if rest == "" {
+			return reply{body: errorJSON("usage: WHO or WHO:room")}
+		}
+		room = rest
+	}
+	clients := c.hub.Roster(room)
+	body, _ := json.Marshal(struct {
+		Room    string   `json:"room,omitempty"`
+		Clients []string `json:"clients"`
+		Count   int      `json:"count"`
+	}{room, clients, len(clients)})
+	return reply{body: string(body)}
+}
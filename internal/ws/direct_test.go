@@ -0,0 +1,125 @@
+// Filename: internal/ws/direct_test.go
+
+package ws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDirectMessageToPresentPeer(t *testing.T) {
+	withHub(t)
+	srv := newTestServer(t)
+	alice := dialTestServer(t, srv)
+	bob := dialTestServer(t, srv)
+	other := dialTestServer(t, srv)
+
+	if got := roundTrip(t, alice, "NAME:alice"); got != `{"name":"alice"}` {
+		t.Errorf("got %q expected the name to be taken", got)
+	}
+	roundTrip(t, bob, "NAME:bob")
+	roundTrip(t, other, "ready")
+
+	if got := roundTrip(t, alice, "TO:bob:hi: there"); got != `{"to":"bob","delivered":true}` {
+		t.Errorf("got %q expected a delivery receipt", got)
+	}
+	_ = bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := bob.ReadMessage()
+	if want := "[DM from alice] hi: there"; err != nil || string(data) != want {
+		t.Errorf("got %q, %v expected %q", data, err, want)
+	}
+	expectSilence(t, other)
+}
+
+func TestDirectMessageToAbsentPeer(t *testing.T) {
+	h := withHub(t)
+	srv := newTestServer(t)
+	alice := dialTestServer(t, srv)
+	bob := dialTestServer(t, srv)
+
+	if got := roundTrip(t, alice, "TO:bob:hi"); got != `{"error":"set a name with NAME: first"}` {
+		t.Errorf("got %q expected to be asked for a name", got)
+	}
+	roundTrip(t, alice, "NAME:alice")
+	if got := roundTrip(t, alice, "TO:bob:hi"); got != `{"error":"user not found"}` {
+		t.Errorf("got %q expected user not found", got)
+	}
+
+	// Once bob disconnects his name is free again
+	roundTrip(t, bob, "NAME:bob")
+	bob.Close()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		h.mu.RLock()
+		_, taken := h.names["bob"]
+		h.mu.RUnlock()
+		if !taken {
+			break
+		}
+	}
+	if got := roundTrip(t, alice, "TO:bob:hi"); got != `{"error":"user not found"}` {
+		t.Errorf("got %q expected bob's name to be released on disconnect", got)
+	}
+}
+
+func TestDuplicateNamesAreRejected(t *testing.T) {
+	h := NewHub()
+	a := NewConnection(nil, "a", DevProfile)
+	b := NewConnection(nil, "b", DevProfile)
+	if err := h.SetName(a, "alice"); err != nil {
+		t.Fatalf("set name: %v", err)
+	}
+	if err := h.SetName(b, "alice"); err != errNameTaken {
+		t.Errorf("got %v expected %v", err, errNameTaken)
+	}
+	if err := h.SetName(a, "alice"); err != nil {
+		t.Errorf("retaking own name: %v", err)
+	}
+
+	// Renaming frees the old name
+	if err := h.SetName(a, "carol"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := h.SetName(b, "alice"); err != nil {
+		t.Errorf("got %v expected the old name to be free", err)
+	}
+}
+
+func TestWhoListsConnectedClients(t *testing.T) {
+	h := withHub(t)
+	srv := newTestServer(t)
+	carol := dialTestServer(t, srv)
+	alice := dialTestServer(t, srv)
+	anon := dialTestServer(t, srv)
+	bob := dialTestServer(t, srv)
+
+	roundTrip(t, carol, "NAME:carol")
+	roundTrip(t, alice, "NAME:alice")
+	roundTrip(t, bob, "NAME:bob")
+	roundTrip(t, anon, "ready")
+	roundTrip(t, alice, "JOIN:red")
+	roundTrip(t, anon, "JOIN:red")
+
+	var anonID uint64
+	h.mu.RLock()
+	for c := range h.clients {
+		if c.name == "" {
+			anonID = c.ID
+		}
+	}
+	h.mu.RUnlock()
+
+	want := fmt.Sprintf(`{"clients":["alice","bob","carol","anon-%d"],"count":4}`, anonID)
+	for i := 0; i < 3; i++ {
+		if got := roundTrip(t, bob, "WHO"); got != want {
+			t.Errorf("got %q expected %q", got, want)
+		}
+	}
+	want = fmt.Sprintf(`{"room":"red","clients":["alice","anon-%d"],"count":2}`, anonID)
+	if got := roundTrip(t, bob, "WHO:red"); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+	if got := roundTrip(t, bob, "WHO:empty"); got != `{"room":"empty","clients":[],"count":0}` {
+		t.Errorf("got %q expected an empty roster", got)
+	}
+}
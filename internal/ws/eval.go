@@ -0,0 +1,154 @@
+// Filename: internal/ws/eval.go
+
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var errDivisionByZero = errors.New("division by zero")
+
+// exprParser is a recursive-descent parser for arithmetic expressions:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = ("+" | "-") factor | number | "(" expr ")"
+//
+// Numbers are decimals such as 3, 2.5 or .5. Positions in errors are byte offsets.
+type exprParser struct {
+	src string
+	pos int
+}
+
+// evalExpr parses and evaluates src
+func evalExpr(src string) (float64, error) {
+	p := &exprParser{src: src}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return 0, p.unexpected()
+	}
+	return v, nil
+}
+
+// skipSpace advances past spaces and tabs
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, or 0 at the end of input
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// unexpected reports the token at the current position
+func (p *exprParser) unexpected() error {
+	if p.pos >= len(p.src) {
+		return errors.New("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected token at position %d", p.pos)
+}
+
+func (p *exprParser) expr() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		rhs, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			v += rhs
+		} else {
+			v -= rhs
+		}
+	}
+	return v, nil
+}
+
+func (p *exprParser) term() (float64, error) {
+	v, err := p.factor()
+	if err != nil {
+		return 0, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		rhs, err := p.factor()
+		if err != nil {
+			return 0, err
+		}
+		if op == '*' {
+			v *= rhs
+		} else if rhs == 0 {
+			return 0, errDivisionByZero
+		} else {
+			v /= rhs
+		}
+	}
+	return v, nil
+}
+
+func (p *exprParser) factor() (float64, error) {
+	switch c := p.peek(); {
+	case c == '+' || c == '-':
+		p.pos++
+		v, err := p.factor()
+		if c == '-' {
+			v = -v
+		}
+		return v, err
+	case c == '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, p.unexpected()
+		}
+		p.pos++
+		return v, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.number()
+	default:
+		return 0, p.unexpected()
+	}
+}
+
+// number scans digits with at most one decimal point
+func (p *exprParser) number() (float64, error) {
+	start := p.pos
+	digits, dot := 0, false
+	for ; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		if c >= '0' && c <= '9' {
+			digits++
+		} else if c == '.' && !dot {
+			dot = true
+		} else {
+			break
+		}
+	}
+	if digits == 0 {
+		p.pos = start
+		return 0, p.unexpected()
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number at position %d", start)
+	}
+	return v, nil
+}
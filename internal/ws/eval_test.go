@@ -0,0 +1,51 @@
+// Filename: internal/ws/eval_test.go
+
+package ws
+
+import "testing"
+
+func TestEvalExpr(t *testing.T) {
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1+2)*3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"  2.5 *\t4 ", 10},
+		{".5 + 1.", 1.5},
+		{"-(2 + 3) * -2", 10},
+		{"((7))", 7},
+		{"2 * (3 + (4 - 1)) / 3", 4},
+	}
+	for _, tt := range tests {
+		got, err := evalExpr(tt.expr)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %v, %v expected %v", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "unexpected end of expression"},
+		{"1 +", "unexpected end of expression"},
+		{"(1 + 2", "unexpected end of expression"},
+		{"1 + * 2", "unexpected token at position 4"},
+		{"1 2", "unexpected token at position 2"},
+		{"2 * x", "unexpected token at position 4"},
+		{"1 + 2)", "unexpected token at position 5"},
+		{"1.2.3", "unexpected token at position 3"},
+		{".", "unexpected token at position 0"},
+		{"1 / (2 - 2)", "division by zero"},
+	}
+	for _, tt := range tests {
+		if _, err := evalExpr(tt.expr); err == nil || err.Error() != tt.want {
+			t.Errorf("%q: got %v expected %q", tt.expr, err, tt.want)
+		}
+	}
+}
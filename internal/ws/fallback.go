@@ -0,0 +1,346 @@
+// Filename: internal/ws/fallback.go
+
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP fallback settings
+const (
+	sessionIdleTTL   = 2 * time.Minute  // sessions with no activity for this long are removed
+	sessionQueueSize = 32               // undelivered replies buffered per session
+	sseKeepAlive     = 15 * time.Second // comment lines keep proxies from closing idle streams
+	maxFallbackBody  = 4 * 1024         // largest message accepted by the send endpoints, in bytes
+	pollTimeout      = 25 * time.Second // how long GET /poll/recv waits for a reply
+	maxSessions      = 1024             // sessions open at once, SSE and long-polling together
+)
+
+// Fallback transports; a session only serves the endpoints of the one that
+// created it
+const (
+	transportSSE  = "sse"  // GET /events with POST /send
+	transportPoll = "poll" // POST /poll/session with /poll/send and /poll/recv
+)
+
+// ErrTooManySessions is returned by Create when the store is full
+var ErrTooManySessions = errors.New("too many sessions")
+
+// FallbackSession is the server side of an HTTP fallback client. It plays
+// the role of a connection: replies queue here until the client reads them.
+type FallbackSession struct {
+	ID          string
+	transport   string
+	replies     chan string
+	rateLimiter MessageLimiter
+	ip          string
+	ipLimiter   *RateLimiter // shared with the client's other sessions and connections; nil when off
+	lastSeen    atomic.Int64 // unix nanos
+}
+
+// touch records activity so the session isn't expired
+func (s *FallbackSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// SessionStore holds the active fallback sessions
+type SessionStore struct {
+	sessions map[string]*FallbackSession
+	ttl      time.Duration
+	max      int
+	mu       sync.Mutex
+}
+
+// NewSessionStore creates a store that holds at most max sessions and drops
+// those idle for longer than ttl
+func NewSessionStore(ttl time.Duration, max int) *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*FallbackSession),
+		ttl:      ttl,
+		max:      max,
+	}
+}
+
+// Shared store used by the fallback handlers
+var sessions = NewSessionStore(sessionIdleTTL, maxSessions)
+
+// Create starts a new session over transport with a random id for the client
+// making r. Its rate limit comes from the request origin's profile, and like a
+// WebSocket connection it shares the per-IP limit when one is configured.
+func (ss *SessionStore) Create(r *http.Request, transport string) (*FallbackSession, error) {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	s := &FallbackSession{
+		ID:          hex.EncodeToString(b[:]),
+		transport:   transport,
+		replies:     make(chan string, sessionQueueSize),
+		rateLimiter: profileForOrigin(r.Header.Get("Origin")).limiter(),
+	}
+	s.touch()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expireLocked()
+	if len(ss.sessions) >= ss.max {
+		return nil, ErrTooManySessions
+	}
+	if conf := cfg(); conf.IPMaxMessages > 0 {
+		s.ip = clientIP(r, conf.TrustProxy)
+		s.ipLimiter = ipLimiters.Acquire(s.ip, conf.IPMaxMessages, conf.IPRateWindow)
+	}
+	ss.sessions[s.ID] = s
+	return s, nil
+}
+
+// Get returns the session with the given id if it exists, belongs to
+// transport and hasn't expired
+func (ss *SessionStore) Get(id, transport string) (*FallbackSession, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expireLocked()
+	s, ok := ss.sessions[id]
+	if !ok || s.transport != transport {
+		return nil, false
+	}
+	s.touch()
+	return s, true
+}
+
+// Remove ends a session
+func (ss *SessionStore) Remove(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s, ok := ss.sessions[id]; ok {
+		ss.removeLocked(s)
+	}
+}
+
+// Len returns the number of open sessions
+func (ss *SessionStore) Len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.sessions)
+}
+
+// removeLocked drops s and its hold on the per-IP limiter; the caller holds ss.mu
+func (ss *SessionStore) removeLocked(s *FallbackSession) {
+	delete(ss.sessions, s.ID)
+	if s.ipLimiter != nil {
+		ipLimiters.Release(s.ip)
+	}
+}
+
+// expireLocked removes idle sessions; the caller holds ss.mu
+func (ss *SessionStore) expireLocked() {
+	cutoff := time.Now().Add(-ss.ttl).UnixNano()
+	for _, s := range ss.sessions {
+		if s.lastSeen.Load() < cutoff {
+			ss.removeLocked(s)
+		}
+	}
+}
+
+// enqueueMessage processes message for s with the stateless transforms and
+// commands, queuing the "#N body" reply. It returns an HTTP status and error
+// text when the message can't be accepted.
+func enqueueMessage(s *FallbackSession, message string) (int, string) {
+	if !s.rateLimiter.AllowMessage() {
+		return http.StatusTooManyRequests, "rate limit exceeded"
+	}
+	if s.ipLimiter != nil && !s.ipLimiter.AllowMessage() {
+		return http.StatusTooManyRequests, "rate limit exceeded"
+	}
+
+	id := atomic.AddUint64(&messageCounter, 1)
+	messageRate.Mark()
+	reply := string(formatResponse(responseTemplate(), id, statelessResponse(message), ""))
+	select {
+	case s.replies <- reply:
+		return http.StatusAccepted, ""
+	default:
+		return http.StatusServiceUnavailable, "reply queue full; read pending replies first"
+	}
+}
+
+// readFallbackMessage validates a POST from an HTTP fallback client and
+// returns its body as the message
+func readFallbackMessage(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	if !requireToken(w, r) || !fallbackOriginAllowed(w, r) {
+		return "", false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFallbackBody))
+	if err != nil {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	return string(body), true
+}
+
+// fallbackOriginAllowed rejects browser requests from origins that couldn't
+// open a WebSocket either. Non-browser clients send no Origin and are allowed.
+func fallbackOriginAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if o := r.Header.Get("Origin"); o != "" && !originAllowed(o) {
+		logger().Warn("blocked cross-origin fallback request", "event", "origin_blocked", "remote_addr", r.RemoteAddr, "origin", o, "path", r.URL.Path)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// HandleEvents streams replies to a Server-Sent Events client. The first
+// event, named "session", carries the id to pass to POST /send; the session
+// ends when the stream is closed.
+func HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireToken(w, r) || !fallbackOriginAllowed(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := sessions.Create(r, transportSSE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer sessions.Remove(s.ID)
+	logger().Info("SSE session opened", "event", "session_opened", "remote_addr", r.RemoteAddr, "session", s.ID, "transport", s.transport)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", s.ID)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case reply := <-s.replies:
+			// Each line of a multi-line reply needs its own data field
+			for _, line := range strings.Split(reply, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+			s.touch()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			s.touch()
+		case <-r.Context().Done():
+			logger().Info("SSE session closed", "event", "session_closed", "remote_addr", r.RemoteAddr, "session", s.ID, "transport", s.transport)
+			return
+		}
+	}
+}
+
+// HandleSend accepts a message for an SSE session (POST /send?session=<id>);
+// the reply arrives on that session's event stream
+func HandleSend(w http.ResponseWriter, r *http.Request) {
+	message, ok := readFallbackMessage(w, r)
+	if !ok {
+		return
+	}
+	s, ok := sessions.Get(r.URL.Query().Get("session"), transportSSE)
+	if !ok {
+		http.Error(w, "unknown or expired session", http.StatusNotFound)
+		return
+	}
+	if status, errMsg := enqueueMessage(s, message); errMsg != "" {
+		http.Error(w, errMsg, status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandlePollSession starts a long-polling session (POST /poll/session) and
+// responds 201 with {"session":"<id>"} to use for /poll/send and /poll/recv
+func HandlePollSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireToken(w, r) || !fallbackOriginAllowed(w, r) {
+		return
+	}
+	s, err := sessions.Create(r, transportPoll)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logger().Info("poll session opened", "event", "session_opened", "remote_addr", r.RemoteAddr, "session", s.ID, "transport", s.transport)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"session": s.ID})
+}
+
+// HandlePollSend accepts a message for a long-polling session
+// (POST /poll/send?session=<id>); the reply is fetched with GET /poll/recv
+func HandlePollSend(w http.ResponseWriter, r *http.Request) {
+	message, ok := readFallbackMessage(w, r)
+	if !ok {
+		return
+	}
+	s, ok := sessions.Get(r.URL.Query().Get("session"), transportPoll)
+	if !ok {
+		http.Error(w, "unknown or expired session", http.StatusNotFound)
+		return
+	}
+	if status, errMsg := enqueueMessage(s, message); errMsg != "" {
+		http.Error(w, errMsg, status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandlePollRecv waits for the next reply of a long-polling session
+// (GET /poll/recv?session=<id>). It responds 200 with the reply as the body,
+// or 204 No Content if none arrives within pollTimeout.
+func HandlePollRecv(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireToken(w, r) || !fallbackOriginAllowed(w, r) {
+		return
+	}
+	s, ok := sessions.Get(r.URL.Query().Get("session"), transportPoll)
+	if !ok {
+		http.Error(w, "unknown or expired session", http.StatusNotFound)
+		return
+	}
+
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	select {
+	case reply := <-s.replies:
+		s.touch()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(reply))
+	case <-timeout.C:
+		s.touch()
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
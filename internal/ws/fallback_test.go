@@ -0,0 +1,283 @@
+// Filename: internal/ws/fallback_test.go
+
+package ws
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSEEvent reads one event from an SSE stream and returns its name and data
+func readSSEEvent(t *testing.T, rd *bufio.Reader) (string, string) {
+	t.Helper()
+	var event string
+	var data []string
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && data != nil:
+			return event, strings.Join(data, "\n")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestSSEFallbackEchoesTransforms(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", HandleEvents)
+	mux.HandleFunc("/send", HandleSend)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	stream, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer stream.Body.Close()
+	rd := bufio.NewReader(stream.Body)
+
+	event, session := readSSEEvent(t, rd)
+	if event != "session" || session == "" {
+		t.Fatalf("got first event %q %q expected a session id", event, session)
+	}
+
+	for msg, want := range map[string]string{
+		"UPPER:hello":                   "HELLO",
+		`{"command":"add","a":2,"b":3}`: `{"result":5,"command":"add"}`,
+	} {
+		resp, err := http.Post(srv.URL+"/send?session="+session, "text/plain", strings.NewReader(msg))
+		if err != nil {
+			t.Fatalf("POST /send: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("got status %v expected %v", resp.StatusCode, http.StatusAccepted)
+		}
+
+		_, data := readSSEEvent(t, rd)
+		if _, body, _ := strings.Cut(data, " "); body != want {
+			t.Errorf("%s: got %q expected %q", msg, data, want)
+		}
+	}
+}
+
+func TestSendRejectsUnknownSession(t *testing.T) {
+	rr := httptest.NewRecorder()
+	HandleSend(rr, httptest.NewRequest(http.MethodPost, "/send?session=nope", strings.NewReader("hi")))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %v expected %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// newPollServer serves the long-polling endpoints
+func newPollServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/poll/session", HandlePollSession)
+	mux.HandleFunc("/poll/send", HandlePollSend)
+	mux.HandleFunc("/poll/recv", HandlePollRecv)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// createPollSession starts a long-polling session and returns its id
+func createPollSession(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/poll/session", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST /poll/session: %v", err)
+	}
+	var created struct {
+		Session string `json:"session"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated || created.Session == "" {
+		t.Fatalf("got status %v session %q err %v", resp.StatusCode, created.Session, err)
+	}
+	return created.Session
+}
+
+// pollSend posts message to a long-polling session and returns the status
+func pollSend(t *testing.T, srv *httptest.Server, session, message string) int {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/poll/send?session="+session, "text/plain", strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("POST /poll/send: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestLongPollFallback(t *testing.T) {
+	srv := newPollServer(t)
+	session := createPollSession(t, srv)
+	if code := pollSend(t, srv, session, "REVERSE:abc"); code != http.StatusAccepted {
+		t.Fatalf("got status %v expected %v", code, http.StatusAccepted)
+	}
+
+	resp, err := http.Get(srv.URL + "/poll/recv?session=" + session)
+	if err != nil {
+		t.Fatalf("GET /poll/recv: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if _, reply, _ := strings.Cut(string(body), " "); resp.StatusCode != http.StatusOK || reply != "cba" {
+		t.Errorf("got status %v body %q expected 200 with cba", resp.StatusCode, body)
+	}
+}
+
+func TestPollSendNeedsExistingSession(t *testing.T) {
+	srv := newPollServer(t)
+	before := sessions.Len()
+	for _, session := range []string{"", "nope"} {
+		if code := pollSend(t, srv, session, "hi"); code != http.StatusNotFound {
+			t.Errorf("session %q: got status %v expected %v", session, code, http.StatusNotFound)
+		}
+	}
+	if got := sessions.Len(); got != before {
+		t.Errorf("sends without a session opened %d sessions", got-before)
+	}
+}
+
+func TestFallbackSessionRateLimit(t *testing.T) {
+	srv := newPollServer(t)
+	session := createPollSession(t, srv)
+	// Requests without an Origin get the dev profile
+	for i := range DevProfile.MaxMessages {
+		if code := pollSend(t, srv, session, "hi"); code != http.StatusAccepted {
+			t.Fatalf("message %d: got status %v expected %v", i+1, code, http.StatusAccepted)
+		}
+	}
+	if code := pollSend(t, srv, session, "hi"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %v expected %v", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestFallbackSessionsShareIPLimit(t *testing.T) {
+	c := DefaultConfig()
+	c.IPMaxMessages = 3
+	withConfig(t, c)
+	srv := newPollServer(t)
+	a, b := createPollSession(t, srv), createPollSession(t, srv)
+
+	for _, session := range []string{a, b, a} {
+		if code := pollSend(t, srv, session, "hi"); code != http.StatusAccepted {
+			t.Fatalf("got status %v expected %v", code, http.StatusAccepted)
+		}
+	}
+	if code := pollSend(t, srv, b, "hi"); code != http.StatusTooManyRequests {
+		t.Errorf("got status %v expected %v", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestSessionStoreIsBounded(t *testing.T) {
+	ss := NewSessionStore(time.Minute, 2)
+	req := httptest.NewRequest(http.MethodPost, "/poll/session", nil)
+	first, err := ss.Create(req, transportPoll)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := ss.Create(req, transportPoll); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := ss.Create(req, transportPoll); err != ErrTooManySessions {
+		t.Errorf("got %v expected %v", err, ErrTooManySessions)
+	}
+	ss.Remove(first.ID)
+	if _, err := ss.Create(req, transportPoll); err != nil {
+		t.Errorf("create after remove: %v", err)
+	}
+}
+
+func TestFallbackEndpointsRequireToken(t *testing.T) {
+	c := DefaultConfig()
+	c.AuthToken = "s3cret"
+	withConfig(t, c)
+
+	for _, tt := range []struct {
+		method, target string
+		handler        http.HandlerFunc
+	}{
+		{http.MethodGet, "/events", HandleEvents},
+		{http.MethodPost, "/send?session=nope", HandleSend},
+		{http.MethodPost, "/poll/session", HandlePollSession},
+		{http.MethodPost, "/poll/send?session=nope", HandlePollSend},
+		{http.MethodGet, "/poll/recv?session=nope", HandlePollRecv},
+		{http.MethodGet, "/poll/recv?session=nope&token=wrong", HandlePollRecv},
+	} {
+		rr := httptest.NewRecorder()
+		tt.handler(rr, httptest.NewRequest(tt.method, tt.target, strings.NewReader("hi")))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: got status %v expected %v", tt.method, tt.target, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// With the token the request gets through to the handler
+	rr := httptest.NewRecorder()
+	HandlePollRecv(rr, httptest.NewRequest(http.MethodGet, "/poll/recv?session=nope&token=s3cret", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %v expected %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestSessionsAreBoundToTheirTransport(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", HandleEvents)
+	mux.HandleFunc("/send", HandleSend)
+	mux.HandleFunc("/poll/session", HandlePollSession)
+	mux.HandleFunc("/poll/send", HandlePollSend)
+	mux.HandleFunc("/poll/recv", HandlePollRecv)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	stream, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer stream.Body.Close()
+	_, sseSession := readSSEEvent(t, bufio.NewReader(stream.Body))
+	pollSession := createPollSession(t, srv)
+
+	if got := pollSend(t, srv, sseSession, "hi"); got != http.StatusNotFound {
+		t.Errorf("SSE session on /poll/send got status %v expected %v", got, http.StatusNotFound)
+	}
+	resp, err := http.Get(srv.URL + "/poll/recv?session=" + sseSession)
+	if err != nil {
+		t.Fatalf("GET /poll/recv: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("SSE session on /poll/recv got status %v expected %v", resp.StatusCode, http.StatusNotFound)
+	}
+	resp, err = http.Post(srv.URL+"/send?session="+pollSession, "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatalf("POST /send: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll session on /send got status %v expected %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestPollRecvUnknownSession(t *testing.T) {
+	rr := httptest.NewRecorder()
+	HandlePollRecv(rr, httptest.NewRequest(http.MethodGet, "/poll/recv?session=nope", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %v expected %v", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,85 @@
+// Filename: internal/ws/faults.go
+
+package ws
+
+import (
+	"math/rand/v2"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Response sent in place of a message's real one when an error is injected
+const injectedErrorJSON = `{"error":"injected error","injected":true}`
+
+// fault is what the injector does to a message
+type fault int
+
+const (
+	faultNone  fault = iota
+	faultError       // reply with injectedErrorJSON instead of processing the message
+	faultDrop        // swallow the message without a reply
+)
+
+// FaultInjector picks messages to fail on purpose, so clients can exercise
+// their retry logic. Each message gets an error with probability errorRate
+// and is dropped with probability dropRate.
+type FaultInjector struct {
+	errorRate, dropRate float64
+	rng                 *rand.Rand
+	mu                  sync.Mutex
+}
+
+// NewFaultInjector creates an injector drawing from a generator seeded with
+// seed, so the same seed fails the same messages. It returns nil, which
+// injects nothing, when both rates are zero.
+func NewFaultInjector(errorRate, dropRate float64, seed uint64) *FaultInjector {
+	if errorRate <= 0 && dropRate <= 0 {
+		return nil
+	}
+	return &FaultInjector{
+		errorRate: errorRate,
+		dropRate:  dropRate,
+		rng:       rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// Next returns the fault to inject into the next message
+func (fi *FaultInjector) Next() fault {
+	if fi == nil {
+		return faultNone
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	switch x := fi.rng.Float64(); {
+	case x < fi.errorRate:
+		return faultError
+	case x < fi.errorRate+fi.dropRate:
+		return faultDrop
+	}
+	return faultNone
+}
+
+// faultSeed returns the configured seed, or a random one when it is zero
+func faultSeed(c *Config) uint64 {
+	if c.FaultSeed != 0 {
+		return c.FaultSeed
+	}
+	return rand.Uint64()
+}
+
+// injectFault applies f to message id in place of its usual handling,
+// reporting whether the connection is still usable
+func (c *Connection) injectFault(f fault, id uint64) bool {
+	if f == faultDrop {
+		logger().Info("dropped message on purpose", "event", "fault_drop", "remote_addr", c.RemoteAddr, "msg_id", id)
+		return true
+	}
+	frame := applyFlags(c.flags, responseTemplate(), id, injectedErrorJSON, "")
+	if err := c.deliver(dataFrame{websocket.TextMessage, frame}, c.echoDelay, false); err != nil {
+		logger().Warn("write failed", "event", "write_error", "remote_addr", c.RemoteAddr, "error", err)
+		return false
+	}
+	logger().Info("injected error", "event", "fault_error", "remote_addr", c.RemoteAddr, "msg_id", id)
+	return true
+}
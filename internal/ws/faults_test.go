@@ -0,0 +1,89 @@
+// Filename: internal/ws/faults_test.go
+
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestErrorRateOneFailsEveryMessage(t *testing.T) {
+	c := DefaultConfig()
+	c.ErrorRate = 1
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	for _, msg := range []string{"hello", "UPPER:hi", `{"command":"add","a":1,"b":2}`} {
+		if got := roundTrip(t, conn, msg); got != injectedErrorJSON {
+			t.Errorf("%s: got %s expected %s", msg, got, injectedErrorJSON)
+		}
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{1, 2}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if kind, data, err := conn.ReadMessage(); err != nil || kind != websocket.TextMessage {
+		t.Errorf("got %d %q, %v expected an injected error for a binary message", kind, data, err)
+	}
+}
+
+func TestErrorRateZeroFailsNothing(t *testing.T) {
+	c := DefaultConfig()
+	c.ErrorRate = 0
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	for _, msg := range []string{"hello", "again", "UPPER:hi"} {
+		if got := roundTrip(t, conn, msg); got == injectedErrorJSON {
+			t.Errorf("%s: got an injected error with the rate at 0", msg)
+		}
+	}
+}
+
+func TestDropRateOneSwallowsMessages(t *testing.T) {
+	c := DefaultConfig()
+	c.DropRate = 1
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("lost")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectSilence(t, conn)
+}
+
+func TestFaultInjectorIsRepeatableWithASeed(t *testing.T) {
+	a := NewFaultInjector(0.3, 0.3, 42)
+	b := NewFaultInjector(0.3, 0.3, 42)
+	counts := map[fault]int{}
+	for i := 0; i < 1000; i++ {
+		fa, fb := a.Next(), b.Next()
+		if fa != fb {
+			t.Fatalf("draw %d: got %d and %d from the same seed", i, fa, fb)
+		}
+		counts[fa]++
+	}
+	for f, want := range map[fault]int{faultNone: 400, faultError: 300, faultDrop: 300} {
+		if counts[f] < want-80 || counts[f] > want+80 {
+			t.Errorf("fault %d chosen %d times in 1000 expected about %d", f, counts[f], want)
+		}
+	}
+}
+
+func TestNoRatesInjectNothing(t *testing.T) {
+	if fi := NewFaultInjector(0, 0, 1); fi != nil || fi.Next() != faultNone {
+		t.Errorf("expected a nil injector that injects nothing")
+	}
+}
+
+func TestConfigureRejectsBadFaultRates(t *testing.T) {
+	for _, rates := range [][2]float64{{-0.1, 0}, {0, -0.1}, {0.6, 0.5}} {
+		c := DefaultConfig()
+		c.ErrorRate, c.DropRate = rates[0], rates[1]
+		if err := Configure(c); err == nil {
+			t.Errorf("error rate %v, drop rate %v: expected an error", rates[0], rates[1])
+		}
+	}
+}
@@ -3,12 +3,17 @@ package ws
 // Filename: internal/ws/handler.go
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,39 +22,117 @@ import (
 
 // define request and response message structures
 type CommandRequest struct {
-	Command string  `json:"command"`
-	A       float64 `json:"a"`
-	B       float64 `json:"b"`
+	Command string      `json:"command"`
+	A       float64     `json:"a"` // operand; single-operand commands such as sqrt use only A
+	B       float64     `json:"b"` // second operand, ignored by single-operand commands
+	Window  int         `json:"window,omitempty"`
+	Count   int         `json:"count,omitempty"` // responses to replay
+	ID      RequestID   `json:"id,omitempty"`    // echoed in the response; the response id for ack
+	Text    string      `json:"text,omitempty"`
+	Text2   string      `json:"text2,omitempty"` // second text for diff
+	Step    string      `json:"step,omitempty"`  // dialog step being answered
+	Expr    string      `json:"expr,omitempty"`  // arithmetic expression for eval
+	Seq     uint64      `json:"seq,omitempty"`   // sequence number for ping_seq
+	TS      json.Number `json:"ts,omitempty"`    // client timestamp for ping, echoed as sent
+
+	// Operands for matmul
+	M1 [][]float64 `json:"m1,omitempty"`
+	M2 [][]float64 `json:"m2,omitempty"`
+
+	// Flag changes for the flags command
+	Set map[string]bool `json:"set,omitempty"`
+
+	// Group for the join and groupstats commands
+	Group string `json:"group,omitempty"`
 }
 
 type CommandResponse struct {
-	Result  float64 `json:"result,omitempty"`
-	Command string  `json:"command"`
-	Error   string  `json:"error,omitempty"`
+	Result  float64     `json:"result,omitempty"`
+	Command string      `json:"command"`
+	Count   int         `json:"count,omitempty"`
+	Padding string      `json:"padding,omitempty"`
+	Matrix  [][]float64 `json:"matrix,omitempty"`
+	Error   string      `json:"error,omitempty"`
+
+	// Parse diagnostics, set when the request was not valid JSON
+	Offset  *int64 `json:"offset,omitempty"`
+	Snippet string `json:"snippet,omitempty"`
+	Hint    string `json:"hint,omitempty"`
 }
 
-// Heartbeat and timeout settings
+// Default heartbeat and timeout settings; see Config to change them
 const (
-	writeWait  = 5 * time.Second     // max time to complete a write
-	pongWait   = 30 * time.Second    // if we don't get a pong in 30s, time out
-	pingPeriod = (pongWait * 9) / 10 // send pings at ~90% of pongWait (e.g., 27s)
+	defaultWriteWait  = 5 * time.Second     // max time to complete a write
+	defaultPongWait   = 30 * time.Second    // if we don't get a pong in 30s, time out
+	defaultPingPeriod = defaultPongWait / 2 // send pings at half of pongWait (15s), so a live client's pong lands before the idle warning
 )
 
-// Only allow pages served from this origin to connect
-var allowedOrigins = []string{
-	"http://localhost:4000",
+// A client silent for this share of pongWait is warned before it is closed
+const idleWarningPercent = 75
+
+// Largest window accepted by the movingavg command
+const maxMovingAverageWindow = 1000
+
+// Largest unacknowledged-response window a client may request with ackmode
+const maxAckWindow = 32
+
+// Control frame (ping/pong) flood protection, tracked separately from data messages
+const (
+	controlMaxMessages = 20               // max control frames per window
+	controlWindow      = 10 * time.Second // window for controlMaxMessages
+)
+
+// errControlFlood is returned from the control handlers to stop the read loop
+var errControlFlood = errors.New("control frame rate limit exceeded")
+
+// RequestID is an optional client-chosen id, a JSON string or number, that
+// is echoed back in the same form in the command's response so pipelined
+// requests can be matched to their responses. It holds the raw JSON.
+type RequestID string
+
+// UnmarshalJSON accepts a string or a number
+func (id *RequestID) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v.(type) {
+	case nil:
+		*id = ""
+	case string, float64:
+		*id = RequestID(data)
+	default:
+		return errors.New("id must be a string or a number")
+	}
+	return nil
 }
 
-func originAllowed(o string) bool {
-	if o == "" {
-		return false
+// MarshalJSON writes the id as it was received
+func (id RequestID) MarshalJSON() ([]byte, error) {
+	if id == "" {
+		return []byte("null"), nil
 	}
-	for _, a := range allowedOrigins {
-		if strings.EqualFold(o, a) {
-			return true
-		}
+	return []byte(id), nil
+}
+
+// Uint returns the id as a response number, as the ack command uses it
+func (id RequestID) Uint() (uint64, bool) {
+	n, err := strconv.ParseUint(string(id), 10, 64)
+	return n, err == nil
+}
+
+// withRequestID adds "id" to a JSON object response when the request had one
+func withRequestID(resp []byte, id RequestID) []byte {
+	if id == "" || len(resp) < 2 || resp[len(resp)-1] != '}' {
+		return resp
+	}
+	out := append([]byte{}, resp[:len(resp)-1]...)
+	if len(resp) > 2 {
+		out = append(out, ',')
 	}
-	return false
+	out = append(out, `"id":`...)
+	out = append(out, id...)
+	return append(out, '}')
 }
 
 func processCommand(payload []byte) ([]byte, error) {
@@ -62,11 +145,57 @@ func processCommand(payload []byte) ([]byte, error) {
 			Command: "unknown",
 			Error:   fmt.Sprintf("invalid JSON: %v", err),
 		}
+		resp.Offset, resp.Snippet, resp.Hint = jsonErrorDiagnostics(payload, err)
 		respBytes, _ := json.Marshal(resp)
 		return respBytes, nil
 	}
+	req.Command = canonicalCommand(req.Command)
+	countCommand(nil, req.Command)
+	resp, err := runCommand(req)
+	if err != nil {
+		return nil, err
+	}
+	return withRequestID(resp, req.ID), nil
+}
+
+// Short names terse clients may use in place of a command's full name
+var commandAliases = map[string]string{
+	"+": "add",
+	"-": "subtract",
+	"*": "multiply",
+	"x": "multiply",
+	"/": "divide",
+}
+
+// canonicalCommand resolves an alias to the command it stands for; other
+// names are returned unchanged
+func canonicalCommand(name string) string {
+	if canonical, ok := commandAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// Error for commands the configuration turned off
+const commandDisabled = "command disabled"
+
+// commandEnabled reports whether the configuration allows the named command:
+// it must be in EnabledCommands, when that is set, and not in DisabledCommands
+func commandEnabled(name string) bool {
+	c := cfg()
+	if len(c.EnabledCommands) > 0 && !slices.Contains(c.EnabledCommands, name) {
+		return false
+	}
+	return !slices.Contains(c.DisabledCommands, name)
+}
 
-	// Switch on req.Command for "add", "subtract", "multiply", "divide"
+// runCommand executes a parsed stateless command
+func runCommand(req CommandRequest) ([]byte, error) {
+	if !commandEnabled(req.Command) {
+		return json.Marshal(CommandResponse{Command: req.Command, Error: commandDisabled})
+	}
+
+	// Switch on req.Command for "add", "subtract", "multiply", "divide", "modulo", "percent", "percent_of", "power", "sqrt", "min", "max", "eval", "factorial", "gcd", "lcm", "round", "floor", "ceil", "trunc", "abs", "negate", "ln", "log"
 	var result float64
 	var respErr string
 
@@ -83,10 +212,85 @@ func processCommand(payload []byte) ([]byte, error) {
 		} else {
 			result = req.A / req.B
 		}
+	case "modulo":
+		// math.Mod keeps the sign of the dividend: -7 mod 3 is -1
+		if req.B == 0 {
+			respErr = "modulo by zero"
+		} else {
+			result = math.Mod(req.A, req.B)
+		}
+	case "percent":
+		// a percent of b: 15 percent of 200 is 30
+		result = req.A / 100 * req.B
+	case "percent_of":
+		// What percent a is of b: 30 is 15 percent of 200
+		if req.B == 0 {
+			respErr = "division by zero"
+		} else {
+			result = req.A / req.B * 100
+		}
+	case "min", "max":
+		result, respErr = minMax(req.Command, req.A, req.B)
+	case "sqrt":
+		if req.A < 0 {
+			respErr = "cannot take square root of negative number"
+		} else {
+			result = math.Sqrt(req.A)
+		}
+	case "power":
+		result = math.Pow(req.A, req.B)
+	case "floor":
+		result = math.Floor(req.A)
+	case "ceil":
+		result = math.Ceil(req.A)
+	case "trunc":
+		result = math.Trunc(req.A)
+	case "ln", "log":
+		result, respErr = logarithm(req.Command, req.A, req.B)
+	case "abs":
+		result = math.Abs(req.A) // clears the sign bit, so -0 becomes +0
+	case "negate":
+		result = 0 - req.A // unlike -req.A, gives +0 rather than -0 for a zero operand
+	case "factorial":
+		result, respErr = factorial(req.A)
+	case "gcd", "lcm":
+		result, respErr = gcdLCM(req.Command, req.A, req.B)
+	case "round":
+		result, respErr = round(req.A, req.B)
+	case "eval":
+		if v, err := evalExpr(req.Expr); err != nil {
+			respErr = err.Error()
+		} else {
+			result = v
+		}
+	case "pad":
+		return processPad(req)
+	case "matmul":
+		return processMatMul(req)
+	case "now":
+		return processNow(req)
+	case "ping":
+		return processPing(req)
+	case "server_info":
+		return processServerInfo(req)
+	case "jsontree":
+		return processJSONTree(req)
+	case "diff":
+		return processDiff(req)
+	case "qr":
+		return processQR(req)
+	case "tokenize":
+		return processTokenize(req)
+	case "stats":
+		return processStats(commandStats)
 	default:
 		respErr = fmt.Sprintf("unknown command: %s", req.Command)
 	}
 
+	if respErr == "" {
+		respErr = nonFiniteError(result)
+	}
+
 	// Create command response with result
 	resp := CommandResponse{
 		Command: req.Command,
@@ -108,13 +312,331 @@ func processCommand(payload []byte) ([]byte, error) {
 	return respBytes, nil
 }
 
+// nonFiniteError describes a NaN or infinite result, which can't be encoded
+// as a JSON number (an overflowing add, math.Pow(-8, 1/3.)); it returns ""
+// for finite values
+func nonFiniteError(v float64) string {
+	if math.IsNaN(v) {
+		return "result is not a number"
+	}
+	if math.IsInf(v, 0) {
+		return "result is out of range"
+	}
+	return ""
+}
+
+// Largest input to factorial; 171! overflows float64
+const maxFactorial = 170
+
+// factorial returns n! for a whole number n between 0 and maxFactorial
+func factorial(n float64) (float64, string) {
+	if n < 0 || n != math.Trunc(n) {
+		return 0, "factorial needs a non-negative whole number"
+	}
+	if n > maxFactorial {
+		return 0, "factorial input too large"
+	}
+	result := 1.0
+	for i := 2.0; i <= n; i++ {
+		result *= i
+	}
+	return result, ""
+}
+
+// Largest magnitude gcd and lcm accept: beyond 2^53 float64 operands can't
+// hold every integer, so they may not be what the client sent
+const maxExactInteger = 1 << 53
+
+// gcdLCM returns the greatest common divisor (gcd) or least common multiple
+// (lcm) of two whole numbers, ignoring their signs. gcd(0, 0) and lcm with a
+// zero operand are 0.
+func gcdLCM(command string, a, b float64) (float64, string) {
+	if a != math.Trunc(a) || b != math.Trunc(b) || math.Abs(a) > maxExactInteger || math.Abs(b) > maxExactInteger {
+		return 0, fmt.Sprintf("operands must be whole numbers up to %d in magnitude", int64(maxExactInteger))
+	}
+	x, y := int64(math.Abs(a)), int64(math.Abs(b))
+	g := gcd(x, y)
+	if command == "gcd" {
+		return float64(g), ""
+	}
+	if x == 0 || y == 0 {
+		return 0, ""
+	}
+	// Divide first so the intermediate stays as small as the result
+	x /= g
+	if x > math.MaxInt64/y {
+		return 0, "result is out of range"
+	}
+	return float64(x * y), ""
+}
+
+// gcd returns the greatest common divisor of two non-negative integers
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Most decimal places round keeps; a float64 holds only 15 to 17
+// significant digits, so more would just expose binary noise
+const maxRoundPlaces = 15
+
+// round rounds a to places decimal places, halves away from zero. places
+// must be a non-negative whole number and is capped at maxRoundPlaces.
+func round(a, places float64) (float64, string) {
+	if places < 0 || places != math.Trunc(places) {
+		return 0, "places must be a non-negative whole number"
+	}
+	scale := math.Pow(10, min(places, maxRoundPlaces))
+	scaled := a * scale
+	if math.IsInf(scaled, 0) || math.Abs(a) >= 1<<52 {
+		return a, "" // too large to have a fractional part
+	}
+	return math.Round(scaled) / scale, ""
+}
+
+// logarithm returns the natural logarithm of a (ln) or its logarithm to
+// base b (log)
+func logarithm(command string, a, b float64) (float64, string) {
+	if a <= 0 {
+		return 0, "logarithm of non-positive number"
+	}
+	if command == "ln" {
+		return math.Log(a), ""
+	}
+	if b <= 0 || b == 1 {
+		return 0, "logarithm base must be positive and not 1"
+	}
+	return math.Log(a) / math.Log(b), ""
+}
+
+// minMax returns the smaller (min) or larger (max) of a and b. NaN operands
+// are rejected since NaN can't be sent back as JSON.
+func minMax(command string, a, b float64) (float64, string) {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return 0, "operand is not a number"
+	}
+	if command == "min" {
+		return math.Min(a, b), ""
+	}
+	return math.Max(a, b), ""
+}
+
+// Most commands accepted in one batch
+const maxBatchSize = 50
+
+// processBatch runs each command in a JSON array through processCommand and
+// responds with their responses in the same order. A failing element gets its
+// own error response; the rest still run.
+func processBatch(payload []byte) ([]byte, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(payload, &items); err != nil {
+		return json.Marshal(CommandResponse{
+			Command: "batch",
+			Error:   fmt.Sprintf("invalid JSON: %v", err),
+		})
+	}
+	if len(items) > maxBatchSize {
+		return json.Marshal(CommandResponse{
+			Command: "batch",
+			Error:   fmt.Sprintf("batches are limited to %d commands", maxBatchSize),
+		})
+	}
+
+	responses := make([]json.RawMessage, 0, len(items))
+	atomic.AddUint64(&commandCounter, uint64(len(items)))
+	for _, item := range items {
+		resp, err := processCommand(item)
+		if err != nil {
+			resp, _ = json.Marshal(CommandResponse{Command: "unknown", Error: err.Error()})
+		}
+		responses = append(responses, resp)
+	}
+	return json.Marshal(responses)
+}
+
+// processMovingAverage pushes req.A into the connection's moving average and
+// responds with the average over the last req.Window values
+func processMovingAverage(avg *MovingAverage, req CommandRequest) ([]byte, error) {
+	resp := CommandResponse{
+		Command: req.Command,
+	}
+	if req.Window < 1 || req.Window > maxMovingAverageWindow {
+		resp.Error = fmt.Sprintf("window must be between 1 and %d", maxMovingAverageWindow)
+	} else {
+		resp.Result, resp.Count = avg.Push(req.A, req.Window)
+		if resp.Error = nonFiniteError(resp.Result); resp.Error != "" {
+			resp.Result = 0
+		}
+	}
+	return json.Marshal(resp)
+}
+
+// processPingSeq acknowledges a ping_seq sequence number, flagging numbers
+// that skip ahead or repeat
+func processPingSeq(seqs *SeqTracker, req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command     string  `json:"command"`
+		Seq         uint64  `json:"seq"`
+		GapDetected bool    `json:"gap_detected,omitempty"`
+		OutOfOrder  bool    `json:"out_of_order,omitempty"`
+		Expected    *uint64 `json:"expected,omitempty"`
+	}{
+		Command: "ack",
+		Seq:     req.Seq,
+	}
+	expected, stale := seqs.Observe(req.Seq)
+	if req.Seq != expected {
+		resp.Expected = &expected
+		resp.GapDetected = req.Seq > expected
+		resp.OutOfOrder = stale
+	}
+	return json.Marshal(resp)
+}
+
+// processTrace responds with the connection's recorded request/response pairs
+func processTrace(trace *TraceBuffer, req CommandRequest) ([]byte, error) {
+	return json.Marshal(struct {
+		Command string       `json:"command"`
+		Entries []TraceEntry `json:"entries"`
+	}{
+		Command: req.Command,
+		Entries: trace.Entries(),
+	})
+}
+
+// processAckMode sets how many responses may be outstanding before the
+// client must acknowledge them; a of 0 turns acknowledgements off
+func processAckMode(acks *AckWindow, req CommandRequest) ([]byte, [][]byte, error) {
+	resp := CommandResponse{
+		Command: req.Command,
+	}
+	if req.A < 0 || req.A > maxAckWindow || req.A != math.Trunc(req.A) {
+		resp.Error = fmt.Sprintf("window must be a whole number between 0 and %d", maxAckWindow)
+		data, err := json.Marshal(resp)
+		return data, nil, err
+	}
+	released := acks.SetLimit(int(req.A))
+	resp.Result = req.A
+	data, err := json.Marshal(resp)
+	return data, released, err
+}
+
+// processReplay responds with how many of the last req.Count responses will
+// be re-sent, returning those frames
+func processReplay(sent *ReplayBuffer, req CommandRequest) ([]byte, [][]byte, error) {
+	resp := CommandResponse{
+		Command: req.Command,
+	}
+	if req.Count < 1 {
+		resp.Error = "count must be at least 1"
+		data, err := json.Marshal(resp)
+		return data, nil, err
+	}
+	frames := sent.Last(min(req.Count, maxReplayResponses))
+	resp.Count = len(frames)
+	data, err := json.Marshal(resp)
+	return data, frames, err
+}
+
+// processChunk adds req.Text to the connection's running upload digest
+func processChunk(digest *ChunkDigest, req CommandRequest) ([]byte, error) {
+	return json.Marshal(CommandResponse{
+		Command: req.Command,
+		Count:   digest.Write(req.Text),
+	})
+}
+
+// processFinalize responds with the digest of all chunks since the last finalize
+func processFinalize(digest *ChunkDigest, req CommandRequest) ([]byte, error) {
+	return json.Marshal(struct {
+		Command string `json:"command"`
+		DigestSummary
+	}{
+		Command:       req.Command,
+		DigestSummary: digest.Finalize(),
+	})
+}
+
+// processDialog advances the connection's dialog and responds with the next prompt
+func processDialog(dialog *Dialog, req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command string `json:"command"`
+		Step    string `json:"step,omitempty"`
+		Prompt  string `json:"prompt,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}{
+		Command: req.Command,
+	}
+	step, prompt, err := dialog.Advance(req.Step, req.Text)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Step, resp.Prompt = step, prompt
+	}
+	return json.Marshal(resp)
+}
+
+// processFlags applies any changes in req.Set and responds with every flag
+func processFlags(flags *FeatureFlags, req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command string          `json:"command"`
+		Flags   map[string]bool `json:"flags"`
+		Error   string          `json:"error,omitempty"`
+	}{
+		Command: req.Command,
+	}
+	if err := flags.Set(req.Set); err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Flags = flags.All()
+	return json.Marshal(resp)
+}
+
+// applyFlags formats a response body and its counter according to the connection's flags
+func applyFlags(flags *FeatureFlags, template string, id uint64, body, variant string) []byte {
+	if flags.Enabled("pretty") && (strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[")) {
+		var buf bytes.Buffer
+		if json.Indent(&buf, []byte(body), "", "  ") == nil {
+			body = buf.String()
+		}
+	}
+	if flags.Enabled("checksum") {
+		body += fmt.Sprintf(" crc32=%08x", crc32.ChecksumIEEE([]byte(body)))
+	}
+	if !flags.Enabled("numbering") {
+		return []byte(body)
+	}
+	return formatResponse(template, id, body, variant)
+}
+
+// binaryEcho returns a binary message's echo: the raw bytes inside the same
+// response template text responses get, unless numbering is turned off
+func binaryEcho(flags *FeatureFlags, id uint64, payload []byte) []byte {
+	if !flags.Enabled("numbering") {
+		return payload
+	}
+	prefix, suffix, _ := strings.Cut(responseTemplate(), "{body}")
+	echo := make([]byte, 0, len(prefix)+len(payload)+len(suffix)+20)
+	echo = appendResponse(echo, prefix, id, "", "")
+	echo = append(echo, payload...)
+	return appendResponse(echo, suffix, id, "", "")
+}
+
 // The upgrader object is used when we need to upgrade from HTTP to RFC 6455
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
+		// Conformance test suites and other non-browser clients don't send
+		// an Origin header; browsers always do, so this can't let a
+		// cross-origin page in
+		if origin == "" && (cfg().ConformanceMode || cfg().AllowEmptyOrigin) {
+			return true
+		}
 		ok := originAllowed(origin)
 		if !ok {
-			log.Printf("blocked cross-origin websocket: Origin=%q Path=%s", origin, r.URL.Path)
+			logger().Warn("blocked cross-origin websocket", "event", "origin_blocked", "remote_addr", r.RemoteAddr, "origin", origin, "path", r.URL.Path)
 		}
 		return ok
 	},
@@ -123,7 +645,11 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// A simple atomic counter for connection IDs
+// Write buffers shared by connections when WriteBufferPool is set
+var writeBuffers = &sync.Pool{}
+
+// A simple atomic counter for message IDs, shared by every connection and
+// reported as the server-wide message total
 var messageCounter uint64
 
 // Attempt to upgrade from HTTP to RFC 6455
@@ -134,157 +660,238 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// When a token is configured, only clients presenting it may connect
+	if !authorized(r, cfg().AuthToken) {
+		logger().Warn("unauthorized upgrade", "event", "unauthorized", "remote_addr", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Shed new connections while the server is under high load or at its
+	// connection limit; the slot reserved here is held until the connection ends
+	conf := cfg()
+	reason, shed := overloaded(conf)
+	if !shed && !reserveConnection(&activeConnections, conf.ShedMaxConnections) {
+		reason, shed = fmt.Sprintf("connections at limit %d", conf.ShedMaxConnections), true
+	}
+	if shed {
+		logger().Warn("shedding connection", "event", "shed", "remote_addr", r.RemoteAddr, "reason", reason)
+		w.Header().Set("Retry-After", retryAfterSeconds(conf.ShedRetryAfter))
+		http.Error(w, "server overloaded, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt64(&activeConnections, -1)
+
 	// Upgrade the connection from HTTP to RFC 6455
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// permessage-deflate is offered back only when enabled in the configuration,
+	// and the first supported subprotocol the client asked for is chosen
+	u := upgrader
+	u.EnableCompression = cfg().Compression
+	u.Subprotocols = subprotocols(cfg())
+	if cfg().WriteBufferPool {
+		u.WriteBufferPool = writeBuffers
+	}
+	conn, err := u.Upgrade(w, r, handshakeHeaders(cfg(), r))
 	if err != nil {
-		log.Printf("upgrade error: %v", err)
+		logger().Warn("upgrade failed", "event", "upgrade_error", "remote_addr", r.RemoteAddr, "error", err)
 		return
 	}
 	defer conn.Close()
+	if cfg().Compression {
+		_ = conn.SetCompressionLevel(cfg().CompressionLevel)
+	}
 
-	log.Printf("connection opened from %s", r.RemoteAddr)
+	logger().Info("connection opened", "event", "connection_opened", "remote_addr", r.RemoteAddr, "subprotocol", conn.Subprotocol())
 
-	// Register this connection with the hub for broadcasting
-	Hub.Register(conn)
-	defer Hub.Unregister(conn)
+	// Strict echo bypasses every application feature below
+	if conf := cfg(); conf.ConformanceMode || (strictAllowed(conf) && conn.Subprotocol() == strictSubprotocol) {
+		strictEcho(conn, r.RemoteAddr)
+		logger().Info("connection closed", "event", "connection_closed", "remote_addr", r.RemoteAddr)
+		return
+	}
 
-	// Initialize rate limiter: 10 messages per minute
-	rateLimiter := NewRateLimiter(10, time.Minute)
+	// Limits and features come from the profile of the origin that connected
+	profile := profileForOrigin(r.Header.Get("Origin"))
+	logger().Info("origin profile selected", "event", "profile", "remote_addr", r.RemoteAddr, "profile", profile.Name)
+	c := NewConnection(conn, r.RemoteAddr, profile)
+	c.jsonOnly = conn.Subprotocol() == jsonSubprotocol
+
+	// Every frame, including the pings sent each pingPeriod, is written by
+	// the connection's writer goroutine; queued frames are flushed before the
+	// connection is closed
+	go c.writePump()
+	defer c.stopWriter()
+
+	// Timers created by server-push commands; all are cancelled on disconnect
+	defer c.timers.StopAll()
+
+	// Messages from all of this client's connections count against one limit
+	if conf := cfg(); conf.IPMaxMessages > 0 {
+		ip := clientIP(r, conf.TrustProxy)
+		c.ipLimiter = ipLimiters.Acquire(ip, conf.IPMaxMessages, conf.IPRateWindow)
+		defer ipLimiters.Release(ip)
+	}
 
-	// Initialize command history: last 5 commands
-	history := NewCommandHistory(5)
+	// Register this connection with the hub for broadcasting
+	// Without a hub the connection is served without broadcast
+	if c.hub = currentHub(); c.hub != nil {
+		if err := c.hub.Register(c); err != nil {
+			if errors.Is(err, ErrHubClosed) {
+				_ = c.Close(websocket.CloseGoingAway, "server shutting down")
+			} else {
+				_ = c.Close(websocket.CloseTryAgainLater, "server busy")
+			}
+			return
+		}
+		defer c.hub.Unregister(c)
+	}
 
-	// Limit message size
-	conn.SetReadLimit(1024 * 4)
+	// Limit message size. readMessage enforces MaxMessageBytes itself so it
+	// can close with a clear reason; gorilla's limit is only a backstop.
+	maxMessage := cfg().MaxMessageBytes
+	conn.SetReadLimit(int64(maxMessage) + 1)
 
 	// PING / PONG SETUP
 
-	// Idle timeout window starts now: must receive a pong within pongWait
-	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	// Idle timeout window starts now: must receive a pong or message within pongWait
+	c.touch()
+	c.installControlHandlers()
 
-	// On each pong, extend the read deadline again
-	conn.SetPongHandler(func(appData string) error {
-		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
-		log.Printf("pong from %s (data=%q)", r.RemoteAddr, appData)
-		return nil
-	})
-
-	// Start a goroutine that sends pings every pingPeriod
-	done := make(chan struct{})
-	ticker := time.NewTicker(pingPeriod)
-	go func() {
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				// Send a ping; if this fails, the read loop will notice soon
-				_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
-				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
-					log.Printf("ping write error: %v", err)
-					return
-				}
-				log.Printf("ping → %s", r.RemoteAddr)
-			case <-done:
-				return
-			}
-		}
-	}()
+	// Message IDs come from the global counter unless each connection
+	// counts its own
+	perConnectionCounter := cfg().PerConnectionCounter
+	var localCounter uint64
 
 	// Read/Echo loop
 	for {
-		msgType, payload, err := conn.ReadMessage()
+		msgType, payload, err := c.readMessage(maxMessage)
+		received := time.Now()
+		if err == errMessageTooLarge {
+			logger().Warn("message too large, closing", "event", "message_too_large", "remote_addr", r.RemoteAddr, "limit", maxMessage)
+			_ = c.Close(websocket.CloseMessageTooBig, "message too large")
+			break
+		}
+		if err == errInvalidUTF8 {
+			logger().Warn("invalid UTF-8, closing", "event", "invalid_utf8", "remote_addr", r.RemoteAddr)
+			_ = c.Close(websocket.CloseInvalidFramePayloadData, err.Error())
+			break
+		}
 		if err != nil {
-			// This error will be:
-			//  - a timeout (no pong in time), or
-			//  - a normal close, or
-			//  - some other read error
-			log.Printf("read error (timeout/close): %v", err)
-
-			// Try to send a graceful close so the client can see 1000 instead of 1006
-			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
-			_ = conn.WriteControl(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"),
-				time.Now().Add(writeWait),
-			)
-
+			// A close from the client, a timeout (no pong in time), or some
+			// other read error
+			c.endRead(err)
 			break
 		}
 
 		// We successfully read a message; normal traffic also keeps the connection alive.
 		// Note: the pong handler also updates the read deadline on pongs.
+		c.touch()
+
+		// Text and binary messages share the counter and the rate limit
+		messageRate.Mark()
+		c.received(payload)
+
+		// Check rate limit
+		if scope, retry, ok := c.allowMessage(); !ok {
+			errMsg := fmt.Sprintf(`{"error":"rate limit exceeded","retry_after_ms":%d}`, (retry+time.Millisecond-1)/time.Millisecond)
+			_ = c.Send([]byte(errMsg))
+			logger().Warn("rate limit exceeded", "event", "rate_limited", "remote_addr", r.RemoteAddr, "scope", scope)
+			continue
+		}
+
+		// Increment message counter; the global one counts every message either way
+		id := atomic.AddUint64(&messageCounter, 1)
+		if perConnectionCounter {
+			localCounter++
+			id = localCounter
+		}
+
+		// Injected faults replace the message's handling entirely
+		if f := c.faults.Next(); f != faultNone {
+			if !c.injectFault(f, id) {
+				break
+			}
+			continue
+		}
+
+		// Binary messages are echoed byte for byte; prefixes and commands are text-only
+		if msgType == websocket.BinaryMessage {
+			logger().Info("message received", "event", "received", "remote_addr", r.RemoteAddr, "msg_id", id, "binary", true, "bytes", len(payload))
+			if err := c.deliver(dataFrame{websocket.BinaryMessage, binaryEcho(c.flags, id, payload)}, c.echoDelay, false); err != nil {
+				logger().Warn("write failed", "event", "write_error", "remote_addr", r.RemoteAddr, "error", err)
+				break
+			}
+			logger().Info("echoed message", "event", "echo", "remote_addr", r.RemoteAddr, "msg_id", id, "binary", true, "bytes", len(payload))
+			continue
+		}
 
 		// Echo back text messages, formatting the response to include the message counter
 		if msgType == websocket.TextMessage {
-			// Check rate limit
-			if !rateLimiter.AllowMessage() {
-				_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
-				errMsg := `{"error":"rate limit exceeded: max 10 messages per minute"}`
-				_ = conn.WriteMessage(websocket.TextMessage, []byte(errMsg))
-				log.Printf("rate limit exceeded for %s", r.RemoteAddr)
+			logger().Info("message received", "event", "received", "remote_addr", r.RemoteAddr, "msg_id", id, "payload", string(payload))
+
+			message := string(payload)
+			rep := c.respond(message, payload)
+			delay := c.delayFor(rep)
+
+			// Send responses the ack window released first, so order is
+			// preserved, then any being replayed
+			writeFailed := false
+			for _, frame := range rep.released {
+				if err := c.deliver(dataFrame{websocket.TextMessage, frame}, delay, true); err != nil {
+					logger().Warn("write failed", "event", "write_error", "remote_addr", r.RemoteAddr, "error", err)
+					writeFailed = true
+					break
+				}
+			}
+			for _, frame := range rep.resent {
+				if writeFailed {
+					break
+				}
+				if err := c.deliver(dataFrame{websocket.TextMessage, frame}, delay, false); err != nil {
+					logger().Warn("write failed", "event", "write_error", "remote_addr", r.RemoteAddr, "error", err)
+					writeFailed = true
+				}
+			}
+			if writeFailed {
+				break
+			}
+			if rep.silent {
 				continue
 			}
 
-			// Increment message counter
-			id := atomic.AddUint64(&messageCounter, 1)
-			log.Printf("received message #%d from %s: %q", id, r.RemoteAddr, payload)
-			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			// Format the response to include the counter, rotating through
+			// the configured response variants if there are any
+			variant, rotating := c.variants.Next()
+			if !rotating {
+				variant.Template = responseTemplate()
+			}
+			// The frame is shared by the ack window, the trace and the send
+			// queue, and never modified
+			frame := applyFlags(c.flags, variant.Template, id, rep.body, variant.Name)
 
-			message := string(payload)
-			var responseBody string
-
-			// Check for special commands
-			if strings.HasPrefix(message, "UPPER:") {
-				text := strings.TrimPrefix(message, "UPPER:")
-				responseBody = strings.ToUpper(text)
-				history.Add("UPPER:" + text)
-			} else if strings.HasPrefix(message, "REVERSE:") {
-				text := strings.TrimPrefix(message, "REVERSE:")
-				runes := []rune(text)
-				for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-					runes[i], runes[j] = runes[j], runes[i]
-				}
-				responseBody = string(runes)
-				history.Add("REVERSE:" + text)
-			} else if strings.HasPrefix(message, "BROADCAST:") {
-				text := strings.TrimPrefix(message, "BROADCAST:")
-				broadcastMsg := fmt.Sprintf("[BROADCAST from %s] %s", r.RemoteAddr, text)
-				Hub.Broadcast([]byte(broadcastMsg), conn)
-				responseBody = "Broadcast sent to all clients"
-				history.Add("BROADCAST:" + text)
-			} else if strings.ToUpper(strings.TrimSpace(message)) == "HISTORY" {
-				responseBody = history.GetHistoryJSON()
-			} else if len(message) > 0 && strings.HasPrefix(message, "{") {
-				// Attempt to process as command
-				resp, err := processCommand(payload)
+			send := true
+			if !rep.untracked {
+				send, err = c.acks.Offer(id, frame)
 				if err != nil {
-					responseBody = fmt.Sprintf(`{"error":"%s"}`, err.Error())
-				} else {
-					responseBody = string(resp)
-					// Track JSON commands in history
-					var cmd CommandRequest
-					if json.Unmarshal(payload, &cmd) == nil {
-						history.Add(fmt.Sprintf("JSON:%s", cmd.Command))
-					}
+					logger().Warn("closing connection", "event", "ack_overflow", "remote_addr", r.RemoteAddr, "error", err)
+					_ = c.Close(websocket.ClosePolicyViolation, err.Error())
+					break
 				}
-			} else {
-				// Echo back as-is
-				responseBody = message
+			}
+			c.trace.Record(received, message, frame, variant.Name)
+			if !send {
+				logger().Info("holding response until acknowledgements arrive", "event", "held", "remote_addr", r.RemoteAddr, "msg_id", id)
+				continue
 			}
 
-			// Format the response to include the counter
-			formatted := "#" + strconv.FormatUint(id, 10) + " " + responseBody
-
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(formatted)); err != nil {
-				log.Printf("write error: %v", err)
+			if err := c.deliver(dataFrame{websocket.TextMessage, frame}, delay, true); err != nil {
+				logger().Warn("write failed", "event", "write_error", "remote_addr", r.RemoteAddr, "error", err)
 				break
 			}
-			log.Printf("echoed message #%d to %s: %q", id, r.RemoteAddr, formatted)
+			logger().Info("echoed message", "event", "echo", "remote_addr", r.RemoteAddr, "msg_id", id, "command", rep.command, "response", logText(frame))
 		}
 	}
 
-	// Stop the ping goroutine
-	close(done)
-
-	log.Printf("connection closed from %s", r.RemoteAddr)
+	logger().Info("connection closed", "event", "connection_closed", "remote_addr", r.RemoteAddr)
 }
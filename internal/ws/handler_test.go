@@ -0,0 +1,693 @@
+// Filename: internal/ws/handler_test.go
+
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves HandleWebSocket for the duration of the test
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dialTestServer opens a WebSocket to srv from an allowed origin
+func dialTestServer(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	return dialOrigin(t, srv, "http://localhost:4000")
+}
+
+// dialOrigin opens a WebSocket to srv with the given Origin header
+func dialOrigin(t *testing.T, srv *httptest.Server, origin string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{}
+	header.Set("Origin", origin)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestControlFrameFloodIsClosed(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+
+	for i := 0; i <= controlMaxMessages; i++ {
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("ping %d: %v", i, err)
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("got %v expected close %d", err, websocket.ClosePolicyViolation)
+	}
+}
+
+// roundTrip sends a text message and returns the response with its "#N " counter removed
+func roundTrip(t *testing.T, conn *websocket.Conn, msg string) string {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("write %q: %v", msg, err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read reply to %q: %v", msg, err)
+	}
+	reply := string(data)
+	if strings.HasPrefix(reply, "#") {
+		if _, body, ok := strings.Cut(reply, " "); ok {
+			return body
+		}
+	}
+	return reply
+}
+
+func TestFlagsChangeResponseFormat(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+
+	got := roundTrip(t, conn, `{"command":"flags","set":{"numbering":false,"pretty":true}}`)
+	want := "{\n  \"command\": \"flags\",\n  \"flags\": {\n    \"checksum\": false,\n    \"numbering\": false,\n    \"pretty\": true\n  }\n}"
+	if got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+
+	roundTrip(t, conn, `{"command":"flags","set":{"pretty":false,"checksum":true}}`)
+	if got := roundTrip(t, conn, "hello"); got != "hello crc32=3610a686" {
+		t.Errorf("got %q expected %q", got, "hello crc32=3610a686")
+	}
+}
+
+// withHub runs the test against a fresh hub so other tests' clients don't receive its broadcasts
+func withHub(t *testing.T) *ClientHub {
+	t.Helper()
+	h := NewHub()
+	go h.Run()
+	prev := currentHub()
+	SetHub(h)
+	t.Cleanup(func() { SetHub(prev) })
+	return h
+}
+
+func TestBroadcastReportsDelivery(t *testing.T) {
+	withHub(t)
+	srv := newTestServer(t)
+	sender := dialTestServer(t, srv)
+	receiver := dialTestServer(t, srv)
+
+	// A round trip on each connection ensures both are registered with the hub
+	roundTrip(t, sender, "ready")
+	roundTrip(t, receiver, "ready")
+
+	want := `{"delivered":1,"failed":0,"failedClients":[]}`
+	if got := roundTrip(t, sender, "BROADCAST:hi"); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := receiver.ReadMessage()
+	if err != nil || !strings.HasSuffix(string(data), "] hi") {
+		t.Errorf("got %q, %v expected the broadcast", data, err)
+	}
+}
+
+func TestBroadcastEchoToSender(t *testing.T) {
+	for _, tt := range []struct {
+		echo    bool
+		receipt string
+	}{
+		{false, `{"delivered":1,"failed":0,"failedClients":[]}`},
+		{true, `{"delivered":2,"failed":0,"failedClients":[]}`},
+	} {
+		c := DefaultConfig()
+		c.BroadcastEchoToSender = tt.echo
+		withConfig(t, c)
+		withHub(t)
+		srv := newTestServer(t)
+		sender := dialTestServer(t, srv)
+		receiver := dialTestServer(t, srv)
+		roundTrip(t, sender, "ready")
+		roundTrip(t, receiver, "ready")
+
+		if err := sender.WriteMessage(websocket.TextMessage, []byte("BROADCAST:hi")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		// The hub delivers the sender's copy before the receipt comes back
+		if tt.echo {
+			expectBroadcast(t, sender, "hi")
+		}
+		_ = sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := sender.ReadMessage()
+		if _, got, _ := strings.Cut(string(data), " "); err != nil || got != tt.receipt {
+			t.Errorf("echo %v: got %q, %v expected %q", tt.echo, data, err, tt.receipt)
+		}
+		expectBroadcast(t, receiver, "hi")
+		expectSilence(t, sender)
+	}
+}
+
+func TestHubEchoesToSenderOnRequest(t *testing.T) {
+	h := withHub(t)
+	srv := newTestServer(t)
+	sender := dialTestServer(t, srv)
+	other := dialTestServer(t, srv)
+	roundTrip(t, sender, "ready")
+	roundTrip(t, other, "ready")
+
+	var from *Connection
+	h.mu.RLock()
+	for c := range h.clients {
+		if c.RemoteAddr == sender.LocalAddr().String() {
+			from = c
+		}
+	}
+	h.mu.RUnlock()
+	if from == nil {
+		t.Fatal("sender not registered with the hub")
+	}
+
+	// A read timeout breaks the connection, so the silent case goes last
+	for _, echo := range []bool{true, false} {
+		result := h.send(BroadcastMessage{Payload: []byte("[test] hi"), Sender: from, Percent: 100, EchoToSender: echo})
+		wantDelivered, wantSkipped := 1, 1
+		if echo {
+			wantDelivered, wantSkipped = 2, 0
+		}
+		if result.Delivered != wantDelivered || result.Skipped != wantSkipped {
+			t.Errorf("echo %v: got %d delivered, %d skipped expected %d, %d", echo, result.Delivered, result.Skipped, wantDelivered, wantSkipped)
+		}
+		expectBroadcast(t, other, "hi")
+		if echo {
+			expectBroadcast(t, sender, "hi")
+		} else {
+			expectSilence(t, sender)
+		}
+	}
+}
+
+func TestGroupStatsAggregatesMembers(t *testing.T) {
+	withHub(t)
+	srv := newTestServer(t)
+	a := dialTestServer(t, srv)
+	b := dialTestServer(t, srv)
+	other := dialTestServer(t, srv)
+
+	roundTrip(t, a, `{"command":"join","group":"team"}`)
+	roundTrip(t, b, `{"command":"join","group":"team"}`)
+	roundTrip(t, other, `{"command":"join","group":"elsewhere"}`)
+
+	var stats GroupStats
+	got := roundTrip(t, a, `{"command":"groupstats","group":"team"}`)
+	if err := json.Unmarshal([]byte(got), &stats); err != nil {
+		t.Fatalf("decode %q: %v", got, err)
+	}
+	// Two joins plus this request in; the two join replies out
+	if stats.Active != 2 || stats.MessagesIn != 3 || stats.MessagesOut != 2 {
+		t.Errorf("got %+v expected 2 active, 3 in, 2 out", stats)
+	}
+
+	roundTrip(t, b, `{"command":"join","group":""}`)
+	got = roundTrip(t, a, `{"command":"groupstats","group":"team"}`)
+	if err := json.Unmarshal([]byte(got), &stats); err != nil || stats.Active != 1 {
+		t.Errorf("got %q expected 1 active after leaving", got)
+	}
+}
+
+func TestReplayResendsResponses(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	first := roundTrip(t, conn, "one")
+	second := roundTrip(t, conn, "UPPER:two")
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"command":"replay","count":2}`)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{first, second, `{"command":"replay","count":2}`} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if _, body, _ := strings.Cut(string(data), " "); body != want {
+			t.Errorf("got %q expected %q", body, want)
+		}
+	}
+}
+
+func TestRateLimitRejectsFlood(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	for i := 0; i < DevProfile.MaxMessages; i++ {
+		if got := roundTrip(t, conn, "hi"); got != "hi" {
+			t.Fatalf("message %d got %q expected echo", i+1, got)
+		}
+	}
+
+	before := atomic.LoadUint64(&messageCounter)
+	got := roundTrip(t, conn, "hi")
+	var resp struct {
+		Error        string `json:"error"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+	if err := json.Unmarshal([]byte(got), &resp); err != nil {
+		t.Fatalf("decode %q: %v", got, err)
+	}
+	if resp.Error != "rate limit exceeded" || resp.RetryAfterMs <= 0 || resp.RetryAfterMs > DevProfile.RateWindow.Milliseconds() {
+		t.Errorf("got %q expected a rate limit error with retry_after_ms", got)
+	}
+	if after := atomic.LoadUint64(&messageCounter); after != before {
+		t.Errorf("message counter moved from %d to %d for a dropped message", before, after)
+	}
+}
+
+func TestPerConnectionCounter(t *testing.T) {
+	c := DefaultConfig()
+	c.PerConnectionCounter = true
+	withConfig(t, c)
+	srv := newTestServer(t)
+	a, b := dialTestServer(t, srv), dialTestServer(t, srv)
+
+	readReply := func(conn *websocket.Conn, msg string) string {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write %q: %v", msg, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read reply to %q: %v", msg, err)
+		}
+		return string(data)
+	}
+
+	before := atomic.LoadUint64(&messageCounter)
+	steps := []struct {
+		conn *websocket.Conn
+		msg  string
+		want string
+	}{
+		{a, "a", "#1 a"},
+		{b, "b", "#1 b"},
+		{a, "a", "#2 a"},
+		{a, "a", "#3 a"},
+		{b, "b", "#2 b"},
+	}
+	for i, step := range steps {
+		if got := readReply(step.conn, step.msg); got != step.want {
+			t.Errorf("message %d got %q expected %q", i+1, got, step.want)
+		}
+	}
+	if after := atomic.LoadUint64(&messageCounter); after-before != 5 {
+		t.Errorf("global counter moved by %d expected 5", after-before)
+	}
+}
+
+func TestBinaryMessagesAreEchoedAsBinary(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	payload := []byte{0x00, 0x01, 0xff, 'U', 'P', 'P', 'E', 'R', ':'}
+	if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msgType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if msgType != websocket.BinaryMessage {
+		t.Errorf("got message type %d expected binary", msgType)
+	}
+	_, body, ok := bytes.Cut(data, []byte(" "))
+	if !ok || data[0] != '#' || !bytes.Equal(body, payload) {
+		t.Errorf("got %q expected \"#N \" followed by %q", data, payload)
+	}
+}
+
+func TestBinaryMessagesCountAgainstRateLimit(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	for i := 0; i < DevProfile.MaxMessages; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte{byte(i)}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("read echo %d: %v", i+1, err)
+		}
+	}
+	if got := roundTrip(t, conn, "hi"); !strings.Contains(got, "rate limit exceeded") {
+		t.Errorf("got %q expected a rate limit error", got)
+	}
+}
+
+func TestHubShutdownClosesClients(t *testing.T) {
+	h := withHub(t)
+	srv := newTestServer(t)
+	clients := []*websocket.Conn{dialTestServer(t, srv), dialTestServer(t, srv), dialTestServer(t, srv)}
+	for _, conn := range clients {
+		roundTrip(t, conn, "ready")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	for i, conn := range clients {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("client %d got %v expected close %d", i, err, websocket.CloseGoingAway)
+		}
+	}
+
+	// A stopped hub returns at once instead of blocking callers
+	if got := h.BroadcastSample([]byte("late"), nil, 100); got != 0 {
+		t.Errorf("got %d deliveries after shutdown expected 0", got)
+	}
+}
+
+func TestHubShutdownSurvivesStalledClient(t *testing.T) {
+	h := withHub(t)
+	srv := newTestServer(t)
+	clients := []*websocket.Conn{dialTestServer(t, srv), dialTestServer(t, srv)}
+	for _, conn := range clients {
+		roundTrip(t, conn, "ready")
+	}
+
+	// No writer runs for this client, so its close frame is never written
+	stalled := NewConnection(nil, "stalled", DevProfile)
+	if err := h.Register(stalled); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_ = h.Shutdown(ctx)
+
+	for i, conn := range clients {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("client %d got %v expected close %d", i, err, websocket.CloseGoingAway)
+		}
+	}
+}
+
+func TestConnectAfterHubShutdown(t *testing.T) {
+	h := withHub(t)
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := h.Register(NewConnection(nil, "late", DevProfile)); err != ErrHubClosed {
+		t.Errorf("got %v expected %v", err, ErrHubClosed)
+	}
+
+	conn := dialTestServer(t, newTestServer(t))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("got %v expected close %d", err, websocket.CloseGoingAway)
+	}
+}
+
+func TestHistoryListsRecentCommands(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	for _, msg := range []string{"UPPER:a", `{"command":"add","a":1,"b":2}`, "REVERSE:b", `{"command":"now"}`, "FREQ:c", "UPPER:d"} {
+		roundTrip(t, conn, msg)
+	}
+
+	// Bounded by the dev profile's history size, oldest first
+	want := `{"count":5,"history":["JSON:add","REVERSE:b","JSON:now","FREQ:c","UPPER:d"]}`
+	if got := roundTrip(t, conn, "HISTORY"); got != want {
+		t.Errorf("got %s expected %s", got, want)
+	}
+	if got := roundTrip(t, conn, `{"command":"history"}`); got != want {
+		t.Errorf("got %s expected %s", got, want)
+	}
+}
+
+func TestClearEmptiesHistory(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	roundTrip(t, conn, "UPPER:a")
+	roundTrip(t, conn, "REVERSE:b")
+	if got := roundTrip(t, conn, "CLEAR"); got != `{"cleared":true,"count":0}` {
+		t.Errorf("got %s expected a confirmation", got)
+	}
+	if got := roundTrip(t, conn, "HISTORY"); got != `{"count":0,"history":[]}` {
+		t.Errorf("got %s expected an empty history", got)
+	}
+	roundTrip(t, conn, "UPPER:c")
+	if got := roundTrip(t, conn, `{"command":"clear","id":1}`); got != `{"cleared":true,"count":0,"id":1}` {
+		t.Errorf("got %s expected a confirmation", got)
+	}
+	if got := roundTrip(t, conn, "HISTORY"); got != `{"count":0,"history":[]}` {
+		t.Errorf("got %s expected an empty history", got)
+	}
+}
+
+func TestConcurrentPingsEchoesAndBroadcasts(t *testing.T) {
+	withHub(t)
+	srv := newTestServer(t)
+	conn := dialTestServer(t, srv)
+	other := dialTestServer(t, srv)
+	roundTrip(t, conn, "ready")
+	roundTrip(t, other, "ready")
+
+	var pongs int32
+	conn.SetPongHandler(func(string) error {
+		atomic.AddInt32(&pongs, 1)
+		return nil
+	})
+
+	const pings, echoes, broadcasts = 15, 8, 5
+	errs := make(chan error, 3)
+	go func() {
+		for i := 0; i < pings; i++ {
+			if err := conn.WriteControl(websocket.PingMessage, []byte(strconv.Itoa(i)), time.Now().Add(time.Second)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := 0; i < echoes; i++ {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("echo"+strconv.Itoa(i))); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := 0; i < broadcasts; i++ {
+			if err := other.WriteMessage(websocket.TextMessage, []byte("BROADCAST:b"+strconv.Itoa(i))); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	// Every frame must arrive intact; echoes and broadcasts each keep their order
+	var gotEchoes, gotBroadcasts []string
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for len(gotEchoes) < echoes || len(gotBroadcasts) < broadcasts {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %d echoes, %d broadcasts: %v", len(gotEchoes), len(gotBroadcasts), err)
+		}
+		msg := string(data)
+		if i := strings.Index(msg, "] "); strings.HasPrefix(msg, "[BROADCAST from ") && i > 0 {
+			gotBroadcasts = append(gotBroadcasts, msg[i+2:])
+		} else if _, body, ok := strings.Cut(msg, " "); ok {
+			gotEchoes = append(gotEchoes, body)
+		} else {
+			t.Fatalf("malformed frame %q", msg)
+		}
+	}
+	for i, got := range gotEchoes {
+		if want := "echo" + strconv.Itoa(i); got != want {
+			t.Errorf("echo %d got %q expected %q", i, got, want)
+		}
+	}
+	for i, got := range gotBroadcasts {
+		if want := "b" + strconv.Itoa(i); got != want {
+			t.Errorf("broadcast %d got %q expected %q", i, got, want)
+		}
+	}
+	// Pongs are only handled while reading; wait for any still in flight
+	if atomic.LoadInt32(&pongs) < pings {
+		_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, data, err := conn.ReadMessage(); err == nil {
+			t.Errorf("unexpected frame %q", data)
+		}
+	}
+	if n := atomic.LoadInt32(&pongs); n != pings {
+		t.Errorf("got %d pongs expected %d", n, pings)
+	}
+}
+
+func TestLowerKeepsCounterPrefix(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("LOWER:MiXeD")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	counter, body, _ := strings.Cut(string(data), " ")
+	if _, err := strconv.ParseUint(strings.TrimPrefix(counter, "#"), 10, 64); err != nil || !strings.HasPrefix(counter, "#") || body != "mixed" {
+		t.Errorf("got %q expected \"#N mixed\"", data)
+	}
+}
+
+func TestOversizedMessageIsClosed(t *testing.T) {
+	c := DefaultConfig()
+	c.MaxMessageBytes = 16
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	if got := roundTrip(t, conn, strings.Repeat("a", 16)); got != strings.Repeat("a", 16) {
+		t.Errorf("got %q expected a message at the limit to echo", got)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", 17))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseMessageTooBig || closeErr.Text != "message too large" {
+		t.Errorf("got %v expected close %d \"message too large\"", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestInvalidUTF8IsClosed(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+
+	if got := roundTrip(t, conn, "héllo"); got != "héllo" {
+		t.Errorf("got %q expected valid UTF-8 to echo", got)
+	}
+	// Binary messages may hold any bytes
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0xff}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || !strings.HasSuffix(string(data), "\xff") {
+		t.Errorf("got %q, %v expected the binary echo", data, err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte{'h', 0xc3, 0x28}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseInvalidFramePayloadData || closeErr.Text != "invalid UTF-8 in text frame" {
+		t.Errorf("got %v expected close %d \"invalid UTF-8 in text frame\"", err, websocket.CloseInvalidFramePayloadData)
+	}
+}
+
+func TestIdleConnectionTimesOut(t *testing.T) {
+	c := DefaultConfig()
+	c.PongWait = 300 * time.Millisecond
+	c.PingPeriod = 200 * time.Millisecond
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+
+	// Ignore the server's pings so no pong extends the deadline
+	conn.SetPingHandler(func(string) error { return nil })
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage() // skip the idle warning
+	}
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("got %v expected close %d", err, websocket.CloseNormalClosure)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Errorf("closed after %v expected about %v", elapsed, c.PongWait)
+	}
+}
+
+func TestIdleWarningBeforeTimeout(t *testing.T) {
+	c := DefaultConfig()
+	c.PongWait = 400 * time.Millisecond
+	c.PingPeriod = 350 * time.Millisecond
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+	conn.SetPingHandler(func(string) error { return nil })
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("got %v expected the idle warning", err)
+	}
+	var warning struct {
+		Warning   string `json:"warning"`
+		ClosingIn int64  `json:"closing_in_ms"`
+	}
+	if err := json.Unmarshal(data, &warning); err != nil || warning.Warning != "idle" {
+		t.Fatalf("got %s expected an idle warning", data)
+	}
+	if warning.ClosingIn <= 0 || warning.ClosingIn > 100 {
+		t.Errorf("got closing_in_ms %d expected at most the last quarter of %v", warning.ClosingIn, c.PongWait)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("warned after %v expected about %v", elapsed, c.PongWait*3/4)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("got %v expected close %d after the warning", err, websocket.CloseNormalClosure)
+	}
+}
+
+func TestActivityPostponesIdleWarning(t *testing.T) {
+	c := DefaultConfig()
+	c.PongWait = 400 * time.Millisecond
+	c.PingPeriod = 350 * time.Millisecond
+	withConfig(t, c)
+	conn := dialTestServer(t, newTestServer(t))
+	conn.SetPingHandler(func(string) error { return nil })
+
+	// A message every 200ms keeps the client under the 300ms warning point
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		if got := roundTrip(t, conn, "hi"); got != "hi" {
+			t.Fatalf("got %q expected the echo, not a warning", got)
+		}
+	}
+}
+
+func TestConfigureRejectsPingPeriodNotBelowPongWait(t *testing.T) {
+	c := DefaultConfig()
+	c.PongWait = time.Second
+	c.PingPeriod = time.Second
+	if err := Configure(c); err == nil {
+		t.Errorf("expected an error when the ping period equals the pong wait")
+	}
+}
@@ -0,0 +1,56 @@
+// Filename: internal/ws/handshake.go
+
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// reservedHandshakeHeader reports whether the upgrade sets name itself
+func reservedHandshakeHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Upgrade", "Connection":
+		return true
+	}
+	return strings.HasPrefix(http.CanonicalHeaderKey(name), "Sec-Websocket-")
+}
+
+// handshakeHeaders returns the configured response headers for the upgrade of r
+func handshakeHeaders(c *Config, r *http.Request) http.Header {
+	if len(c.HandshakeHeaders) == 0 && c.HandshakeHeaderFunc == nil {
+		return nil
+	}
+	h := c.HandshakeHeaders.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if c.HandshakeHeaderFunc != nil {
+		for name, values := range c.HandshakeHeaderFunc(r) {
+			if reservedHandshakeHeader(name) {
+				logger().Warn("ignoring reserved handshake header", "event", "handshake_header", "header", name)
+				continue
+			}
+			h[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return h
+}
+
+// CorrelationHeader returns a HandshakeHeaderFunc that echoes the request's
+// name header in the response, generating a random id when the client sent none
+func CorrelationHeader(name string) func(r *http.Request) http.Header {
+	return func(r *http.Request) http.Header {
+		id := r.Header.Get(name)
+		if id == "" {
+			var b [8]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		h := http.Header{}
+		h.Set(name, id)
+		return h
+	}
+}
@@ -0,0 +1,110 @@
+// Filename: internal/ws/handshake_test.go
+
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandshakeHeadersAreSent(t *testing.T) {
+	c := DefaultConfig()
+	c.HandshakeHeaders = http.Header{"X-Server-Instance": {"web-1"}}
+	c.HandshakeHeaderFunc = CorrelationHeader("X-Request-Id")
+	withConfig(t, c)
+	srv := newTestServer(t)
+
+	header := http.Header{}
+	header.Set("Origin", "http://localhost:4000")
+	header.Set("X-Request-Id", "abc123")
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if got := resp.Header.Get("X-Server-Instance"); got != "web-1" {
+		t.Errorf("got X-Server-Instance %q expected %q", got, "web-1")
+	}
+	if got := resp.Header.Get("X-Request-Id"); got != "abc123" {
+		t.Errorf("got X-Request-Id %q expected %q", got, "abc123")
+	}
+}
+
+func TestCorrelationHeaderGeneratesID(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+	if got := CorrelationHeader("X-Request-Id")(r).Get("X-Request-Id"); len(got) != 16 {
+		t.Errorf("got %q expected a 16 character id", got)
+	}
+}
+
+func TestConfigureRejectsReservedHandshakeHeaders(t *testing.T) {
+	c := DefaultConfig()
+	c.HandshakeHeaders = http.Header{"Sec-Websocket-Accept": {"x"}}
+	if err := Configure(c); err == nil {
+		t.Errorf("expected an error for a reserved header")
+	}
+}
+
+func TestCompressionIsNegotiatedWhenEnabled(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		c := DefaultConfig()
+		c.Compression = enabled
+		withConfig(t, c)
+		srv := newTestServer(t)
+
+		header := http.Header{}
+		header.Set("Origin", "http://localhost:4000")
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.Close()
+
+		got := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		if got != enabled {
+			t.Errorf("compression %v: got extensions %q", enabled, resp.Header.Get("Sec-WebSocket-Extensions"))
+		}
+	}
+}
+
+// dialTLS opens a wss:// connection to srv with the given Origin header
+func dialTLS(srv *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+	header := http.Header{}
+	header.Set("Origin", origin)
+	return dialer.Dial("wss"+strings.TrimPrefix(srv.URL, "https"), header)
+}
+
+func TestSecureWebSocketEchoes(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := dialTLS(srv, "https://localhost:4000")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if got := roundTrip(t, conn, "secure"); got != "secure" {
+		t.Errorf("got %q expected %q", got, "secure")
+	}
+}
+
+func TestSecureWebSocketChecksOrigin(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(srv.Close)
+
+	conn, resp, err := dialTLS(srv, "https://evil.example")
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected the handshake to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %v expected status %d", resp, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,99 @@
+// Filename: internal/ws/iplimit.go
+
+package ws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipLimiterEntry is a shared limiter, how many connections hold it and when the last one let go
+type ipLimiterEntry struct {
+	limiter  *RateLimiter
+	refs     int
+	released time.Time
+}
+
+// IPLimiterRegistry hands out one RateLimiter per client IP so that all of a
+// client's connections share a limit. Limiters are created on first use and
+// dropped once no connection has held them for longer than their window, at
+// which point every timestamp they hold has expired anyway.
+type IPLimiterRegistry struct {
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiterEntry
+	lastSweep time.Time
+}
+
+// NewIPLimiterRegistry creates an empty registry
+func NewIPLimiterRegistry() *IPLimiterRegistry {
+	return &IPLimiterRegistry{limiters: make(map[string]*ipLimiterEntry)}
+}
+
+// ipLimiters is shared by every WebSocket connection
+var ipLimiters = NewIPLimiterRegistry()
+
+// Acquire returns the limiter for ip, allowing maxMessages per window, and
+// holds it until Release. A limiter created with different settings is replaced.
+func (reg *IPLimiterRegistry) Acquire(ip string, maxMessages int, window time.Duration) *RateLimiter {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(reg.lastSweep) >= window {
+		for key, e := range reg.limiters {
+			if e.refs == 0 && now.Sub(e.released) > e.limiter.windowDuration {
+				delete(reg.limiters, key)
+			}
+		}
+		reg.lastSweep = now
+	}
+
+	e := reg.limiters[ip]
+	if e == nil {
+		e = &ipLimiterEntry{}
+		reg.limiters[ip] = e
+	}
+	if e.limiter == nil || e.limiter.maxMessages != maxMessages || e.limiter.windowDuration != window {
+		e.limiter = NewRateLimiter(maxMessages, window)
+	}
+	e.refs++
+	return e.limiter
+}
+
+// Release gives up a hold taken by Acquire
+func (reg *IPLimiterRegistry) Release(ip string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if e := reg.limiters[ip]; e != nil && e.refs > 0 {
+		e.refs--
+		e.released = time.Now()
+	}
+}
+
+// Len returns the number of tracked IPs
+func (reg *IPLimiterRegistry) Len() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.limiters)
+}
+
+// clientIP returns the host part of r.RemoteAddr or, when trustProxy is set,
+// the address the proxy appended to X-Forwarded-For (its last entry)
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			entries := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+// Filename: internal/ws/iplimit_test.go
+
+package ws
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIPLimiterRegistrySharesLimiters(t *testing.T) {
+	reg := NewIPLimiterRegistry()
+	a := reg.Acquire("10.0.0.1", 2, time.Minute)
+	b := reg.Acquire("10.0.0.1", 2, time.Minute)
+	other := reg.Acquire("10.0.0.2", 2, time.Minute)
+	if a != b {
+		t.Error("got different limiters for the same IP")
+	}
+	if a == other {
+		t.Error("got the same limiter for different IPs")
+	}
+	if c := reg.Acquire("10.0.0.1", 5, time.Minute); c == a {
+		t.Error("got the old limiter after its settings changed")
+	}
+}
+
+func TestIPLimiterRegistrySweepsIdleLimiters(t *testing.T) {
+	reg := NewIPLimiterRegistry()
+	window := 20 * time.Millisecond
+	reg.Acquire("10.0.0.1", 1, window)
+	reg.Acquire("10.0.0.2", 1, window)
+	reg.Release("10.0.0.2")
+
+	time.Sleep(2 * window)
+	reg.Acquire("10.0.0.3", 1, window)
+	if got := reg.Len(); got != 2 {
+		t.Errorf("got %d tracked IPs expected 2 (the held and the new one)", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remote, xff string
+		trust       bool
+		want        string
+	}{
+		{"192.0.2.1:5000", "", false, "192.0.2.1"},
+		{"[2001:db8::1]:5000", "", false, "2001:db8::1"},
+		{"192.0.2.1:5000", "198.51.100.7", false, "192.0.2.1"},
+		{"192.0.2.1:5000", "198.51.100.7", true, "198.51.100.7"},
+		{"192.0.2.1:5000", "203.0.113.9, 198.51.100.7", true, "198.51.100.7"},
+		{"192.0.2.1:5000", "", true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r, tt.trust); got != tt.want {
+			t.Errorf("%s xff=%q trust=%v got %q expected %q", tt.remote, tt.xff, tt.trust, got, tt.want)
+		}
+	}
+}
+
+func TestIPRateLimitIsSharedAcrossConnections(t *testing.T) {
+	c := DefaultConfig()
+	c.IPMaxMessages = 4
+	withConfig(t, c)
+	prev := ipLimiters
+	ipLimiters = NewIPLimiterRegistry()
+	t.Cleanup(func() { ipLimiters = prev })
+
+	srv := newTestServer(t)
+	conns := []*websocket.Conn{dialTestServer(t, srv), dialTestServer(t, srv), dialTestServer(t, srv)}
+	sent := 0
+	for _, conn := range conns[:2] {
+		for i := 0; i < 2; i++ {
+			if got := roundTrip(t, conn, "hi"); got != "hi" {
+				t.Fatalf("message %d got %q expected echo", sent+1, got)
+			}
+			sent++
+		}
+	}
+	// Each connection is well under its own limit, but the IP is out of messages
+	if got := roundTrip(t, conns[2], "hi"); !strings.Contains(got, "rate limit exceeded") {
+		t.Errorf("got %q expected a rate limit error", got)
+	}
+}
@@ -0,0 +1,106 @@
+// Filename: internal/ws/loadshed.go
+
+package ws
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of WebSocket connections currently open
+var activeConnections int64
+
+// RateMeter keeps an exponentially weighted moving average of events per second
+type RateMeter struct {
+	count    int64
+	rate     float64
+	lastTick time.Time
+	halfLife time.Duration
+	mu       sync.Mutex
+}
+
+// NewRateMeter creates a meter whose average decays by half every halfLife
+func NewRateMeter(halfLife time.Duration) *RateMeter {
+	return &RateMeter{
+		lastTick: time.Now(),
+		halfLife: halfLife,
+	}
+}
+
+// Mark records a single event
+func (m *RateMeter) Mark() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick(time.Now())
+	m.count++
+}
+
+// Rate returns the current moving average in events per second
+func (m *RateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick(time.Now())
+	return m.rate
+}
+
+// tick folds the events counted since the last tick into the average.
+// Ticks happen at most once per second so short bursts are smoothed out.
+func (m *RateMeter) tick(now time.Time) {
+	elapsed := now.Sub(m.lastTick)
+	if elapsed < time.Second {
+		return
+	}
+	instant := float64(m.count) / elapsed.Seconds()
+	alpha := 1 - math.Exp2(-elapsed.Seconds()/m.halfLife.Seconds())
+	m.rate += alpha * (instant - m.rate)
+	m.count = 0
+	m.lastTick = now
+}
+
+// Server-wide message rate used by the load shedder
+var messageRate = NewRateMeter(10 * time.Second)
+
+// reserveConnection claims a slot in count (normally activeConnections)
+// unless max, when above zero, are already taken. Checking and claiming are
+// one atomic step, so concurrent upgrades can't overshoot the limit.
+func reserveConnection(count *int64, max int64) bool {
+	for {
+		n := atomic.LoadInt64(count)
+		if max > 0 && n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(count, n, n+1) {
+			return true
+		}
+	}
+}
+
+// overloaded reports whether new connections should be shed and why. The
+// connection limit is checked separately by reserveConnection.
+func overloaded(c *Config) (string, bool) {
+	if c.ShedMaxGoroutines > 0 {
+		if n := runtime.NumGoroutine(); n > c.ShedMaxGoroutines {
+			return fmt.Sprintf("goroutines %d > %d", n, c.ShedMaxGoroutines), true
+		}
+	}
+	if c.ShedMaxMessageRate > 0 {
+		if r := messageRate.Rate(); r > c.ShedMaxMessageRate {
+			return fmt.Sprintf("message rate %.1f/s > %.1f/s", r, c.ShedMaxMessageRate), true
+		}
+	}
+	return "", false
+}
+
+// retryAfterSeconds formats d for a Retry-After header, rounding up to at least one second
+func retryAfterSeconds(d time.Duration) string {
+	secs := int64(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
@@ -0,0 +1,116 @@
+// Filename: internal/ws/loadshed_test.go
+
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withConfig installs c for the duration of the test
+func withConfig(t *testing.T, c Config) {
+	t.Helper()
+	prev := CurrentConfig()
+	if err := Configure(c); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	t.Cleanup(func() { _ = Configure(prev) })
+}
+
+func TestHandleWebSocketShedsUnderLoad(t *testing.T) {
+	c := DefaultConfig()
+	c.ShedMaxGoroutines = 1
+	c.ShedRetryAfter = 1500 * time.Millisecond
+	withConfig(t, c)
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	rr := httptest.NewRecorder()
+	HandleWebSocket(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %v expected %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("got Retry-After %q expected %q", got, "2")
+	}
+}
+
+func TestConnectionLimitShedsWhenFull(t *testing.T) {
+	c := DefaultConfig()
+	c.ShedMaxConnections = 2
+	withConfig(t, c)
+	srv := newTestServer(t)
+
+	first := dialTestServer(t, srv)
+	dialTestServer(t, srv)
+
+	header := http.Header{}
+	header.Set("Origin", "http://localhost:4000")
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected the third connection to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("got %v expected status %d with Retry-After", resp, http.StatusServiceUnavailable)
+	}
+
+	// Closing a connection frees its slot
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&activeConnections) >= 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("got %v expected a connection once a slot was free", err)
+	}
+	conn.Close()
+}
+
+func TestReserveConnectionNeverOvershoots(t *testing.T) {
+	var count, granted int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveConnection(&count, 10) {
+				atomic.AddInt64(&granted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 10 || count != 10 {
+		t.Errorf("got %d reservations and count %d expected 10", granted, count)
+	}
+}
+
+func TestRateMeterAveragesEvents(t *testing.T) {
+	m := NewRateMeter(time.Second)
+	for i := 0; i < 100; i++ {
+		m.Mark()
+	}
+	// Pretend the events were spread over the last two seconds
+	m.lastTick = m.lastTick.Add(-2 * time.Second)
+
+	if r := m.Rate(); r <= 0 || r > 50 {
+		t.Errorf("got rate %v expected a value in (0, 50]", r)
+	}
+}
+
+func TestConfigureRejectsNegativeThresholds(t *testing.T) {
+	c := DefaultConfig()
+	c.ShedMaxConnections = -1
+	if err := Configure(c); err == nil {
+		t.Error("expected an error for a negative threshold")
+	}
+}
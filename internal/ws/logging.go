@@ -0,0 +1,34 @@
+// Filename: internal/ws/logging.go
+
+package ws
+
+import (
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// Log records carry an "event" field naming what happened, plus
+// "remote_addr", "msg_id" and "command" where they apply.
+var currentLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	currentLogger.Store(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+// logger returns the package logger
+func logger() *slog.Logger {
+	return currentLogger.Load()
+}
+
+// logText logs a byte slice as text, copying it only if the record is written
+type logText []byte
+
+func (b logText) LogValue() slog.Value {
+	return slog.StringValue(string(b))
+}
+
+// SetLogger replaces the package logger, e.g. with one using slog.NewJSONHandler
+func SetLogger(l *slog.Logger) {
+	currentLogger.Store(l)
+}
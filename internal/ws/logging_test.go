@@ -0,0 +1,165 @@
+// Filename: internal/ws/logging_test.go
+
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// captureHandler records the attributes of every log record it handles
+type captureHandler struct {
+	mu      sync.Mutex
+	records []map[string]any
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := map[string]any{"level": r.Level}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.Any()
+		return true
+	})
+	h.mu.Lock()
+	h.records = append(h.records, attrs)
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler      { return h }
+
+// find returns the first record whose event attribute matches
+func (h *captureHandler) find(event string) map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r["event"] == event {
+			return r
+		}
+	}
+	return nil
+}
+
+// findFrom returns the first record with the given event about conn's connection
+func (h *captureHandler) findFrom(event string, conn *websocket.Conn) map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r["event"] == event && r["remote_addr"] == conn.LocalAddr().String() {
+			return r
+		}
+	}
+	return nil
+}
+
+// waitFor polls until conn's connection logs the given event, or fails the test
+func (h *captureHandler) waitFor(t *testing.T, event string, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rec := h.findFrom(event, conn); rec != nil {
+			return rec
+		}
+	}
+	t.Fatalf("no %s event logged", event)
+	return nil
+}
+
+// withLogger captures the package logger's output for the duration of the test
+func withLogger(t *testing.T) *captureHandler {
+	t.Helper()
+	h := &captureHandler{}
+	old := logger()
+	SetLogger(slog.New(h))
+	t.Cleanup(func() { SetLogger(old) })
+	return h
+}
+
+func TestEchoEventIsLoggedWithFields(t *testing.T) {
+	h := withLogger(t)
+	conn := dialTestServer(t, newTestServer(t))
+	roundTrip(t, conn, `{"command":"add","a":1,"b":2}`)
+
+	// The echo is logged after the response is queued, so allow it a moment
+	var rec map[string]any
+	for deadline := time.Now().Add(2 * time.Second); rec == nil && time.Now().Before(deadline); {
+		if rec = h.find("echo"); rec == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if rec == nil {
+		t.Fatal("no echo event logged")
+	}
+	if rec["command"] != "add" {
+		t.Errorf("got command %v expected add", rec["command"])
+	}
+	if id, ok := rec["msg_id"].(uint64); !ok || id == 0 {
+		t.Errorf("got msg_id %v expected a positive id", rec["msg_id"])
+	}
+	if addr, _ := rec["remote_addr"].(string); addr == "" {
+		t.Error("missing remote_addr")
+	}
+	if h.find("connection_opened") == nil {
+		t.Error("no connection_opened event logged")
+	}
+}
+
+func TestClientCloseCodesAreLoggedDistinctly(t *testing.T) {
+	tests := []struct {
+		code   int
+		reason string
+		name   string
+		level  slog.Level
+	}{
+		{websocket.CloseNormalClosure, "done", "normal_closure", slog.LevelInfo},
+		{websocket.CloseGoingAway, "page closed", "going_away", slog.LevelInfo},
+		{websocket.CloseProtocolError, "bad frame", "protocol_error", slog.LevelWarn},
+		{websocket.ClosePolicyViolation, "", "policy_violation", slog.LevelWarn},
+		{4001, "custom", "application", slog.LevelWarn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := withLogger(t)
+			conn := dialTestServer(t, newTestServer(t))
+			msg := websocket.FormatCloseMessage(tt.code, tt.reason)
+			if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("write close: %v", err)
+			}
+
+			// The server answers with the client's own code, not one of its own
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, tt.code) {
+				t.Errorf("got %v expected the close %d echoed", err, tt.code)
+			}
+
+			rec := h.waitFor(t, "client_close", conn)
+			if rec["code"] != int64(tt.code) || rec["code_name"] != tt.name || rec["reason"] != tt.reason || rec["level"] != tt.level {
+				t.Errorf("got %v expected code %d (%s), reason %q at %v", rec, tt.code, tt.name, tt.reason, tt.level)
+			}
+			if h.findFrom("read_timeout", conn) != nil || h.findFrom("read_error", conn) != nil {
+				t.Error("a client close was logged as a read failure")
+			}
+		})
+	}
+}
+
+func TestReadTimeoutIsLogged(t *testing.T) {
+	c := DefaultConfig()
+	c.PongWait = 200 * time.Millisecond
+	c.PingPeriod = 150 * time.Millisecond
+	withConfig(t, c)
+	h := withLogger(t)
+	conn := dialTestServer(t, newTestServer(t))
+	conn.SetPingHandler(func(string) error { return nil })
+
+	h.waitFor(t, "read_timeout", conn)
+	if h.findFrom("client_close", conn) != nil {
+		t.Error("a timeout was logged as a client close")
+	}
+}
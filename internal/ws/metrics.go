@@ -0,0 +1,60 @@
+// Filename: internal/ws/metrics.go
+
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Total JSON commands processed, including each element of a batch
+var commandCounter uint64
+
+// ServerMetrics is the body served by HandleMetrics
+type ServerMetrics struct {
+	ActiveConnections int    `json:"active_connections"`
+	TotalMessages     uint64 `json:"total_messages"`
+	TotalCommands     uint64 `json:"total_commands"`
+}
+
+// currentMetrics reads the server-wide counters
+func currentMetrics() ServerMetrics {
+	return ServerMetrics{
+		ActiveConnections: currentHub().Len(),
+		TotalMessages:     atomic.LoadUint64(&messageCounter),
+		TotalCommands:     atomic.LoadUint64(&commandCounter),
+	}
+}
+
+// HandleHealthz answers load balancer and orchestrator probes with the
+// number of connected clients: 200 while the hub is running or when the
+// server runs without one, 503 once it has stopped and connections can no
+// longer be served
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h := currentHub()
+	status, code := "ok", http.StatusOK
+	if h != nil && !h.Running() {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(struct {
+		Status  string `json:"status"`
+		Clients int    `json:"clients"`
+	}{status, h.Len()})
+}
+
+// HandleMetrics serves the connection and message counters as JSON
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentMetrics())
+}
@@ -0,0 +1,84 @@
+// Filename: internal/ws/metrics_test.go
+
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getMetrics fetches /metrics through HandleMetrics
+func getMetrics(t *testing.T) ServerMetrics {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	HandleMetrics(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %v expected %v", rr.Code, http.StatusOK)
+	}
+	var m ServerMetrics
+	if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Fatalf("decode %s: %v", rr.Body, err)
+	}
+	return m
+}
+
+func TestHandleMetricsReflectsTraffic(t *testing.T) {
+	withHub(t)
+	before := getMetrics(t)
+	if before.ActiveConnections != 0 {
+		t.Errorf("got %d active connections on a fresh hub expected 0", before.ActiveConnections)
+	}
+
+	conn := dialTestServer(t, newTestServer(t))
+	roundTrip(t, conn, "hello")
+	roundTrip(t, conn, `{"command":"add","a":1,"b":2}`)
+	roundTrip(t, conn, `[{"command":"add","a":1,"b":2},{"command":"now"}]`)
+
+	after := getMetrics(t)
+	if after.ActiveConnections != 1 {
+		t.Errorf("got %d active connections expected 1", after.ActiveConnections)
+	}
+	if got := after.TotalMessages - before.TotalMessages; got != 3 {
+		t.Errorf("got %d new messages expected 3", got)
+	}
+	if got := after.TotalCommands - before.TotalCommands; got != 3 {
+		t.Errorf("got %d new commands expected 3", got)
+	}
+}
+
+// getHealthz fetches /healthz through HandleHealthz
+func getHealthz(t *testing.T) (int, string, int) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	HandleHealthz(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var body struct {
+		Status  string `json:"status"`
+		Clients int    `json:"clients"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %s: %v", rr.Body, err)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q expected application/json", ct)
+	}
+	return rr.Code, body.Status, body.Clients
+}
+
+func TestHandleHealthz(t *testing.T) {
+	h := withHub(t)
+	// Registering goes through Run, so a connection that answers proves it is running
+	roundTrip(t, dialTestServer(t, newTestServer(t)), "hello")
+
+	if code, status, clients := getHealthz(t); code != http.StatusOK || status != "ok" || clients != 1 {
+		t.Errorf("got %d %q with %d clients expected 200 \"ok\" with 1", code, status, clients)
+	}
+
+	if err := h.Shutdown(t.Context()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if code, status, _ := getHealthz(t); code != http.StatusServiceUnavailable || status != "unavailable" {
+		t.Errorf("got %d %q after shutdown expected 503 \"unavailable\"", code, status)
+	}
+}
@@ -1,14 +1,31 @@
 package ws
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+// MessageLimiter decides whether a message may be processed now
+type MessageLimiter interface {
+	AllowMessage() bool
+	RetryAfter() time.Duration
+	Remaining() int
+}
+
 // RateLimiter tracks message timestamps for rate limiting per connection
 type RateLimiter struct {
 	timestamps     []time.Time
@@ -28,20 +45,26 @@ func NewRateLimiter(maxMessages int, windowDuration time.Duration) *RateLimiter
 
 // AllowMessage checks if a new message is allowed based on rate limit
 func (rl *RateLimiter) AllowMessage() bool {
+	return rl.allowAt(time.Now())
+}
+
+// allowAt is AllowMessage for a message arriving at now
+func (rl *RateLimiter) allowAt(now time.Time) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
 	cutoff := now.Add(-rl.windowDuration)
 
-	// Remove timestamps older than the window
-	filtered := make([]time.Time, 0)
-	for _, t := range rl.timestamps {
-		if t.After(cutoff) {
-			filtered = append(filtered, t)
-		}
+	// Remove timestamps older than the window. They're appended in order, so
+	// the expired ones are a prefix; compact in place to reuse the backing array
+	expired := 0
+	for expired < len(rl.timestamps) && !rl.timestamps[expired].After(cutoff) {
+		expired++
+	}
+	if expired > 0 {
+		n := copy(rl.timestamps, rl.timestamps[expired:])
+		rl.timestamps = rl.timestamps[:n]
 	}
-	rl.timestamps = filtered
 
 	// Check if we've exceeded the limit
 	if len(rl.timestamps) >= rl.maxMessages {
@@ -53,6 +76,100 @@ func (rl *RateLimiter) AllowMessage() bool {
 	return true
 }
 
+// RetryAfter returns how long until another message would be allowed
+func (rl *RateLimiter) RetryAfter() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if len(rl.timestamps) < rl.maxMessages || len(rl.timestamps) == 0 {
+		return 0
+	}
+	wait := time.Until(rl.timestamps[len(rl.timestamps)-rl.maxMessages].Add(rl.windowDuration))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Remaining returns how many more messages the current window allows
+func (rl *RateLimiter) Remaining() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := time.Now().Add(-rl.windowDuration)
+	live := 0
+	for _, ts := range rl.timestamps {
+		if ts.After(cutoff) {
+			live++
+		}
+	}
+	return max(rl.maxMessages-live, 0)
+}
+
+// TokenBucketLimiter allows bursts of up to burst messages and refills at
+// rate messages per second. Unlike RateLimiter it keeps no per-message
+// state, so each call is O(1) regardless of the limit.
+type TokenBucketLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+// NewTokenBucketLimiter creates a token bucket that starts full
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// refill adds the tokens earned since the last call; callers hold tb.mu
+func (tb *TokenBucketLimiter) refill() {
+	now := tb.now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// AllowMessage takes a token if one is available
+func (tb *TokenBucketLimiter) AllowMessage() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// RetryAfter returns how long until the next token is available
+func (tb *TokenBucketLimiter) RetryAfter() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	if tb.tokens >= 1 || tb.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// Remaining returns how many whole tokens are available
+func (tb *TokenBucketLimiter) Remaining() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	return int(tb.tokens)
+}
+
 // CommandHistory keeps track of the last N commands per connection
 type CommandHistory struct {
 	commands []string
@@ -90,6 +207,16 @@ func (ch *CommandHistory) GetHistory() []string {
 	return history
 }
 
+// clearedHistoryJSON is the response to CLEAR
+const clearedHistoryJSON = `{"cleared":true,"count":0}`
+
+// Clear empties the history, keeping the slice's capacity
+func (ch *CommandHistory) Clear() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.commands = ch.commands[:0]
+}
+
 // GetHistoryJSON returns history as JSON string
 func (ch *CommandHistory) GetHistoryJSON() string {
 	history := ch.GetHistory()
@@ -103,85 +230,925 @@ func (ch *CommandHistory) GetHistoryJSON() string {
 	return string(data)
 }
 
+// SeqTracker remembers the highest sequence number a connection has sent
+// with ping_seq, to spot skipped or repeated numbers
+type SeqTracker struct {
+	last uint64
+	seen bool
+	mu   sync.Mutex
+}
+
+// NewSeqTracker creates a tracker that has seen nothing yet
+func NewSeqTracker() *SeqTracker {
+	return &SeqTracker{}
+}
+
+// Observe records seq. It returns the number that was expected next (seq
+// itself for the first one) and whether seq was at or below one already
+// seen; a repeated or late number doesn't move the tracker back.
+func (st *SeqTracker) Observe(seq uint64) (expected uint64, stale bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	expected = seq
+	if st.seen {
+		expected = st.last + 1
+	}
+	if st.seen && seq <= st.last {
+		return expected, true
+	}
+	st.last, st.seen = seq, true
+	return expected, false
+}
+
+// MovingAverage keeps the most recent values pushed on a connection and
+// averages over them. The buffer is sized by the window of the last push.
+type MovingAverage struct {
+	values []float64
+	next   int
+	full   bool
+	mu     sync.Mutex
+}
+
+// NewMovingAverage creates an empty moving average
+func NewMovingAverage() *MovingAverage {
+	return &MovingAverage{}
+}
+
+// Push adds value and returns the average over the last window values along
+// with how many values it covers. Changing the window resets the buffer.
+func (ma *MovingAverage) Push(value float64, window int) (float64, int) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	if len(ma.values) != window {
+		ma.values = make([]float64, window)
+		ma.next = 0
+		ma.full = false
+	}
+
+	// Overwrite the oldest value once the ring is full
+	ma.values[ma.next] = value
+	ma.next = (ma.next + 1) % window
+	if ma.next == 0 {
+		ma.full = true
+	}
+
+	n := ma.next
+	if ma.full {
+		n = window
+	}
+	// Summing the window afresh each time keeps precision lost to a large
+	// value, or an overflow to Inf, from outliving that value
+	var sum float64
+	for _, v := range ma.values[:n] {
+		sum += v
+	}
+	return sum / float64(n), n
+}
+
+// Bounds on the per-connection trace buffer
+const (
+	maxTraceEntries      = 20  // request/response pairs kept per connection
+	maxTracePayloadBytes = 256 // longer payloads are truncated in the trace
+)
+
+// TraceEntry is one request/response pair recorded on a connection
+type TraceEntry struct {
+	Time      time.Time `json:"time"`
+	Request   string    `json:"request"`
+	Response  string    `json:"response"`
+	LatencyUs int64     `json:"latency_us"`
+	Variant   string    `json:"variant,omitempty"` // response variant used, if any
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// TraceBuffer keeps the last request/response pairs of a connection for debugging
+type TraceBuffer struct {
+	entries []TraceEntry
+	next    int
+	mu      sync.Mutex
+}
+
+// NewTraceBuffer creates an empty trace buffer
+func NewTraceBuffer() *TraceBuffer {
+	return &TraceBuffer{
+		entries: make([]TraceEntry, 0, maxTraceEntries),
+	}
+}
+
+// truncatePayload shortens s to at most maxTracePayloadBytes, reporting
+// whether it did
+func truncatePayload(s string) (string, bool) {
+	if len(s) <= maxTracePayloadBytes {
+		return s, false
+	}
+	return s[:traceCut(s)], true
+}
+
+// traceCut returns where to cut a payload longer than maxTracePayloadBytes,
+// backing off to the start of a rune so none is split
+func traceCut[T string | []byte](s T) int {
+	n := maxTracePayloadBytes
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
+
+// Record stores a request received at start and the response frame sent
+// for it. Only the part of the frame that is kept is copied.
+func (tb *TraceBuffer) Record(start time.Time, request string, response []byte, variant string) {
+	req, reqCut := truncatePayload(request)
+	respCut := len(response) > maxTracePayloadBytes
+	resp := string(response)
+	if respCut {
+		resp = string(response[:traceCut(response)])
+	}
+	entry := TraceEntry{
+		Time:      start,
+		Request:   req,
+		Response:  resp,
+		LatencyUs: time.Since(start).Microseconds(),
+		Variant:   variant,
+		Truncated: reqCut || respCut,
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if len(tb.entries) < maxTraceEntries {
+		tb.entries = append(tb.entries, entry)
+		return
+	}
+	tb.entries[tb.next] = entry // Overwrite oldest
+	tb.next = (tb.next + 1) % maxTraceEntries
+}
+
+// Entries returns the recorded pairs, oldest first
+func (tb *TraceBuffer) Entries() []TraceEntry {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	entries := make([]TraceEntry, 0, len(tb.entries))
+	entries = append(entries, tb.entries[tb.next:]...)
+	entries = append(entries, tb.entries[:tb.next]...)
+	return entries
+}
+
+// Responses kept per connection for the replay command
+const maxReplayResponses = 20
+
+// ReplayBuffer keeps the last responses sent on a connection so they can be re-sent
+type ReplayBuffer struct {
+	frames [][]byte
+	next   int
+	mu     sync.Mutex
+}
+
+// NewReplayBuffer creates an empty replay buffer
+func NewReplayBuffer() *ReplayBuffer {
+	return &ReplayBuffer{
+		frames: make([][]byte, 0, maxReplayResponses),
+	}
+}
+
+// Add records a response that was sent
+func (rb *ReplayBuffer) Add(frame []byte) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.frames) < maxReplayResponses {
+		rb.frames = append(rb.frames, frame)
+		return
+	}
+	rb.frames[rb.next] = frame
+	rb.next = (rb.next + 1) % maxReplayResponses
+}
+
+// Last returns up to n of the most recent responses, oldest first
+func (rb *ReplayBuffer) Last(n int) [][]byte {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	frames := make([][]byte, 0, len(rb.frames))
+	frames = append(frames, rb.frames[rb.next:]...)
+	frames = append(frames, rb.frames[:rb.next]...)
+	if n < len(frames) {
+		frames = frames[len(frames)-n:]
+	}
+	return frames
+}
+
+// Most responses an AckWindow buffers while waiting for acknowledgements
+const maxPendingResponses = 64
+
+// ErrTooManyPending is returned when a connection has more unsent responses
+// buffered than the ack window allows
+var ErrTooManyPending = errors.New("too many unacknowledged responses")
+
+// pendingResponse is a response held back until the ack window has room
+type pendingResponse struct {
+	id    uint64
+	frame []byte
+}
+
+// AckWindow implements a sliding-window delivery protocol: once enabled, at
+// most limit responses may be sent without the client acknowledging them,
+// and further responses are buffered until acks arrive
+type AckWindow struct {
+	limit   int // 0 means acknowledgements are off
+	unacked map[uint64]struct{}
+	pending []pendingResponse
+	mu      sync.Mutex
+}
+
+// NewAckWindow creates a window with acknowledgements turned off
+func NewAckWindow() *AckWindow {
+	return &AckWindow{
+		unacked: make(map[uint64]struct{}),
+	}
+}
+
+// SetLimit changes the window size; 0 turns acknowledgements off. It returns
+// any buffered frames that may now be sent.
+func (aw *AckWindow) SetLimit(limit int) [][]byte {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	aw.limit = limit
+	if limit == 0 {
+		aw.unacked = make(map[uint64]struct{})
+	}
+	return aw.release()
+}
+
+// Offer reports whether the response with the given id may be sent now. If
+// not, the frame is buffered and returned later by Ack or SetLimit.
+func (aw *AckWindow) Offer(id uint64, frame []byte) (bool, error) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if aw.limit == 0 {
+		return true, nil
+	}
+	if len(aw.unacked) < aw.limit && len(aw.pending) == 0 {
+		aw.unacked[id] = struct{}{}
+		return true, nil
+	}
+	if len(aw.pending) >= maxPendingResponses {
+		return false, ErrTooManyPending
+	}
+	aw.pending = append(aw.pending, pendingResponse{id: id, frame: frame})
+	return false, nil
+}
+
+// Ack marks the response with the given id as received by the client. It
+// reports whether the id was outstanding and returns frames that may now be sent.
+func (aw *AckWindow) Ack(id uint64) ([][]byte, bool) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if _, ok := aw.unacked[id]; !ok {
+		return nil, false
+	}
+	delete(aw.unacked, id)
+	return aw.release(), true
+}
+
+// Unacked returns how many sent responses are awaiting acknowledgement
+func (aw *AckWindow) Unacked() int {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	return len(aw.unacked)
+}
+
+// release moves buffered responses into the window while it has room
+func (aw *AckWindow) release() [][]byte {
+	var frames [][]byte
+	for len(aw.pending) > 0 && (aw.limit == 0 || len(aw.unacked) < aw.limit) {
+		p := aw.pending[0]
+		aw.pending = aw.pending[1:]
+		if aw.limit > 0 {
+			aw.unacked[p.id] = struct{}{}
+		}
+		frames = append(frames, p.frame)
+	}
+	return frames
+}
+
+// ChunkDigest incrementally hashes chunks pushed on a connection so a client
+// can verify a multi-message upload
+type ChunkDigest struct {
+	crc    hash.Hash32
+	sha    hash.Hash
+	bytes  int64
+	chunks int
+	mu     sync.Mutex
+}
+
+// DigestSummary describes all chunks pushed since the last reset
+type DigestSummary struct {
+	CRC32  string `json:"crc32"`
+	SHA256 string `json:"sha256"`
+	Bytes  int64  `json:"bytes"`
+	Chunks int    `json:"chunks"`
+}
+
+// NewChunkDigest creates an empty digest
+func NewChunkDigest() *ChunkDigest {
+	return &ChunkDigest{
+		crc: crc32.NewIEEE(),
+		sha: sha256.New(),
+	}
+}
+
+// Write adds a chunk to the running hashes and returns the chunk count so far
+func (cd *ChunkDigest) Write(chunk string) int {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	cd.crc.Write([]byte(chunk))
+	cd.sha.Write([]byte(chunk))
+	cd.bytes += int64(len(chunk))
+	cd.chunks++
+	return cd.chunks
+}
+
+// Finalize returns the digest of everything written and resets for the next upload
+func (cd *ChunkDigest) Finalize() DigestSummary {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	sum := DigestSummary{
+		CRC32:  hex.EncodeToString(cd.crc.Sum(nil)),
+		SHA256: hex.EncodeToString(cd.sha.Sum(nil)),
+		Bytes:  cd.bytes,
+		Chunks: cd.chunks,
+	}
+	cd.crc.Reset()
+	cd.sha.Reset()
+	cd.bytes = 0
+	cd.chunks = 0
+	return sum
+}
+
+// Connection flags and their defaults
+var defaultFlags = map[string]bool{
+	"numbering": true,  // format responses with the response template ("#N " by default)
+	"pretty":    false, // indent JSON responses
+	"checksum":  false, // append the CRC32 of the response body
+}
+
+// FeatureFlags holds the boolean toggles a connection can set for itself
+type FeatureFlags struct {
+	flags map[string]bool
+	mu    sync.Mutex
+}
+
+// NewFeatureFlags creates a flag set with the default values
+func NewFeatureFlags() *FeatureFlags {
+	flags := make(map[string]bool, len(defaultFlags))
+	for name, v := range defaultFlags {
+		flags[name] = v
+	}
+	return &FeatureFlags{flags: flags}
+}
+
+// Enabled reports whether the named flag is on
+func (ff *FeatureFlags) Enabled(name string) bool {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	return ff.flags[name]
+}
+
+// Set applies changes; if any flag is unknown nothing is changed
+func (ff *FeatureFlags) Set(changes map[string]bool) error {
+	for name := range changes {
+		if _, ok := defaultFlags[name]; !ok {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+	}
+
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	for name, v := range changes {
+		ff.flags[name] = v
+	}
+	return nil
+}
+
+// All returns a copy of every flag and its value
+func (ff *FeatureFlags) All() map[string]bool {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+
+	all := make(map[string]bool, len(ff.flags))
+	for name, v := range ff.flags {
+		all[name] = v
+	}
+	return all
+}
+
+// ErrTooManyTimers is returned when a connection already has its maximum
+// number of active timers
+var ErrTooManyTimers = errors.New("too many active timers on this connection")
+
+// TimerSet tracks the timers a connection has scheduled so server-push
+// features share one limit and are all stopped on disconnect
+type TimerSet struct {
+	timers  map[*time.Timer]struct{}
+	max     int
+	stopped bool
+	mu      sync.Mutex
+}
+
+// NewTimerSet creates a timer set allowing at most max active timers
+func NewTimerSet(max int) *TimerSet {
+	return &TimerSet{
+		timers: make(map[*time.Timer]struct{}),
+		max:    max,
+	}
+}
+
+// AfterFunc runs f after d, counting it against the limit until it fires
+func (ts *TimerSet) AfterFunc(d time.Duration, f func()) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.stopped {
+		return errors.New("connection is closing")
+	}
+	if len(ts.timers) >= ts.max {
+		return ErrTooManyTimers
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		ts.mu.Lock()
+		_, active := ts.timers[t]
+		delete(ts.timers, t)
+		ts.mu.Unlock()
+		if active {
+			f()
+		}
+	})
+	ts.timers[t] = struct{}{}
+	return nil
+}
+
+// Active returns how many timers have not fired yet
+func (ts *TimerSet) Active() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.timers)
+}
+
+// StopAll cancels every pending timer and refuses new ones
+func (ts *TimerSet) StopAll() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for t := range ts.timers {
+		t.Stop()
+		delete(ts.timers, t)
+	}
+	ts.stopped = true
+}
+
 // ClientHub manages all connected WebSocket clients for broadcasting
 type ClientHub struct {
-	clients    map[*websocket.Conn]bool
+	clients    map[*Connection]bool
+	groups     map[string]map[*Connection]bool
+	rooms      map[string]map[*Connection]bool
+	names      map[string]*Connection // set with NAME: for direct messages
 	broadcast  chan BroadcastMessage
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
+	register   chan *Connection
+	unregister chan *Connection
 	mu         sync.RWMutex
+
+	// done is closed by Shutdown to stop Run; stopped is closed once Run
+	// returns. running is set while Run is looping.
+	done     chan struct{}
+	stopped  chan struct{}
+	shutdown sync.Once
+	running  atomic.Bool
+
+	// How long Register and Unregister wait for Run
+	waitTimeout time.Duration
 }
 
+// hubWaitTimeout bounds how long Register and Unregister wait for Run to take
+// the connection, so a wedged hub can't hold up connection handlers forever
+const hubWaitTimeout = 5 * time.Second
+
+// ErrHubBusy is returned by Register when Run doesn't take the connection in time
+var ErrHubBusy = errors.New("hub busy")
+
+// ErrHubClosed is returned by Register once the hub has been shut down
+var ErrHubClosed = errors.New("hub closed")
+
 // BroadcastMessage contains the message and sender information
 type BroadcastMessage struct {
 	Payload []byte
-	Sender  *websocket.Conn
+	Sender  *Connection
+
+	// Percent of the other clients, chosen at random, that receive the message
+	Percent float64
+
+	// If set, only members of this room are candidates
+	Room string
+
+	// If set, the sender receives its own message too (on top of any
+	// sample), for clients that wait for the server's copy rather than
+	// rendering their message straight away
+	EchoToSender bool
+
+	// If TTL is set, Run drops the message instead of delivering it once it
+	// is older than TTL, so a delayed one can't flush stale data to clients.
+	// Enqueued defaults to the time the message is queued.
+	TTL      time.Duration
+	Enqueued time.Time
+
+	// If set, receives the per-client outcome once the message is sent
+	Result chan<- BroadcastResult
 }
 
-// Global hub instance
-var Hub *ClientHub
+// BroadcastResult summarizes the delivery of one broadcast
+type BroadcastResult struct {
+	Delivered     int      `json:"delivered"`
+	Failed        int      `json:"failed"`
+	FailedClients []string `json:"failedClients"`
+
+	// Write errors by client id, and recipients skipped (the sender, unless
+	// it asked for its own copy)
+	Errors  map[string]string `json:"-"`
+	Skipped int               `json:"-"`
+
+	// Set when the message outlived its TTL and went to no one
+	Expired bool `json:"expired,omitempty"`
+}
 
-func init() {
-	Hub = &ClientHub{
-		clients:    make(map[*websocket.Conn]bool),
+// NewHub creates an empty hub. Its Run loop must be started by the caller,
+// normally with go hub.Run().
+func NewHub() *ClientHub {
+	return &ClientHub{
+		clients:    make(map[*Connection]bool),
+		groups:     make(map[string]map[*Connection]bool),
+		rooms:      make(map[string]map[*Connection]bool),
+		names:      make(map[string]*Connection),
 		broadcast:  make(chan BroadcastMessage, 256),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+		register:   make(chan *Connection),
+		unregister: make(chan *Connection),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+
+		waitTimeout: hubWaitTimeout,
 	}
-	go Hub.Run()
 }
 
+// Hub is the hub HandleWebSocket registers connections with. The package
+// never creates one: while it is nil, connections are served without
+// broadcast, rooms, names or groups, and no hub goroutine runs.
+//
+// Deprecated: start a hub from NewHub and pass it to SetHub instead.
+var Hub *ClientHub
+
+var hubMu sync.Mutex
+
+// SetHub makes h, started with go h.Run(), the hub HandleWebSocket registers
+// connections with. A nil h turns broadcast off for new connections.
+func SetHub(h *ClientHub) {
+	hubMu.Lock()
+	defer hubMu.Unlock()
+	Hub = h
+}
+
+// currentHub returns the configured hub, or nil if there is none
+func currentHub() *ClientHub {
+	hubMu.Lock()
+	defer hubMu.Unlock()
+	return Hub
+}
+
+// ErrNoHub is returned by hub features used while no hub is configured
+var ErrNoHub = errors.New("broadcast is not available on this server")
+
 // Run starts the hub's main loop
 func (h *ClientHub) Run() {
+	defer close(h.stopped)
+	h.running.Store(true)
+	defer h.running.Store(false)
 	for {
 		select {
+		case <-h.done:
+			return
+
 		case conn := <-h.register:
 			h.mu.Lock()
 			h.clients[conn] = true
+			total := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("Client registered, total clients: %d", len(h.clients))
+			logger().Info("client registered", "event", "hub_register", "remote_addr", conn.RemoteAddr, "clients", total)
 
 		case conn := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[conn]; ok {
-				delete(h.clients, conn)
-				log.Printf("Client unregistered, total clients: %d", len(h.clients))
-			}
+			h.removeLocked(conn)
 			h.mu.Unlock()
 
 		case msg := <-h.broadcast:
+			if msg.TTL > 0 && time.Since(msg.Enqueued) > msg.TTL {
+				logger().Warn("broadcast expired", "event", "broadcast_expired", "age", time.Since(msg.Enqueued), "ttl", msg.TTL)
+				if msg.Result != nil {
+					msg.Result <- BroadcastResult{FailedClients: []string{}, Expired: true}
+				}
+				continue
+			}
+
 			h.mu.RLock()
-			for client := range h.clients {
-				// Don't send back to sender (optional - can be changed)
+			candidates := h.clients
+			if msg.Room != "" {
+				candidates = h.rooms[msg.Room]
+			}
+			recipients := make([]*Connection, 0, len(candidates))
+			result := BroadcastResult{FailedClients: []string{}}
+			senderIsCandidate := false
+			for client := range candidates {
+				// The sender is never part of the sample
 				if client == msg.Sender {
+					senderIsCandidate = true
 					continue
 				}
+				recipients = append(recipients, client)
+			}
+			recipients = sampleClients(recipients, msg.Percent)
+			if senderIsCandidate {
+				if msg.EchoToSender {
+					recipients = append(recipients, msg.Sender)
+				} else {
+					result.Skipped++
+				}
+			}
 
-				// Try to write, if it fails, the connection will be cleaned up elsewhere
-				err := client.WriteMessage(websocket.TextMessage, msg.Payload)
+			var dropped []*Connection
+			for _, client := range recipients {
+				// Queue without waiting, so a stalled client can't hold up the
+				// hub; a full or closed connection counts as failed and is dropped
+				err := client.TrySend(msg.Payload)
 				if err != nil {
-					log.Printf("error broadcasting to client: %v", err)
+					dropped = append(dropped, client)
+					logger().Warn("broadcast failed", "event", "broadcast_error", "remote_addr", client.RemoteAddr, "client", client.Name(), "error", err)
+					if result.Errors == nil {
+						result.Errors = make(map[string]string)
+					}
+					result.Failed++
+					result.FailedClients = append(result.FailedClients, client.Name())
+					result.Errors[client.Name()] = err.Error()
+					continue
 				}
+				result.Delivered++
 			}
 			h.mu.RUnlock()
+
+			// A full queue means a slow consumer, which is disconnected rather
+			// than left to fail every broadcast. A closed client whose
+			// Unregister timed out would otherwise stay registered for good.
+			if len(dropped) > 0 {
+				h.mu.Lock()
+				for _, client := range dropped {
+					h.removeLocked(client)
+				}
+				h.mu.Unlock()
+				for _, client := range dropped {
+					if client.closeSlow() == nil {
+						logger().Warn("slow consumer disconnected", "event", "slow_consumer", "remote_addr", client.RemoteAddr, "client", client.Name())
+					}
+				}
+			}
+
+			if msg.Result != nil {
+				msg.Result <- result
+			}
 		}
 	}
 }
 
-// Register adds a client to the hub
-func (h *ClientHub) Register(conn *websocket.Conn) {
-	h.register <- conn
+// removeLocked forgets conn and its groups, rooms and name; h.mu must be held
+func (h *ClientHub) removeLocked(conn *Connection) {
+	if _, ok := h.clients[conn]; !ok {
+		return
+	}
+	delete(h.clients, conn)
+	h.leaveGroupLocked(conn)
+	h.leaveRoomsLocked(conn)
+	h.releaseNameLocked(conn)
+	logger().Info("client unregistered", "event", "hub_unregister", "remote_addr", conn.RemoteAddr, "clients", len(h.clients))
 }
 
-// Unregister removes a client from the hub
-func (h *ClientHub) Unregister(conn *websocket.Conn) {
-	h.unregister <- conn
+// Running reports whether Run is processing the hub's events
+func (h *ClientHub) Running() bool {
+	if h == nil {
+		return false
+	}
+	return h.running.Load()
+}
+
+// Len returns the number of registered clients
+func (h *ClientHub) Len() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Register adds a client to the hub, giving up with ErrHubBusy after
+// hubWaitTimeout and returning ErrHubClosed after Shutdown
+func (h *ClientHub) Register(conn *Connection) error {
+	timer := time.NewTimer(h.waitTimeout)
+	defer timer.Stop()
+	select {
+	case h.register <- conn:
+		return nil
+	case <-h.done:
+		return ErrHubClosed
+	case <-timer.C:
+		logger().Warn("hub did not take registration", "event", "hub_register_timeout", "remote_addr", conn.RemoteAddr)
+		return ErrHubBusy
+	}
+}
+
+// Unregister removes a client from the hub. If Run doesn't take it within
+// hubWaitTimeout the client is left for Run to prune at its next broadcast.
+func (h *ClientHub) Unregister(conn *Connection) {
+	timer := time.NewTimer(h.waitTimeout)
+	defer timer.Stop()
+	select {
+	case h.unregister <- conn:
+	case <-h.done:
+	case <-timer.C:
+		logger().Warn("hub did not take unregistration", "event", "hub_unregister_timeout", "remote_addr", conn.RemoteAddr)
+	}
 }
 
 // Broadcast sends a message to all connected clients
-func (h *ClientHub) Broadcast(payload []byte, sender *websocket.Conn) {
-	h.broadcast <- BroadcastMessage{
-		Payload: payload,
-		Sender:  sender,
+func (h *ClientHub) Broadcast(payload []byte, sender *Connection) {
+	if h == nil {
+		return
 	}
+	select {
+	case h.broadcast <- BroadcastMessage{Payload: payload, Sender: sender, Percent: 100, EchoToSender: cfg().BroadcastEchoToSender}:
+	case <-h.done:
+	}
+}
+
+// BroadcastWithReceipt sends a message to all other clients and waits for
+// the per-client outcome
+func (h *ClientHub) BroadcastWithReceipt(payload []byte, sender *Connection) BroadcastResult {
+	return h.send(BroadcastMessage{Payload: payload, Sender: sender, Percent: 100, EchoToSender: cfg().BroadcastEchoToSender})
+}
+
+// BroadcastSample sends a message to a random percent of the other clients
+// and returns how many received it
+func (h *ClientHub) BroadcastSample(payload []byte, sender *Connection, percent float64) int {
+	return h.send(BroadcastMessage{Payload: payload, Sender: sender, Percent: percent, EchoToSender: cfg().BroadcastEchoToSender}).Delivered
+}
+
+// send queues a broadcast and waits for its result
+func (h *ClientHub) send(msg BroadcastMessage) BroadcastResult {
+	if h == nil {
+		return BroadcastResult{FailedClients: []string{}}
+	}
+	result := make(chan BroadcastResult, 1)
+	msg.Result = result
+	if msg.Enqueued.IsZero() {
+		msg.Enqueued = time.Now()
+	}
+	select {
+	case h.broadcast <- msg:
+	case <-h.done:
+		return BroadcastResult{FailedClients: []string{}}
+	}
+	select {
+	case r := <-result:
+		return r
+	case <-h.stopped:
+		return BroadcastResult{FailedClients: []string{}}
+	}
+}
+
+// Shutdown stops Run and sends every client a going-away close frame,
+// giving up when ctx is done. The frames are sent in parallel so a stalled
+// client can't use up the others' deadline. Clients disconnect once they
+// answer the close.
+func (h *ClientHub) Shutdown(ctx context.Context) error {
+	h.shutdown.Do(func() { close(h.done) })
+	select {
+	case <-h.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	deadline := time.Now().Add(cfg().WriteWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// Copy the clients so the lock isn't held while the frames are written
+	h.mu.RLock()
+	clients := make([]*Connection, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+	logger().Info("hub shutting down", "event", "hub_shutdown", "clients", len(clients))
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Connection) {
+			defer wg.Done()
+			if err := client.closeBefore(websocket.CloseGoingAway, "server shutting down", deadline); err != nil {
+				logger().Warn("close failed", "event", "close_error", "remote_addr", client.RemoteAddr, "client", client.Name(), "error", err)
+			}
+		}(client)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// GroupStats aggregates the metrics of the connections in a group
+type GroupStats struct {
+	Group       string `json:"group"`
+	Active      int    `json:"active"`
+	MessagesIn  uint64 `json:"messagesIn"`
+	MessagesOut uint64 `json:"messagesOut"`
+	BytesIn     uint64 `json:"bytesIn"`
+	BytesOut    uint64 `json:"bytesOut"`
+}
+
+// JoinGroup moves conn into group; an empty group just leaves the current one.
+// Clients the hub has pruned or unregistered aren't added, since nothing would
+// remove them again.
+func (h *ClientHub) JoinGroup(conn *Connection, group string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[conn] {
+		return
+	}
+	h.leaveGroupLocked(conn)
+	if group == "" {
+		return
+	}
+	if h.groups[group] == nil {
+		h.groups[group] = make(map[*Connection]bool)
+	}
+	h.groups[group][conn] = true
+	conn.group = group
+}
+
+// leaveGroupLocked removes conn from its group; the caller holds h.mu
+func (h *ClientHub) leaveGroupLocked(conn *Connection) {
+	members := h.groups[conn.group]
+	delete(members, conn)
+	if len(members) == 0 {
+		delete(h.groups, conn.group)
+	}
+	conn.group = ""
+}
+
+// GroupStats sums the metrics of the connections currently in group
+func (h *ClientHub) GroupStats(group string) GroupStats {
+	stats := GroupStats{Group: group}
+	if h == nil {
+		return stats
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for conn := range h.groups[group] {
+		m := conn.Metrics()
+		stats.Active++
+		stats.MessagesIn += m.MessagesIn
+		stats.MessagesOut += m.MessagesOut
+		stats.BytesIn += m.BytesIn
+		stats.BytesOut += m.BytesOut
+	}
+	return stats
+}
+
+// sampleClients returns a random subset holding percent of clients, rounded
+// to the nearest client
+func sampleClients(clients []*Connection, percent float64) []*Connection {
+	if percent >= 100 {
+		return clients
+	}
+	n := int(math.Round(float64(len(clients)) * percent / 100))
+	rand.Shuffle(len(clients), func(i, j int) {
+		clients[i], clients[j] = clients[j], clients[i]
+	})
+	return clients[:n]
 }
@@ -0,0 +1,647 @@
+// Filename: internal/ws/middleware_test.go
+
+package ws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMovingAveragePush(t *testing.T) {
+	ma := NewMovingAverage()
+
+	tests := []struct {
+		value     float64
+		window    int
+		wantAvg   float64
+		wantCount int
+	}{
+		{10, 3, 10, 1},
+		{20, 3, 15, 2},
+		{30, 3, 20, 3},
+		{40, 3, 30, 3}, // 10 falls out of the window
+		{5, 2, 5, 1},   // new window resets the buffer
+		{7, 2, 6, 2},
+		{1e20, 2, 5e19, 2}, // a large value, then small ones once it has left
+		{1, 2, 5e19, 2},
+		{1, 2, 1, 2},
+		{1e308, 2, 1e308 / 2, 2}, // the sum overflows, then recovers
+		{1e308, 2, math.Inf(1), 2},
+		{3, 2, 1e308 / 2, 2},
+		{5, 2, 4, 2},
+	}
+	for _, tt := range tests {
+		avg, n := ma.Push(tt.value, tt.window)
+		if avg != tt.wantAvg || n != tt.wantCount {
+			t.Errorf("Push(%v, %d) got (%v, %d) expected (%v, %d)", tt.value, tt.window, avg, n, tt.wantAvg, tt.wantCount)
+		}
+	}
+}
+
+func TestCommandHistoryClear(t *testing.T) {
+	ch := NewCommandHistory(5)
+	for _, cmd := range []string{"UPPER:a", "REVERSE:b", "FREQ:c"} {
+		ch.Add(cmd)
+	}
+	before := cap(ch.commands)
+	ch.Clear()
+	if got := ch.GetHistory(); len(got) != 0 {
+		t.Errorf("got %v expected an empty history", got)
+	}
+	if after := cap(ch.commands); after != before {
+		t.Errorf("got capacity %d expected %d to be kept", after, before)
+	}
+	ch.Add("UPPER:d")
+	if got := ch.GetHistory(); len(got) != 1 || got[0] != "UPPER:d" {
+		t.Errorf("got %v expected only the command added after clearing", got)
+	}
+}
+
+func TestTimerSetLimitAndStopAll(t *testing.T) {
+	ts := NewTimerSet(2)
+	fired := make(chan struct{}, 3)
+	for i := 0; i < 2; i++ {
+		if err := ts.AfterFunc(time.Hour, func() { fired <- struct{}{} }); err != nil {
+			t.Fatalf("timer %d: unexpected error %v", i, err)
+		}
+	}
+	if err := ts.AfterFunc(time.Hour, func() {}); err != ErrTooManyTimers {
+		t.Errorf("got error %v expected %v", err, ErrTooManyTimers)
+	}
+
+	ts.StopAll()
+	if n := ts.Active(); n != 0 {
+		t.Errorf("got %d active timers after StopAll expected 0", n)
+	}
+	if err := ts.AfterFunc(time.Millisecond, func() {}); err == nil {
+		t.Error("expected an error scheduling after StopAll")
+	}
+	select {
+	case <-fired:
+		t.Error("stopped timer fired")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestTimerSetFreesSlotWhenFired(t *testing.T) {
+	ts := NewTimerSet(1)
+	done := make(chan struct{})
+	if err := ts.AfterFunc(time.Millisecond, func() { close(done) }); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	<-done
+	if err := ts.AfterFunc(time.Millisecond, func() {}); err != nil {
+		t.Errorf("got error %v after the first timer fired expected nil", err)
+	}
+}
+
+func TestTraceBufferKeepsNewestEntries(t *testing.T) {
+	tb := NewTraceBuffer()
+	start := time.Now()
+	for i := 0; i < maxTraceEntries+3; i++ {
+		tb.Record(start, "req"+strconv.Itoa(i), []byte("resp"), "")
+	}
+
+	entries := tb.Entries()
+	if len(entries) != maxTraceEntries {
+		t.Fatalf("got %d entries expected %d", len(entries), maxTraceEntries)
+	}
+	if entries[0].Request != "req3" {
+		t.Errorf("got oldest request %q expected %q", entries[0].Request, "req3")
+	}
+	if last := entries[len(entries)-1].Request; last != "req"+strconv.Itoa(maxTraceEntries+2) {
+		t.Errorf("got newest request %q", last)
+	}
+}
+
+func TestTraceBufferTruncatesPayloads(t *testing.T) {
+	tb := NewTraceBuffer()
+	tb.Record(time.Now(), strings.Repeat("x", maxTracePayloadBytes*2), []byte("ok"), "")
+
+	e := tb.Entries()[0]
+	if len(e.Request) != maxTracePayloadBytes || !e.Truncated {
+		t.Errorf("got request length %d truncated=%v expected %d true", len(e.Request), e.Truncated, maxTracePayloadBytes)
+	}
+}
+
+func TestTraceBufferTruncatesAtRuneBoundary(t *testing.T) {
+	// Two-byte runes from offset 1, so byte maxTracePayloadBytes is mid-rune
+	payload := "x" + strings.Repeat("é", maxTracePayloadBytes)
+	tb := NewTraceBuffer()
+	tb.Record(time.Now(), payload, []byte(payload), "")
+
+	e := tb.Entries()[0]
+	for name, got := range map[string]string{"request": e.Request, "response": e.Response} {
+		if !utf8.ValidString(got) || len(got) != maxTracePayloadBytes-1 {
+			t.Errorf("%s got %d bytes valid=%v expected %d valid bytes", name, len(got), utf8.ValidString(got), maxTracePayloadBytes-1)
+		}
+	}
+	if !e.Truncated {
+		t.Error("expected the entry to be marked truncated")
+	}
+}
+
+func TestSampleClientsPercent(t *testing.T) {
+	tests := []struct {
+		percent float64
+		want    int
+	}{
+		{100, 10},
+		{50, 5},
+		{25, 3}, // 2.5 rounds to the nearest client
+		{0, 0},
+	}
+	for _, tt := range tests {
+		got := sampleClients(make([]*Connection, 10), tt.percent)
+		if len(got) != tt.want {
+			t.Errorf("sampleClients(10, %v) got %d clients expected %d", tt.percent, len(got), tt.want)
+		}
+	}
+}
+
+func TestAckWindowHoldsResponsesUntilAcked(t *testing.T) {
+	aw := NewAckWindow()
+	if ok, _ := aw.Offer(1, []byte("one")); !ok {
+		t.Fatal("expected responses to flow while acks are off")
+	}
+
+	aw.SetLimit(2)
+	for id := uint64(2); id <= 3; id++ {
+		if ok, err := aw.Offer(id, []byte("r")); !ok || err != nil {
+			t.Fatalf("Offer(%d) got (%v, %v) expected (true, nil)", id, ok, err)
+		}
+	}
+	if ok, _ := aw.Offer(4, []byte("four")); ok {
+		t.Fatal("expected response 4 to be held with a full window")
+	}
+
+	if _, ok := aw.Ack(99); ok {
+		t.Error("expected an unknown id to be rejected")
+	}
+	released, ok := aw.Ack(2)
+	if !ok || len(released) != 1 || string(released[0]) != "four" {
+		t.Errorf("Ack(2) got (%q, %v) expected ([four], true)", released, ok)
+	}
+	if n := aw.Unacked(); n != 2 {
+		t.Errorf("got %d unacked expected 2", n)
+	}
+}
+
+func TestAckWindowBoundsPending(t *testing.T) {
+	aw := NewAckWindow()
+	aw.SetLimit(1)
+	aw.Offer(1, nil)
+	for id := uint64(2); id < 2+maxPendingResponses; id++ {
+		if _, err := aw.Offer(id, nil); err != nil {
+			t.Fatalf("Offer(%d): unexpected error %v", id, err)
+		}
+	}
+	if _, err := aw.Offer(1000, nil); err != ErrTooManyPending {
+		t.Errorf("got error %v expected %v", err, ErrTooManyPending)
+	}
+}
+
+func TestChunkDigestMatchesWholeUpload(t *testing.T) {
+	cd := NewChunkDigest()
+	cd.Write("hello, ")
+	if n := cd.Write("world"); n != 2 {
+		t.Errorf("got chunk count %d expected 2", n)
+	}
+
+	sum := cd.Finalize()
+	whole := sha256.Sum256([]byte("hello, world"))
+	if sum.SHA256 != hex.EncodeToString(whole[:]) || sum.Bytes != 12 || sum.Chunks != 2 {
+		t.Errorf("got %+v", sum)
+	}
+	if want := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("hello, world"))); sum.CRC32 != want {
+		t.Errorf("got crc32 %s expected %s", sum.CRC32, want)
+	}
+
+	if again := cd.Finalize(); again.Bytes != 0 || again.Chunks != 0 {
+		t.Errorf("expected finalize to reset the digest, got %+v", again)
+	}
+}
+
+func TestNewHubRunsIndependently(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	if n := h.BroadcastSample([]byte("hi"), nil, 100); n != 0 {
+		t.Errorf("got %d deliveries on an empty hub expected 0", n)
+	}
+}
+
+func TestServingWithoutHub(t *testing.T) {
+	prev := currentHub()
+	SetHub(nil)
+	t.Cleanup(func() { SetHub(prev) })
+
+	// HTTP endpoints report no clients and don't start a hub
+	if m := getMetrics(t); m.ActiveConnections != 0 {
+		t.Errorf("got %d active connections expected 0", m.ActiveConnections)
+	}
+	if code, infos := getConnections(t, ""); code != http.StatusOK || len(infos) != 0 {
+		t.Errorf("got status %d and %d connections expected 200 and none", code, len(infos))
+	}
+	rr := httptest.NewRecorder()
+	HandleHealthz(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("got healthz status %d expected %d", rr.Code, http.StatusOK)
+	}
+	if currentHub() != nil {
+		t.Fatal("an HTTP request created a hub")
+	}
+
+	// Connections still echo; hub features report that they are unavailable
+	conn := dialTestServer(t, newTestServer(t))
+	for _, tt := range []struct{ msg, want string }{
+		{"hello", "hello"},
+		{"JOIN:team", `{"error":"` + ErrNoHub.Error() + `"}`},
+		{"BROADCAST:hi", `{"delivered":0,"failed":0,"failedClients":[]}`},
+	} {
+		if got := roundTrip(t, conn, tt.msg); got != tt.want {
+			t.Errorf("%s: got %q expected %q", tt.msg, got, tt.want)
+		}
+	}
+	if currentHub() != nil {
+		t.Error("a connection created a hub")
+	}
+}
+
+func TestStalledClientDoesNotBlockHub(t *testing.T) {
+	h := withHub(t)
+	srv := newTestServer(t)
+	sender := dialTestServer(t, srv)
+	receiver := dialTestServer(t, srv)
+	roundTrip(t, sender, "ready")
+	roundTrip(t, receiver, "ready")
+
+	// No writer drains this client, so its queue stays full
+	stalled := NewConnection(nil, "stalled", DevProfile)
+	for i := 0; i < sendQueueSize; i++ {
+		_ = stalled.TrySend([]byte("x"))
+	}
+	if err := h.Register(stalled); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	done := make(chan string, 1)
+	go func() { done <- roundTrip(t, sender, "BROADCAST:hi") }()
+	select {
+	case got := <-done:
+		want := fmt.Sprintf(`{"delivered":1,"failed":1,"failedClients":["%s"]}`, stalled.Name())
+		if got != want {
+			t.Errorf("got %q expected %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcast blocked on the stalled client")
+	}
+	expectBroadcast(t, receiver, "hi")
+
+	// New clients still register; the stalled one was dropped as a slow consumer
+	late := dialTestServer(t, srv)
+	roundTrip(t, late, "ready")
+	if n := h.Len(); n != 3 {
+		t.Errorf("got %d clients expected 3", n)
+	}
+}
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	c := DefaultConfig()
+	c.SendQueueSize = 4
+	withConfig(t, c)
+	h := withHub(t)
+	srv := newTestServer(t)
+	slow := dialTestServer(t, srv)
+	fast := dialTestServer(t, srv)
+	roundTrip(t, slow, "ready")
+	roundTrip(t, fast, "ready")
+
+	// slow stops reading; once the socket buffers and its queue fill up, the
+	// hub drops it while fast keeps receiving
+	payload := []byte("[test] " + strings.Repeat("x", 16*1024))
+	dropped := false
+	for i := 0; i < 2000 && !dropped; i++ {
+		r := h.BroadcastWithReceipt(payload, nil)
+		dropped = r.Failed == 1
+		if r.Delivered+r.Failed != 2 {
+			t.Fatalf("broadcast %d: got %+v expected 2 recipients", i, r)
+		}
+		_ = fast.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := fast.ReadMessage(); err != nil {
+			t.Fatalf("broadcast %d: fast client: %v", i, err)
+		}
+	}
+	if !dropped {
+		t.Fatal("slow client was never dropped")
+	}
+	if r := h.BroadcastWithReceipt([]byte("[test] after"), nil); r.Delivered != 1 || r.Failed != 0 {
+		t.Errorf("got %+v expected only the fast client", r)
+	}
+	expectBroadcast(t, fast, "after")
+
+	// Draining the backlog reaches the close frame
+	for {
+		_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := slow.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+				t.Errorf("got %v expected close %d", err, websocket.CloseInternalServerErr)
+			}
+			break
+		}
+	}
+}
+
+func TestRegisterGivesUpOnBusyHub(t *testing.T) {
+	h := NewHub() // Run never starts, so nothing takes the connection
+	h.waitTimeout = 50 * time.Millisecond
+	c := NewConnection(nil, "a", DevProfile)
+	start := time.Now()
+	if err := h.Register(c); err != ErrHubBusy {
+		t.Errorf("got %v expected %v", err, ErrHubBusy)
+	}
+	h.Unregister(c)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("register and unregister took %v", elapsed)
+	}
+}
+
+func TestHubPrunesClosedClients(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	t.Cleanup(func() { _ = h.Shutdown(t.Context()) })
+
+	c := NewConnection(nil, "a", DevProfile)
+	go c.writePump()
+	c.stopWriter()
+	if err := h.Register(c); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if r := h.BroadcastWithReceipt([]byte("hi"), nil); r.Failed != 1 {
+		t.Errorf("got %+v expected the closed client to fail", r)
+	}
+	if n := h.Len(); n != 0 {
+		t.Errorf("got %d clients expected the closed one to be pruned", n)
+	}
+}
+
+func TestPrunedClientCannotJoinGroup(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	t.Cleanup(func() { _ = h.Shutdown(t.Context()) })
+
+	c := NewConnection(nil, "a", DevProfile)
+	go c.writePump()
+	c.stopWriter()
+	if err := h.Register(c); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	h.BroadcastWithReceipt([]byte("hi"), nil) // prunes the closed client
+
+	h.JoinGroup(c, "team")
+	h.JoinGroup(NewConnection(nil, "b", DevProfile), "team") // never registered
+	if stats := h.GroupStats("team"); stats.Active != 0 {
+		t.Errorf("got %+v expected no active members", stats)
+	}
+}
+
+func TestExpiredBroadcastIsNotDelivered(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	t.Cleanup(func() { _ = h.Shutdown(t.Context()) })
+
+	c := NewConnection(nil, "a", DevProfile) // no writer, so frames stay queued
+	if err := h.Register(c); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	enqueued := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	r := h.send(BroadcastMessage{Payload: []byte("stale"), Percent: 100, TTL: 5 * time.Millisecond, Enqueued: enqueued})
+	if !r.Expired || r.Delivered != 0 || len(c.send) != 0 {
+		t.Errorf("got %+v with %d queued expected the message to expire undelivered", r, len(c.send))
+	}
+
+	r = h.send(BroadcastMessage{Payload: []byte("fresh"), Percent: 100, TTL: time.Minute})
+	if r.Expired || r.Delivered != 1 || len(c.send) != 1 {
+		t.Errorf("got %+v with %d queued expected the message to be delivered", r, len(c.send))
+	}
+}
+
+func TestFeatureFlagsSet(t *testing.T) {
+	ff := NewFeatureFlags()
+	if !ff.Enabled("numbering") || ff.Enabled("pretty") {
+		t.Fatalf("unexpected defaults %v", ff.All())
+	}
+	if err := ff.Set(map[string]bool{"pretty": true, "numbering": false}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := ff.Set(map[string]bool{"checksum": true, "bogus": true}); err == nil {
+		t.Error("expected an unknown flag to be rejected")
+	}
+	want := map[string]bool{"numbering": false, "pretty": true, "checksum": false}
+	for name, v := range want {
+		if ff.Enabled(name) != v {
+			t.Errorf("flag %s got %v expected %v", name, ff.Enabled(name), v)
+		}
+	}
+}
+
+func TestReplayBufferKeepsLatest(t *testing.T) {
+	rb := NewReplayBuffer()
+	for i := 0; i < maxReplayResponses+5; i++ {
+		rb.Add([]byte(strconv.Itoa(i)))
+	}
+	got := rb.Last(3)
+	want := []string{"22", "23", "24"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames expected %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("frame %d got %s expected %s", i, got[i], want[i])
+		}
+	}
+	if n := len(rb.Last(100)); n != maxReplayResponses {
+		t.Errorf("got %d frames expected %d", n, maxReplayResponses)
+	}
+}
+
+// fakeClock is a settable time source for limiters
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestBucket returns a token bucket driven by a fake clock
+func newTestBucket(rate float64, burst int) (*TokenBucketLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Now()}
+	tb := NewTokenBucketLimiter(rate, burst)
+	tb.last, tb.now = clock.t, clock.now
+	return tb, clock
+}
+
+func TestTokenBucketAllowsBurst(t *testing.T) {
+	tb, _ := newTestBucket(1, 5)
+	for i := 0; i < 5; i++ {
+		if !tb.AllowMessage() {
+			t.Fatalf("message %d rejected within the burst", i+1)
+		}
+	}
+	if tb.AllowMessage() {
+		t.Error("expected the message after the burst to be rejected")
+	}
+	if d := tb.RetryAfter(); d != time.Second {
+		t.Errorf("got %v expected 1s", d)
+	}
+}
+
+func TestTokenBucketSteadyRate(t *testing.T) {
+	tb, clock := newTestBucket(4, 1)
+	allowed := 0
+	// Offer 16 messages a second for 60s: the first takes the initial token
+	// and then every fourth gets through (the step is exact in binary, so
+	// there's no rounding drift)
+	for i := 0; i < 16*60; i++ {
+		if tb.AllowMessage() {
+			allowed++
+		}
+		clock.advance(time.Second / 16)
+	}
+	if want := 4 * 60; allowed != want {
+		t.Errorf("got %d messages allowed expected %d", allowed, want)
+	}
+}
+
+func TestTokenBucketRefillIsCappedAtBurst(t *testing.T) {
+	tb, clock := newTestBucket(100, 3)
+	clock.advance(time.Hour)
+	allowed := 0
+	for tb.AllowMessage() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("got %d messages after a long idle expected the burst of 3", allowed)
+	}
+}
+
+// filteringAllow is the original AllowMessage, which rebuilt the timestamp
+// slice on every call; kept as a reference for the in-place version
+func filteringAllow(timestamps *[]time.Time, maxMessages int, window time.Duration, now time.Time) bool {
+	cutoff := now.Add(-window)
+	filtered := make([]time.Time, 0)
+	for _, t := range *timestamps {
+		if t.After(cutoff) {
+			filtered = append(filtered, t)
+		}
+	}
+	*timestamps = filtered
+	if len(*timestamps) >= maxMessages {
+		return false
+	}
+	*timestamps = append(*timestamps, now)
+	return true
+}
+
+func TestRateLimiterMatchesFilteringImplementation(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, window := range []time.Duration{time.Second, 10 * time.Second} {
+		rl := NewRateLimiter(5, window)
+		var reference []time.Time
+		now := time.Now()
+		for i := 0; i < 5000; i++ {
+			// Arrivals in bursts and gaps, including several at the same instant
+			now = now.Add(time.Duration(rng.IntN(4)) * time.Duration(rng.Int64N(int64(window/2))))
+			got := rl.allowAt(now)
+			want := filteringAllow(&reference, 5, window, now)
+			if got != want {
+				t.Fatalf("window %v message %d: got %v expected %v", window, i, got, want)
+			}
+		}
+	}
+}
+
+// steadyArrivals feeds allow a message every 10ms against a 100/s limit, so
+// that each call also expires a timestamp
+func steadyArrivals(b *testing.B, allow func(time.Time) bool) {
+	now := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		now = now.Add(10 * time.Millisecond)
+		allow(now)
+	}
+}
+
+func BenchmarkSlidingWindowSteadyState(b *testing.B) {
+	rl := NewRateLimiter(100, time.Second)
+	steadyArrivals(b, rl.allowAt)
+}
+
+func BenchmarkFilteringSlidingWindowSteadyState(b *testing.B) {
+	var timestamps []time.Time
+	steadyArrivals(b, func(now time.Time) bool {
+		return filteringAllow(&timestamps, 100, time.Second, now)
+	})
+}
+
+func BenchmarkSlidingWindowAllowMessage(b *testing.B) {
+	rl := NewRateLimiter(1000, time.Minute)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rl.AllowMessage()
+	}
+}
+
+func BenchmarkTokenBucketAllowMessage(b *testing.B) {
+	tb := NewTokenBucketLimiter(1000, 1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tb.AllowMessage()
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	rl := NewRateLimiter(2, time.Minute)
+	if d := rl.RetryAfter(); d != 0 {
+		t.Errorf("got %v expected 0 before any messages", d)
+	}
+	rl.AllowMessage()
+	rl.AllowMessage()
+	if rl.AllowMessage() {
+		t.Fatalf("expected the third message to be rejected")
+	}
+	if d := rl.RetryAfter(); d <= 59*time.Second || d > time.Minute {
+		t.Errorf("got %v expected just under a minute", d)
+	}
+}
+
+func TestLimitersReportRemaining(t *testing.T) {
+	rl := NewRateLimiter(3, time.Minute)
+	tb, clock := newTestBucket(1, 3)
+	for _, l := range []MessageLimiter{rl, tb} {
+		if got := l.Remaining(); got != 3 {
+			t.Errorf("%T: got %d remaining expected 3 before any message", l, got)
+		}
+		l.AllowMessage()
+		l.AllowMessage()
+		if got := l.Remaining(); got != 1 {
+			t.Errorf("%T: got %d remaining expected 1 after two messages", l, got)
+		}
+	}
+	clock.advance(time.Second)
+	if got := tb.Remaining(); got != 2 {
+		t.Errorf("got %d remaining expected 2 after a token refilled", got)
+	}
+}
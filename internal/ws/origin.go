@@ -0,0 +1,121 @@
+// Filename: internal/ws/origin.go
+
+package ws
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OriginProfile holds the limits and features granted to clients connecting
+// from a particular origin
+type OriginProfile struct {
+	Name           string
+	MaxMessages    int           // rate limit: messages allowed per RateWindow
+	RateWindow     time.Duration // rate limit window
+	Burst          int           // if set, a token bucket refilling at MaxMessages per RateWindow replaces the sliding window
+	HistorySize    int           // commands kept for HISTORY
+	AllowBroadcast bool          // whether BROADCAST: and SAMPLEBROADCAST: are available
+}
+
+// limiter returns the per-connection message limiter the profile asks for
+func (p OriginProfile) limiter() MessageLimiter {
+	if p.Burst > 0 {
+		return NewTokenBucketLimiter(float64(p.MaxMessages)/p.RateWindow.Seconds(), p.Burst)
+	}
+	return NewRateLimiter(p.MaxMessages, p.RateWindow)
+}
+
+// DevProfile is for local development front-ends
+var DevProfile = OriginProfile{
+	Name:           "dev",
+	MaxMessages:    10,
+	RateWindow:     time.Minute,
+	HistorySize:    5,
+	AllowBroadcast: true,
+}
+
+// ProductionProfile is a stricter profile for public front-ends
+var ProductionProfile = OriginProfile{
+	Name:           "production",
+	MaxMessages:    5,
+	RateWindow:     time.Minute,
+	HistorySize:    5,
+	AllowBroadcast: false,
+}
+
+// Only allow pages served from these origins to connect. Keys are lowercase.
+var (
+	allowedOrigins = map[string]OriginProfile{
+		"http://localhost:4000":  DevProfile,
+		"https://localhost:4000": DevProfile, // the same page served over TLS
+	}
+	originsMu sync.RWMutex
+)
+
+// SetOriginProfile allows origin to connect with the given profile. An origin
+// like https://*.example.com allows every subdomain of example.com.
+func SetOriginProfile(origin string, p OriginProfile) {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	allowedOrigins[strings.ToLower(origin)] = p
+}
+
+// lookupOrigin returns the profile for an allowed origin
+func lookupOrigin(o string) (OriginProfile, bool) {
+	if o == "" {
+		return OriginProfile{}, false
+	}
+	originsMu.RLock()
+	defer originsMu.RUnlock()
+	if p, ok := allowedOrigins[strings.ToLower(o)]; ok {
+		return p, true
+	}
+
+	// Fall back to wildcard entries such as https://*.example.com; the most
+	// specific matching pattern wins
+	u, err := url.Parse(strings.ToLower(o))
+	if err != nil || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return OriginProfile{}, false
+	}
+	var best OriginProfile
+	bestLen := -1
+	for pattern, p := range allowedOrigins {
+		if len(pattern) > bestLen && wildcardMatch(pattern, u) {
+			best, bestLen = p, len(pattern)
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// wildcardMatch reports whether u matches a pattern like https://*.example.com:
+// the scheme and port must be the same and the host must be a subdomain
+// (at any depth) of the suffix. The apex itself does not match.
+func wildcardMatch(pattern string, u *url.URL) bool {
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok || scheme != u.Scheme {
+		return false
+	}
+	suffix, port := host, ""
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		suffix, port = host[:i], host[i+1:]
+	}
+	return port == u.Port() && strings.HasSuffix(u.Hostname(), "."+suffix)
+}
+
+func originAllowed(o string) bool {
+	_, ok := lookupOrigin(o)
+	return ok
+}
+
+// profileForOrigin returns the profile for o, falling back to DevProfile for
+// connections admitted without a matching origin (e.g. conformance mode or
+// AllowEmptyOrigin)
+func profileForOrigin(o string) OriginProfile {
+	if p, ok := lookupOrigin(o); ok {
+		return p
+	}
+	return DevProfile
+}
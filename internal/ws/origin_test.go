@@ -0,0 +1,138 @@
+// Filename: internal/ws/origin_test.go
+
+package ws
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestProfileForOrigin(t *testing.T) {
+	SetOriginProfile("https://App.Example.com", ProductionProfile)
+	t.Cleanup(func() {
+		originsMu.Lock()
+		delete(allowedOrigins, "https://app.example.com")
+		originsMu.Unlock()
+	})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+		profile string
+	}{
+		{"http://localhost:4000", true, "dev"},
+		{"HTTP://LOCALHOST:4000", true, "dev"},
+		{"https://app.example.com", true, "production"},
+		{"https://evil.example.com", false, "dev"},
+		{"", false, "dev"},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin); got != tt.allowed {
+			t.Errorf("originAllowed(%q) got %v expected %v", tt.origin, got, tt.allowed)
+		}
+		if got := profileForOrigin(tt.origin).Name; got != tt.profile {
+			t.Errorf("profileForOrigin(%q) got %q expected %q", tt.origin, got, tt.profile)
+		}
+	}
+}
+
+func TestProductionProfileDisablesBroadcast(t *testing.T) {
+	SetOriginProfile("https://prod.example.com", ProductionProfile)
+	t.Cleanup(func() {
+		originsMu.Lock()
+		delete(allowedOrigins, "https://prod.example.com")
+		originsMu.Unlock()
+	})
+
+	conn := dialOrigin(t, newTestServer(t), "https://prod.example.com")
+	want := `{"error":"broadcast is not enabled for this origin"}`
+	if got := roundTrip(t, conn, "BROADCAST:hi"); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+}
+
+func TestWildcardOrigins(t *testing.T) {
+	SetOriginProfile("https://*.Example.com", ProductionProfile)
+	SetOriginProfile("http://*.local.test:8080", DevProfile)
+	t.Cleanup(func() {
+		originsMu.Lock()
+		delete(allowedOrigins, "https://*.example.com")
+		delete(allowedOrigins, "http://*.local.test:8080")
+		originsMu.Unlock()
+	})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://APP.EXAMPLE.COM", true},
+		{"https://example.com", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://example.com.attacker.com", false},
+		{"https://app.example.com.attacker.com", false},
+		{"https://attackerexample.com", false},
+		{"https://user@app.example.com", false},
+		{"http://api.local.test:8080", true},
+		{"http://api.local.test", false},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin); got != tt.allowed {
+			t.Errorf("originAllowed(%q) got %v expected %v", tt.origin, got, tt.allowed)
+		}
+	}
+}
+
+func TestProfileBurstSelectsTokenBucket(t *testing.T) {
+	if _, ok := DevProfile.limiter().(*RateLimiter); !ok {
+		t.Error("expected a sliding window limiter without Burst")
+	}
+	p := DevProfile
+	p.Burst = 3
+	tb, ok := p.limiter().(*TokenBucketLimiter)
+	if !ok {
+		t.Fatal("expected a token bucket limiter with Burst")
+	}
+	if want := float64(p.MaxMessages) / p.RateWindow.Seconds(); tb.rate != want || tb.burst != 3 {
+		t.Errorf("got rate %v burst %v expected %v and 3", tb.rate, tb.burst, want)
+	}
+}
+
+func TestAllowEmptyOrigin(t *testing.T) {
+	for _, tt := range []struct {
+		allowEmpty bool
+		origin     string
+		want       int
+	}{
+		{false, "", http.StatusForbidden},
+		{true, "", http.StatusSwitchingProtocols},
+		{false, "https://evil.example.com", http.StatusForbidden},
+		{true, "https://evil.example.com", http.StatusForbidden},
+		{true, "http://localhost:4000", http.StatusSwitchingProtocols},
+	} {
+		c := DefaultConfig()
+		c.AllowEmptyOrigin = tt.allowEmpty
+		withConfig(t, c)
+		srv := newTestServer(t)
+
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("origin %q: dial: %v", tt.origin, err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("allow empty %v, origin %q: got status %d expected %d", tt.allowEmpty, tt.origin, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Filename: internal/ws/qr.go
+
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The qr command produces a version 1 QR code (21x21) in byte mode with
+// error correction level L and mask pattern 0, which holds up to 17 bytes.
+const (
+	qrSize          = 21
+	qrDataCodewords = 19
+	qrECCodewords   = 7
+	maxQRBytes      = 17
+)
+
+// qrMultiply multiplies two elements of GF(256) modulo the QR polynomial x^8+x^4+x^3+x^2+1
+func qrMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x1D)
+		z ^= ((y >> i) & 1) * x
+	}
+	return z
+}
+
+// qrDivisor returns the Reed-Solomon generator polynomial of the given degree,
+// highest coefficient first with the leading 1 omitted
+func qrDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+// qrErrorCorrection returns the Reed-Solomon error correction codewords for data
+func qrErrorCorrection(data []byte, degree int) []byte {
+	divisor := qrDivisor(degree)
+	result := make([]byte, degree)
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[degree-1] = 0
+		for i := range result {
+			result[i] ^= qrMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// qrCodewords encodes text as byte-mode data codewords followed by its error correction
+func qrCodewords(text []byte) []byte {
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4) // byte mode
+	appendBits(len(text), 8)
+	for _, b := range text {
+		appendBits(int(b), 8)
+	}
+
+	// Terminator, then pad to a whole byte
+	capacity := qrDataCodewords * 8
+	appendBits(0, min(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+
+	data := make([]byte, 0, qrDataCodewords+qrECCodewords)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xEC); len(data) < qrDataCodewords; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+	return append(data, qrErrorCorrection(data, qrECCodewords)...)
+}
+
+// qrFormatBits returns the 15-bit format information for level L and mask 0
+func qrFormatBits() int {
+	data := 0b01<<3 | 0 // level L, mask 0
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// qrMatrix is a grid of modules indexed [y][x]; true is dark
+type qrMatrix struct {
+	modules  [qrSize][qrSize]bool
+	function [qrSize][qrSize]bool
+}
+
+// set places a function module that data and masking must not touch
+func (m *qrMatrix) set(x, y int, dark bool) {
+	m.modules[y][x] = dark
+	m.function[y][x] = true
+}
+
+// drawFunctionPatterns draws the timing and finder patterns and the format information
+func (m *qrMatrix) drawFunctionPatterns() {
+	for i := 0; i < qrSize; i++ {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {qrSize - 4, 3}, {3, qrSize - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= qrSize || y < 0 || y >= qrSize {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				m.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+	m.drawFormatBits(qrFormatBits())
+}
+
+// drawFormatBits writes both copies of the format information and the dark module
+func (m *qrMatrix) drawFormatBits(bits int) {
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		m.set(qrSize-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(8, qrSize-15+i, bit(i))
+	}
+	m.set(8, qrSize-8, true)
+}
+
+// drawCodewords places data in the zigzag order from the bottom right,
+// applying mask 0 (invert where x+y is even)
+func (m *qrMatrix) drawCodewords(data []byte) {
+	i := 0
+	for right := qrSize - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qrSize; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if upward {
+					y = qrSize - 1 - vert
+				}
+				if m.function[y][x] {
+					continue
+				}
+				dark := false
+				if i < len(data)*8 {
+					dark = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+				m.modules[y][x] = dark != ((x+y)%2 == 0)
+			}
+		}
+	}
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// encodeQR returns the QR code for text as rows of modules, true for dark
+func encodeQR(text []byte) [][]bool {
+	var m qrMatrix
+	m.drawFunctionPatterns()
+	m.drawCodewords(qrCodewords(text))
+
+	rows := make([][]bool, qrSize)
+	for y := range rows {
+		rows[y] = m.modules[y][:]
+	}
+	return rows
+}
+
+// processQR responds with req.Text encoded as a QR code matrix
+func processQR(req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command string   `json:"command"`
+		Size    int      `json:"size,omitempty"`
+		Matrix  [][]bool `json:"matrix,omitempty"`
+		Error   string   `json:"error,omitempty"`
+	}{
+		Command: req.Command,
+	}
+	if len(req.Text) == 0 || len(req.Text) > maxQRBytes {
+		resp.Error = fmt.Sprintf("text must be 1 to %d bytes", maxQRBytes)
+		return json.Marshal(resp)
+	}
+	resp.Size = qrSize
+	resp.Matrix = encodeQR([]byte(req.Text))
+	return json.Marshal(resp)
+}
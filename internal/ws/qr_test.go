@@ -0,0 +1,96 @@
+// Filename: internal/ws/qr_test.go
+
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestQRErrorCorrection(t *testing.T) {
+	// "HELLO WORLD" as version 1-M, from the worked example at thonky.com
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := qrErrorCorrection(data, 10); !bytes.Equal(got, want) {
+		t.Errorf("got %v expected %v", got, want)
+	}
+}
+
+func TestQRFormatBits(t *testing.T) {
+	if got := qrFormatBits(); got != 0b111011111000100 {
+		t.Errorf("got %015b expected 111011111000100", got)
+	}
+}
+
+func TestQRCodewordsRoundTrip(t *testing.T) {
+	var m qrMatrix
+	m.drawFunctionPatterns()
+	function := m.function
+	matrix := encodeQR([]byte("hi"))
+
+	// Read the modules back in placement order, undoing the mask
+	var bits []bool
+	for right := qrSize - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qrSize; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if upward {
+					y = qrSize - 1 - vert
+				}
+				if !function[y][x] {
+					bits = append(bits, matrix[y][x] != ((x+y)%2 == 0))
+				}
+			}
+		}
+	}
+	var got []byte
+	for i := 0; i+8 <= len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		got = append(got, b)
+	}
+	want := qrCodewords([]byte("hi"))
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v expected %v", got, want)
+	}
+	// Mode 0100, length 2, 'h' 'i', terminator
+	if want[0] != 0x40 || want[1] != 0x26 || want[2] != 0x86 || want[3] != 0x90 {
+		t.Errorf("unexpected data codewords %v", want[:4])
+	}
+}
+
+func TestProcessQR(t *testing.T) {
+	out, err := processQR(CommandRequest{Command: "qr", Text: "hi"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var resp struct {
+		Size   int      `json:"size"`
+		Matrix [][]bool `json:"matrix"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatalf("decode %s: %v", out, err)
+	}
+	if resp.Size != qrSize || len(resp.Matrix) != qrSize || len(resp.Matrix[0]) != qrSize {
+		t.Fatalf("got size %d with %d rows expected %d", resp.Size, len(resp.Matrix), qrSize)
+	}
+	// Top-left finder pattern: dark border, light ring, dark center
+	if !resp.Matrix[0][0] || resp.Matrix[1][1] || !resp.Matrix[3][3] || resp.Matrix[7][7] {
+		t.Errorf("finder pattern not drawn")
+	}
+
+	out, _ = processQR(CommandRequest{Command: "qr", Text: strings.Repeat("x", maxQRBytes+1)})
+	if !strings.Contains(string(out), `"error"`) {
+		t.Errorf("got %s expected an error for oversized text", out)
+	}
+}
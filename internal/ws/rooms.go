@@ -0,0 +1,141 @@
+// Filename: internal/ws/rooms.go
+
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Rooms are named broadcast scopes. Unlike groups (one per connection, used
+// for stats) a connection can be in several rooms at once.
+const (
+	maxRoomName           = 64
+	maxRoomsPerConnection = 16
+)
+
+var errTooManyRooms = fmt.Errorf("connections can be in at most %d rooms", maxRoomsPerConnection)
+
+// validRoomName reports why name can't be used as a room, or nil if it can
+func validRoomName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("room name must not be empty")
+	case len(name) > maxRoomName:
+		return fmt.Errorf("room names are limited to %d bytes", maxRoomName)
+	case strings.Contains(name, ":"):
+		return errors.New("room names must not contain ':'")
+	}
+	return nil
+}
+
+// JoinRoom adds conn to room and returns how many members the room has
+func (h *ClientHub) JoinRoom(conn *Connection, room string) (int, error) {
+	if h == nil {
+		return 0, ErrNoHub
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !conn.rooms[room] && len(conn.rooms) >= maxRoomsPerConnection {
+		return 0, errTooManyRooms
+	}
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*Connection]bool)
+	}
+	h.rooms[room][conn] = true
+	conn.rooms[room] = true
+	return len(h.rooms[room]), nil
+}
+
+// LeaveRoom removes conn from room, reporting whether it was a member
+func (h *ClientHub) LeaveRoom(conn *Connection, room string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !conn.rooms[room] {
+		return false
+	}
+	h.leaveRoomLocked(conn, room)
+	return true
+}
+
+// InRoom reports whether conn is a member of room
+func (h *ClientHub) InRoom(conn *Connection, room string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return conn.rooms[room]
+}
+
+// leaveRoomLocked removes conn from room, dropping the room once it's empty;
+// the caller holds h.mu
+func (h *ClientHub) leaveRoomLocked(conn *Connection, room string) {
+	members := h.rooms[room]
+	delete(members, conn)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+	delete(conn.rooms, room)
+}
+
+// leaveRoomsLocked removes conn from every room it's in; the caller holds h.mu
+func (h *ClientHub) leaveRoomsLocked(conn *Connection) {
+	for room := range conn.rooms {
+		h.leaveRoomLocked(conn, room)
+	}
+}
+
+// BroadcastToRoom sends a message to the other members of room and waits
+// for the per-client outcome
+func (h *ClientHub) BroadcastToRoom(payload []byte, sender *Connection, room string) BroadcastResult {
+	return h.send(BroadcastMessage{Payload: payload, Sender: sender, Percent: 100, Room: room, EchoToSender: cfg().BroadcastEchoToSender})
+}
+
+// respondRoom handles JOIN:<room>, LEAVE:<room> and ROOM:<room>:<text>
+func (c *Connection) respondRoom(message string) reply {
+	prefix, rest, _ := strings.Cut(message, ":")
+	room, text := rest, ""
+	if prefix == "ROOM" {
+		room, text, _ = strings.Cut(rest, ":")
+	}
+	if err := validRoomName(room); err != nil {
+		return reply{body: errorJSON(err.Error())}
+	}
+	c.history.Add(message)
+
+	switch prefix {
+	case "JOIN":
+		members, err := c.hub.JoinRoom(c, room)
+		if err != nil {
+			return reply{body: errorJSON(err.Error())}
+		}
+		body, _ := json.Marshal(struct {
+			Room    string `json:"room"`
+			Members int    `json:"members"`
+		}{room, members})
+		return reply{body: string(body)}
+	case "LEAVE":
+		if !c.hub.LeaveRoom(c, room) {
+			return reply{body: errorJSON("not in room " + room)}
+		}
+		body, _ := json.Marshal(struct {
+			Room string `json:"room"`
+			Left bool   `json:"left"`
+		}{room, true})
+		return reply{body: string(body)}
+	default:
+		if !c.hub.InRoom(c, room) {
+			return reply{body: errorJSON("not in room " + room)}
+		}
+		broadcastMsg := fmt.Sprintf("[ROOM %s from %s] %s", room, c.RemoteAddr, text)
+		result := c.hub.BroadcastToRoom([]byte(broadcastMsg), c, room)
+		body, _ := json.Marshal(result)
+		return reply{body: string(body)}
+	}
+}
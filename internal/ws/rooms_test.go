@@ -0,0 +1,123 @@
+// Filename: internal/ws/rooms_test.go
+
+package ws
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectBroadcast reads one message from conn and checks it ends with text
+func expectBroadcast(t *testing.T, conn *websocket.Conn, text string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil || !strings.HasSuffix(string(data), "] "+text) {
+		t.Errorf("got %q, %v expected the broadcast %q", data, err, text)
+	}
+}
+
+// expectSilence checks nothing arrives on conn for a short while
+func expectSilence(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Errorf("got unexpected message %q", data)
+	}
+}
+
+func TestRoomsIsolateBroadcasts(t *testing.T) {
+	withHub(t)
+	srv := newTestServer(t)
+	red := dialTestServer(t, srv)
+	blue := dialTestServer(t, srv)
+	both := dialTestServer(t, srv)
+	neither := dialTestServer(t, srv)
+
+	roundTrip(t, red, "JOIN:red")
+	roundTrip(t, blue, "JOIN:blue")
+	roundTrip(t, both, "JOIN:red")
+	if got := roundTrip(t, both, "JOIN:blue"); got != `{"room":"blue","members":2}` {
+		t.Errorf("got %q expected blue to have 2 members", got)
+	}
+	roundTrip(t, neither, "ready")
+
+	want := `{"delivered":1,"failed":0,"failedClients":[]}`
+	if got := roundTrip(t, red, "ROOM:red:hello red"); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+	expectBroadcast(t, both, "hello red")
+
+	if got := roundTrip(t, blue, "ROOM:blue:hello blue"); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+	expectBroadcast(t, both, "hello blue")
+
+	expectSilence(t, red)
+	expectSilence(t, blue)
+	expectSilence(t, neither)
+}
+
+func TestRoomCommandErrors(t *testing.T) {
+	withHub(t)
+	conn := dialTestServer(t, newTestServer(t))
+	tests := []struct {
+		msg, want string
+	}{
+		{"ROOM:red:hi", `{"error":"not in room red"}`},
+		{"LEAVE:red", `{"error":"not in room red"}`},
+		{"JOIN:", `{"error":"room name must not be empty"}`},
+		{"JOIN:a:b", `{"error":"room names must not contain ':'"}`},
+		{"JOIN:red", `{"room":"red","members":1}`},
+		{"LEAVE:red", `{"room":"red","left":true}`},
+		{"ROOM:red:hi", `{"error":"not in room red"}`},
+	}
+	for _, tt := range tests {
+		if got := roundTrip(t, conn, tt.msg); got != tt.want {
+			t.Errorf("%s: got %q expected %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestRoomsAreLeftOnUnregister(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+	t.Cleanup(func() { _ = h.Shutdown(t.Context()) })
+
+	c := NewConnection(nil, "a", DevProfile)
+	h.Register(c)
+	for _, room := range []string{"red", "blue"} {
+		if _, err := h.JoinRoom(c, room); err != nil {
+			t.Fatalf("join %s: %v", room, err)
+		}
+	}
+	h.Unregister(c)
+
+	for deadline := time.Now().Add(time.Second); h.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.rooms) != 0 || len(c.rooms) != 0 {
+		t.Errorf("got rooms %v and memberships %v expected none after unregister", h.rooms, c.rooms)
+	}
+}
+
+func TestJoinRoomLimit(t *testing.T) {
+	h := NewHub()
+	c := NewConnection(nil, "a", DevProfile)
+	for i := 0; i < maxRoomsPerConnection; i++ {
+		if _, err := h.JoinRoom(c, strings.Repeat("r", i+1)); err != nil {
+			t.Fatalf("join %d: %v", i, err)
+		}
+	}
+	if _, err := h.JoinRoom(c, "one-too-many"); err != errTooManyRooms {
+		t.Errorf("got %v expected %v", err, errTooManyRooms)
+	}
+	if _, err := h.JoinRoom(c, "r"); err != nil {
+		t.Errorf("rejoining a room: %v", err)
+	}
+}
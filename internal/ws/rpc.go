@@ -0,0 +1,143 @@
+// Filename: internal/ws/rpc.go
+
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000 // a command ran but reported an error
+)
+
+// numericCommands answer with a single number in CommandResponse.Result,
+// which becomes the JSON-RPC result; other commands' whole response
+// (minus "command") is the result
+var numericCommands = map[string]bool{
+	"add": true, "subtract": true, "multiply": true, "divide": true, "modulo": true,
+	"percent": true, "percent_of": true,
+	"power": true, "sqrt": true, "min": true, "max": true, "eval": true,
+	"factorial": true, "gcd": true, "lcm": true, "round": true,
+	"floor": true, "ceil": true, "trunc": true, "abs": true, "negate": true,
+	"ln": true, "log": true,
+}
+
+// rpcRequest is a JSON-RPC 2.0 request; params are the command's fields
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// isJSONRPC reports whether a JSON object message uses the JSON-RPC
+// envelope. Unparseable input counts if it mentions "jsonrpc", so it gets a
+// JSON-RPC parse error rather than a legacy one.
+func isJSONRPC(payload []byte) bool {
+	var probe struct {
+		JSONRPC *string `json:"jsonrpc"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return bytes.Contains(payload, []byte(`"jsonrpc"`))
+	}
+	return probe.JSONRPC != nil
+}
+
+// rpcReply encodes a JSON-RPC response; a nil id is sent as null
+func rpcReply(id json.RawMessage, result any, rerr *rpcError) reply {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	body, _ := json.Marshal(rpcResponse{JSONRPC: "2.0", Result: result, Error: rerr, ID: id})
+	return reply{body: string(body)}
+}
+
+// respondRPC runs a JSON-RPC request through respondCommand and translates
+// the command's response into a JSON-RPC result or error. Notifications
+// (requests without an id) get no reply.
+func (c *Connection) respondRPC(payload []byte) reply {
+	var req rpcRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return rpcReply(nil, nil, &rpcError{rpcParseError, "parse error"})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcReply(req.ID, nil, &rpcError{rpcInvalidRequest, `invalid request: need "jsonrpc":"2.0" and a method`})
+	}
+
+	// Params become the fields of a legacy command
+	fields := map[string]json.RawMessage{}
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		if err := json.Unmarshal(req.Params, &fields); err != nil {
+			return rpcReply(req.ID, nil, &rpcError{rpcInvalidParams, "params must be an object"})
+		}
+	}
+	fields["command"], _ = json.Marshal(req.Method)
+	cmdPayload, _ := json.Marshal(fields)
+	var check CommandRequest
+	if err := json.Unmarshal(cmdPayload, &check); err != nil {
+		return rpcReply(req.ID, nil, &rpcError{rpcInvalidParams, "invalid params: " + err.Error()})
+	}
+
+	rep := c.respondCommand(cmdPayload)
+	if req.ID == nil {
+		rep.silent = true
+		return rep
+	}
+	if rep.silent {
+		// Commands such as ack answer nothing; JSON-RPC still wants a reply
+		out := rpcReply(req.ID, true, nil)
+		out.command = rep.command
+		return out
+	}
+
+	var resp map[string]any
+	if err := json.Unmarshal([]byte(rep.body), &resp); err != nil {
+		return rpcReply(req.ID, nil, &rpcError{rpcServerError, "command returned an unreadable response"})
+	}
+	var out reply
+	if msg, ok := resp["error"].(string); ok {
+		code := rpcServerError
+		if strings.HasPrefix(msg, "unknown command") || msg == commandDisabled {
+			code = rpcMethodNotFound
+		}
+		out = rpcReply(req.ID, nil, &rpcError{code, msg})
+	} else {
+		out = rpcReply(req.ID, rpcResult(canonicalCommand(req.Method), resp), nil)
+	}
+	out.command = rep.command
+	out.untracked = rep.untracked
+	out.released = rep.released
+	out.resent = rep.resent
+	return out
+}
+
+// rpcResult extracts the JSON-RPC result from a command response
+func rpcResult(method string, resp map[string]any) any {
+	if numericCommands[method] {
+		if v, ok := resp["result"]; ok {
+			return v
+		}
+		return 0 // omitted from CommandResponse when zero
+	}
+	delete(resp, "command")
+	return resp
+}
@@ -0,0 +1,48 @@
+// Filename: internal/ws/rpc_test.go
+
+package ws
+
+import "testing"
+
+func TestJSONRPCRequests(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"jsonrpc":"2.0","method":"add","params":{"a":1,"b":2},"id":7}`, `{"jsonrpc":"2.0","result":3,"id":7}`},
+		{`{"jsonrpc":"2.0","method":"subtract","params":{"a":2,"b":2},"id":"x"}`, `{"jsonrpc":"2.0","result":0,"id":"x"}`},
+		{`{"jsonrpc":"2.0","method":"eval","params":{"expr":"(1+2)*3"},"id":1}`, `{"jsonrpc":"2.0","result":9,"id":1}`},
+		{`{"jsonrpc":"2.0","method":"qr","params":{"text":""},"id":2}`, `{"jsonrpc":"2.0","error":{"code":-32000,"message":"text must be 1 to 17 bytes"},"id":2}`},
+		{`{"jsonrpc":"2.0","method":"divide","params":{"a":1,"b":0},"id":3}`, `{"jsonrpc":"2.0","error":{"code":-32000,"message":"division by zero"},"id":3}`},
+		{`{"jsonrpc":"2.0","method":"abs","params":{"a":-0},"id":10}`, `{"jsonrpc":"2.0","result":0,"id":10}`},
+		{`{"jsonrpc":"2.0","method":"negate","params":{"a":0},"id":11}`, `{"jsonrpc":"2.0","result":0,"id":11}`},
+		{`{"jsonrpc":"2.0","method":"nope","id":4}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"unknown command: nope"},"id":4}`},
+		{`{"jsonrpc":"2.0","method":"add","params":[1,2],"id":5}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"params must be an object"},"id":5}`},
+		{`{"jsonrpc":"2.0","method":"add","params":{"a":"one"},"id":6}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"invalid params: json: cannot unmarshal string into Go struct field CommandRequest.a of type float64"},"id":6}`},
+		{`{"jsonrpc":"1.0","method":"add","id":8}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: need \"jsonrpc\":\"2.0\" and a method"},"id":8}`},
+		{`{"jsonrpc":"2.0","params":{},"id":9}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: need \"jsonrpc\":\"2.0\" and a method"},"id":9}`},
+		{`{"jsonrpc":"2.0","method":"add",`, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`},
+	}
+	for _, tt := range tests {
+		c := NewConnection(nil, "a", DevProfile)
+		if got := c.respond(tt.payload, []byte(tt.payload)).body; got != tt.want {
+			t.Errorf("%s\n got %s\nwant %s", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestJSONRPCNotificationGetsNoReply(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	payload := `{"jsonrpc":"2.0","method":"add","params":{"a":1,"b":2}}`
+	if rep := c.respond(payload, []byte(payload)); !rep.silent {
+		t.Errorf("got reply %q expected none for a notification", rep.body)
+	}
+}
+
+func TestLegacyCommandsStillWork(t *testing.T) {
+	c := NewConnection(nil, "a", DevProfile)
+	payload := `{"command":"add","a":1,"b":2}`
+	if got := c.respond(payload, []byte(payload)).body; got != `{"result":3,"command":"add"}` {
+		t.Errorf("got %s expected the legacy response", got)
+	}
+}
@@ -0,0 +1,91 @@
+// Filename: internal/ws/stats.go
+
+package ws
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// Most distinct command names a CommandStats tracks, so clients sending
+// made-up names can't grow it without bound
+const maxStatsCommands = 128
+
+// CommandStats counts invocations by command name
+type CommandStats struct {
+	counts map[string]*atomic.Uint64
+	mu     sync.RWMutex
+}
+
+// NewCommandStats creates empty command counters
+func NewCommandStats() *CommandStats {
+	return &CommandStats{counts: make(map[string]*atomic.Uint64)}
+}
+
+// Server-wide counts reported by the stats command
+var commandStats = NewCommandStats()
+
+// Add counts one invocation of name
+func (cs *CommandStats) Add(name string) {
+	cs.mu.RLock()
+	n, ok := cs.counts[name]
+	cs.mu.RUnlock()
+	if !ok {
+		cs.mu.Lock()
+		if n, ok = cs.counts[name]; !ok {
+			if len(cs.counts) >= maxStatsCommands {
+				cs.mu.Unlock()
+				return
+			}
+			n = new(atomic.Uint64)
+			cs.counts[name] = n
+		}
+		cs.mu.Unlock()
+	}
+	n.Add(1)
+}
+
+// Snapshot returns the current counts
+func (cs *CommandStats) Snapshot() map[string]uint64 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	out := make(map[string]uint64, len(cs.counts))
+	for name, n := range cs.counts {
+		out[name] = n.Load()
+	}
+	return out
+}
+
+// countCommand counts an invocation server-wide and, if local is set, for
+// one connection. Disabled commands aren't counted since they don't run.
+func countCommand(local *CommandStats, name string) {
+	if !commandEnabled(name) {
+		return
+	}
+	commandStats.Add(name)
+	if local != nil {
+		local.Add(name)
+	}
+}
+
+// countBatch counts a batch's commands for one connection; processCommand
+// counts them server-wide as it runs them
+func countBatch(local *CommandStats, payload []byte) {
+	var items []struct {
+		Command string `json:"command"`
+	}
+	if json.Unmarshal(payload, &items) != nil || len(items) > maxBatchSize {
+		return
+	}
+	for _, item := range items {
+		if name := canonicalCommand(item.Command); commandEnabled(name) {
+			local.Add(name)
+		}
+	}
+}
+
+// processStats responds with the invocation counts in cs, keyed by command name
+func processStats(cs *CommandStats) ([]byte, error) {
+	return json.Marshal(cs.Snapshot())
+}
@@ -0,0 +1,81 @@
+// Filename: internal/ws/stats_test.go
+
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// statsFrom runs the stats command on conn and decodes the counts
+func statsFrom(t *testing.T, conn *websocket.Conn) map[string]uint64 {
+	t.Helper()
+	got := roundTrip(t, conn, `{"command":"stats"}`)
+	var counts map[string]uint64
+	if err := json.Unmarshal([]byte(got), &counts); err != nil {
+		t.Fatalf("decode %q: %v", got, err)
+	}
+	return counts
+}
+
+func TestStatsCountsCommandsServerWide(t *testing.T) {
+	srv := newTestServer(t)
+	before := statsFrom(t, dialTestServer(t, srv))
+
+	a := dialTestServer(t, srv)
+	b := dialTestServer(t, srv)
+	roundTrip(t, a, `{"command":"add","a":1,"b":2}`)
+	roundTrip(t, a, `{"command":"add","a":3,"b":4}`)
+	roundTrip(t, b, `{"command":"divide","a":6,"b":3}`)
+	roundTrip(t, b, `[{"command":"add","a":1,"b":1},{"command":"whoami"}]`)
+	roundTrip(t, b, `{"command":"whoami"}`)
+	roundTrip(t, b, `{"command":"nope"}`)
+
+	// The first stats request counted itself before taking its snapshot
+	after := statsFrom(t, a)
+	for name, want := range map[string]uint64{"add": 3, "divide": 1, "whoami": 2, "nope": 1, "stats": 1} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s: got %d more invocations expected %d", name, got, want)
+		}
+	}
+}
+
+func TestStatsPerConnection(t *testing.T) {
+	c := DefaultConfig()
+	c.PerConnectionStats = true
+	withConfig(t, c)
+	srv := newTestServer(t)
+	a := dialTestServer(t, srv)
+	b := dialTestServer(t, srv)
+
+	roundTrip(t, a, `{"command":"add","a":1,"b":2}`)
+	roundTrip(t, a, `[{"command":"add","a":1,"b":1},{"command":"divide","a":4,"b":2}]`)
+	roundTrip(t, b, `{"command":"multiply","a":2,"b":3}`)
+
+	want := `{"add":2,"divide":1,"stats":1}`
+	if got := roundTrip(t, a, `{"command":"stats"}`); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+	want = `{"multiply":1,"stats":1}`
+	if got := roundTrip(t, b, `{"command":"stats"}`); got != want {
+		t.Errorf("got %q expected %q", got, want)
+	}
+}
+
+func TestCommandStatsBoundsNames(t *testing.T) {
+	cs := NewCommandStats()
+	for i := 0; i < maxStatsCommands+10; i++ {
+		cs.Add(fmt.Sprintf("cmd%d", i))
+	}
+	cs.Add("cmd0")
+	counts := cs.Snapshot()
+	if len(counts) != maxStatsCommands {
+		t.Errorf("got %d names expected %d", len(counts), maxStatsCommands)
+	}
+	if counts["cmd0"] != 2 {
+		t.Errorf("got %d for cmd0 expected 2", counts["cmd0"])
+	}
+}
@@ -0,0 +1,60 @@
+// Filename: internal/ws/strict.go
+
+package ws
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol a client can request to get strict echo on a single connection
+const strictSubprotocol = "echo.strict"
+
+// strictEcho runs conn as a plain RFC 6455 echo server: every message is
+// sent back unchanged with its original type, with no counter, transforms,
+// commands or rate limits. MaxMessageBytes still limits messages, and a
+// client that sends nothing, not even a pong, for PongWait is disconnected.
+// Fragmented messages are reassembled before being
+// echoed, text that is not valid UTF-8 closes with 1007, and close frames
+// are answered with the client's close code and reason. Gorilla itself
+// answers invalid close codes and bad framing with 1002.
+func strictEcho(conn *websocket.Conn, remoteAddr string) {
+	logger().Info("strict echo mode", "event", "strict", "remote_addr", remoteAddr)
+	conn.SetReadLimit(int64(cfg().MaxMessageBytes))
+	_ = conn.SetReadDeadline(time.Now().Add(cfg().PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(cfg().PongWait))
+	})
+	conn.SetCloseHandler(func(code int, text string) error {
+		// A close without a status code gets an empty payload back
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(cfg().WriteWait))
+		return nil
+	})
+
+	for {
+		msgType, payload, err := conn.ReadMessage()
+		if err != nil {
+			logger().Info("strict echo read ended", "event", "read_error", "remote_addr", remoteAddr, "error", err)
+			return
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(cfg().PongWait))
+
+		if msgType == websocket.TextMessage && !utf8.Valid(payload) {
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "invalid UTF-8 in text frame"),
+				time.Now().Add(cfg().WriteWait),
+			)
+			return
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(cfg().WriteWait))
+		if err := conn.WriteMessage(msgType, payload); err != nil {
+			logger().Warn("strict echo write failed", "event", "write_error", "remote_addr", remoteAddr, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Filename: internal/ws/strict_test.go
+
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// allowStrict offers the strict echo subprotocol for the rest of the test
+func allowStrict(t *testing.T) {
+	t.Helper()
+	c := CurrentConfig()
+	c.StrictSubprotocol = true
+	withConfig(t, c)
+}
+
+// dialStrict opens a connection that negotiates the strict echo subprotocol
+func dialStrict(t *testing.T) *websocket.Conn {
+	t.Helper()
+	allowStrict(t)
+	srv := newTestServer(t)
+	header := http.Header{}
+	header.Set("Origin", "http://localhost:4000")
+	dialer := websocket.Dialer{Subprotocols: []string{strictSubprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if conn.Subprotocol() != strictSubprotocol {
+		t.Fatalf("got subprotocol %q expected %q", conn.Subprotocol(), strictSubprotocol)
+	}
+	return conn
+}
+
+func TestStrictEchoIsVerbatim(t *testing.T) {
+	conn := dialStrict(t)
+	messages := []struct {
+		msgType int
+		data    string
+	}{
+		{websocket.TextMessage, "UPPER:hello"},
+		{websocket.TextMessage, `{"command":"add","a":1,"b":2}`},
+		{websocket.BinaryMessage, "\x00\x01\xff"},
+	}
+	for _, m := range messages {
+		if err := conn.WriteMessage(m.msgType, []byte(m.data)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if msgType != m.msgType || string(data) != m.data {
+			t.Errorf("got (%d, %q) expected (%d, %q)", msgType, data, m.msgType, m.data)
+		}
+	}
+}
+
+func TestStrictEchoRejectsInvalidUTF8(t *testing.T) {
+	conn := dialStrict(t)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte{0xff, 0xfe}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData) {
+		t.Errorf("got %v expected close %d", err, websocket.CloseInvalidFramePayloadData)
+	}
+}
+
+func TestConformanceModeEchoesCommandsLiterally(t *testing.T) {
+	c := DefaultConfig()
+	c.ConformanceMode = true
+	withConfig(t, c)
+	// No echo.strict subprotocol: the server-wide flag alone disables parsing
+	conn := dialTestServer(t, newTestServer(t))
+	for _, msg := range []string{
+		"REVERSE:hello",
+		"BROADCAST:hi",
+		"DELAY:500:late",
+		`{"command":"whoami"}`,
+		`[{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1}]`,
+		"WHOAMI",
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != msg {
+			t.Errorf("got %q, %v expected %q verbatim", data, err, msg)
+		}
+	}
+}
+
+// rawStrictClient is a raw client that negotiates the strict echo subprotocol
+func rawStrictClient(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	allowStrict(t)
+	return rawClient(t, newTestServer(t), "Sec-WebSocket-Protocol: "+strictSubprotocol+"\r\n")
+}
+
+func TestStrictSubprotocolIsOffByDefault(t *testing.T) {
+	conn, resp := dialSubprotocols(t, strictSubprotocol, echoSubprotocol)
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != echoSubprotocol {
+		t.Errorf("got Sec-WebSocket-Protocol %q expected %q", got, echoSubprotocol)
+	}
+	// The connection gets the usual handling
+	if got := roundTrip(t, conn, "UPPER:hello"); got != "HELLO" {
+		t.Errorf("got %q expected %q", got, "HELLO")
+	}
+}
+
+func TestStrictEchoKeepsMessageLimit(t *testing.T) {
+	c := DefaultConfig()
+	c.MaxMessageBytes = 16
+	withConfig(t, c)
+	conn := dialStrict(t)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("got %v expected close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestStrictEchoClosesIdleConnection(t *testing.T) {
+	c := DefaultConfig()
+	c.PingPeriod = 50 * time.Millisecond
+	c.PongWait = 100 * time.Millisecond
+	withConfig(t, c)
+	conn := dialStrict(t)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Errorf("got %v expected the server to hang up", err)
+	}
+}
+
+func TestStrictEchoReassemblesFragments(t *testing.T) {
+	nc, br := rawStrictClient(t)
+	for _, f := range [][]byte{
+		rawFrame(websocket.TextMessage, false, []byte("Hel")),
+		rawFrame(0, false, []byte("lo, ")),
+		rawFrame(websocket.PingMessage, true, []byte("mid")), // control frames may interleave
+		rawFrame(0, true, []byte("world")),
+	} {
+		if _, err := nc.Write(f); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if head, payload := readRawFrame(t, nc, br); head != 0x80|websocket.PongMessage || string(payload) != "mid" {
+		t.Errorf("got frame %#x %q expected the pong", head, payload)
+	}
+	if head, payload := readRawFrame(t, nc, br); head != 0x80|websocket.TextMessage || string(payload) != "Hello, world" {
+		t.Errorf("got frame %#x %q expected one final text frame %q", head, payload, "Hello, world")
+	}
+}
+
+func TestStrictEchoRejectsInvalidUTF8AcrossFragments(t *testing.T) {
+	nc, br := rawStrictClient(t)
+	// The first fragment ends mid-character, which is valid once reassembled;
+	// the 0xff in the second never is
+	for _, f := range [][]byte{
+		rawFrame(websocket.TextMessage, false, []byte{'a', 0xc3}),
+		rawFrame(0, true, []byte{0xa9, 0xff}),
+	} {
+		if _, err := nc.Write(f); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	head, payload := readRawFrame(t, nc, br)
+	if head != 0x80|websocket.CloseMessage || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != websocket.CloseInvalidFramePayloadData {
+		t.Errorf("got frame %#x %q expected close %d", head, payload, websocket.CloseInvalidFramePayloadData)
+	}
+}
+
+func TestStrictEchoAnswersCloseWithSameCodeAndReason(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		sent, want []byte
+	}{
+		{"normal", websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"), websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done")},
+		{"application", websocket.FormatCloseMessage(4000, "app"), websocket.FormatCloseMessage(4000, "app")},
+		{"no status", []byte{}, []byte{}},
+		{"invalid code", []byte{0x03, 0xe7}, websocket.FormatCloseMessage(websocket.CloseProtocolError, "bad close code 999")},
+	} {
+		nc, br := rawStrictClient(t)
+		if _, err := nc.Write(rawFrame(websocket.CloseMessage, true, tt.sent)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if head, payload := readRawFrame(t, nc, br); head != 0x80|websocket.CloseMessage || string(payload) != string(tt.want) {
+			t.Errorf("%s: got frame %#x %q expected close %q", tt.name, head, payload, tt.want)
+		}
+	}
+}
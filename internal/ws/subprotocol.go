@@ -0,0 +1,40 @@
+// Filename: internal/ws/subprotocol.go
+
+package ws
+
+import "strings"
+
+// Subprotocols the server always accepts
+const (
+	echoSubprotocol = "echo.v1" // the default behaviour, by name
+	jsonSubprotocol = "json.v1" // only JSON commands, JSON-RPC and batches
+)
+
+// Reply to text that isn't JSON on a json.v1 connection
+const notJSONError = `{"error":"json.v1 accepts only JSON messages"}`
+
+// subprotocols returns the subprotocols offered in the handshake, in the
+// server's order of preference: echo.strict when allowed, the built-in
+// ones, then c.Subprotocols
+func subprotocols(c *Config) []string {
+	var offered []string
+	if strictAllowed(c) {
+		offered = append(offered, strictSubprotocol)
+	}
+	return append(append(offered, jsonSubprotocol, echoSubprotocol), c.Subprotocols...)
+}
+
+// strictAllowed reports whether clients may request echo.strict
+func strictAllowed(c *Config) bool {
+	return c.ConformanceMode || c.StrictSubprotocol
+}
+
+// validSubprotocol reports whether name can be sent in Sec-WebSocket-Protocol
+func validSubprotocol(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t,;\"")
+}
+
+// isJSONText reports whether a json.v1 connection accepts message
+func isJSONText(message string) bool {
+	return strings.HasPrefix(message, "{") || strings.HasPrefix(message, "[")
+}
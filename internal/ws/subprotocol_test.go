@@ -0,0 +1,84 @@
+// Filename: internal/ws/subprotocol_test.go
+
+package ws
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSubprotocols opens a connection offering protocols, returning the
+// handshake response too
+func dialSubprotocols(t *testing.T, protocols ...string) (*websocket.Conn, *http.Response) {
+	t.Helper()
+	srv := newTestServer(t)
+	header := http.Header{}
+	header.Set("Origin", "http://localhost:4000")
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	c := DefaultConfig()
+	c.Subprotocols = []string{"chat.v2"}
+	withConfig(t, c)
+
+	for _, tt := range []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"json.v1"}, "json.v1"},
+		{[]string{"echo.v1"}, "echo.v1"},
+		{[]string{"chat.v2"}, "chat.v2"},
+		{[]string{"unknown", "echo.v1"}, "echo.v1"},
+		{[]string{"echo.v1", "json.v1"}, "json.v1"}, // the server's preference wins
+		{[]string{"unknown"}, ""},
+		{nil, ""},
+	} {
+		conn, resp := dialSubprotocols(t, tt.offered...)
+		if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.want {
+			t.Errorf("offered %v: got Sec-WebSocket-Protocol %q expected %q", tt.offered, got, tt.want)
+		}
+		if conn.Subprotocol() != tt.want {
+			t.Errorf("offered %v: got subprotocol %q expected %q", tt.offered, conn.Subprotocol(), tt.want)
+		}
+	}
+}
+
+func TestJSONSubprotocolRejectsPlainText(t *testing.T) {
+	conn, _ := dialSubprotocols(t, jsonSubprotocol)
+	for _, tt := range []struct{ msg, want string }{
+		{"hello", notJSONError},
+		{"UPPER:hello", notJSONError},
+		{`{"command":"add","a":1,"b":2}`, `{"result":3,"command":"add"}`},
+		{`[{"command":"add","a":1,"b":2}]`, `[{"result":3,"command":"add"}]`},
+	} {
+		if got := roundTrip(t, conn, tt.msg); got != tt.want {
+			t.Errorf("%s: got %q expected %q", tt.msg, got, tt.want)
+		}
+	}
+
+	// Other subprotocols keep the usual handling
+	conn, _ = dialSubprotocols(t, echoSubprotocol)
+	if got := roundTrip(t, conn, "UPPER:hello"); got != "HELLO" {
+		t.Errorf("got %q expected %q", got, "HELLO")
+	}
+}
+
+func TestConfigureRejectsInvalidSubprotocol(t *testing.T) {
+	for _, p := range []string{"", "two words", "a,b"} {
+		c := DefaultConfig()
+		c.Subprotocols = []string{p}
+		if err := Configure(c); err == nil {
+			t.Errorf("%q: expected an error", p)
+		}
+	}
+}
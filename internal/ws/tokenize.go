@@ -0,0 +1,63 @@
+// Filename: internal/ws/tokenize.go
+
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Most tokens the tokenize command returns, keeping responses under the write limit
+const maxTokens = 500
+
+// Token is one classified piece of text; Pos is its byte offset
+type Token struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+	Pos  int    `json:"pos"`
+}
+
+// tokenRules classify tokens in order; the first rule matching at the
+// current position wins. Anything unmatched is a single punctuation rune.
+var tokenRules = []struct {
+	typ string
+	re  *regexp.Regexp
+}{
+	{"whitespace", regexp.MustCompile(`^\s+`)},
+	{"number", regexp.MustCompile(`^[0-9]+(?:[.,][0-9]+)*`)},
+	{"word", regexp.MustCompile(`^[\pL\pM][\pL\pM\pN]*(?:['’-][\pL\pM\pN]+)*`)},
+	{"punctuation", regexp.MustCompile(`^(?s).`)},
+}
+
+// tokenize splits text into classified tokens
+func tokenize(text string) []Token {
+	tokens := []Token{}
+	for pos := 0; pos < len(text); {
+		for _, rule := range tokenRules {
+			if m := rule.re.FindString(text[pos:]); m != "" {
+				tokens = append(tokens, Token{Text: m, Type: rule.typ, Pos: pos})
+				pos += len(m)
+				break
+			}
+		}
+	}
+	return tokens
+}
+
+// processTokenize responds with the tokens of req.Text
+func processTokenize(req CommandRequest) ([]byte, error) {
+	resp := struct {
+		Command string  `json:"command"`
+		Tokens  []Token `json:"tokens"`
+		Error   string  `json:"error,omitempty"`
+	}{
+		Command: req.Command,
+		Tokens:  tokenize(req.Text),
+	}
+	if len(resp.Tokens) > maxTokens {
+		resp.Tokens = []Token{}
+		resp.Error = fmt.Sprintf("text has more than %d tokens", maxTokens)
+	}
+	return json.Marshal(resp)
+}
@@ -0,0 +1,38 @@
+// Filename: internal/ws/tokenize_test.go
+
+package ws
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got, _ := json.Marshal(tokenize("Don't pay 3.50, ok?"))
+	want := `[{"text":"Don't","type":"word","pos":0},{"text":" ","type":"whitespace","pos":5},` +
+		`{"text":"pay","type":"word","pos":6},{"text":" ","type":"whitespace","pos":9},` +
+		`{"text":"3.50","type":"number","pos":10},{"text":",","type":"punctuation","pos":14},` +
+		`{"text":" ","type":"whitespace","pos":15},{"text":"ok","type":"word","pos":16},` +
+		`{"text":"?","type":"punctuation","pos":18}]`
+	if string(got) != want {
+		t.Errorf("got %s expected %s", got, want)
+	}
+}
+
+func TestTokenizeUnicodeAndInvalidBytes(t *testing.T) {
+	tokens := tokenize("café\xff")
+	if len(tokens) != 2 || tokens[0].Text != "café" || tokens[1].Type != "punctuation" || tokens[1].Pos != 5 {
+		t.Errorf("got %+v", tokens)
+	}
+}
+
+func TestProcessTokenizeLimit(t *testing.T) {
+	out, err := processTokenize(CommandRequest{Command: "tokenize", Text: strings.Repeat("a ", maxTokens)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !strings.Contains(string(out), `"error":"text has more than 500 tokens"`) {
+		t.Errorf("got %s expected a token limit error", out)
+	}
+}
@@ -0,0 +1,245 @@
+// Filename: internal/ws/transform.go
+
+package ws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// textTransforms maps message prefixes to the transform applied to the rest
+// of the message. They need no per-connection state, so every transport
+// (WebSocket and the HTTP fallbacks) shares them.
+var textTransforms = []struct {
+	prefix string
+	apply  func(text string) string
+}{
+	{"UPPER:", strings.ToUpper},
+	{"LOWER:", strings.ToLower},
+	{"REVERSE:", reverseText},
+	{"ROT13:", rot13},
+	{"REPEAT:", func(text string) string {
+		repeated, err := repeatText(text, cfg().MaxWriteBytes)
+		if err != nil {
+			return errorJSON(err.Error())
+		}
+		return repeated
+	}},
+	{"LENGTH:", lengthJSON},
+	{"FREQ:", func(text string) string { return frequencyJSON(text, false) }},
+	{"FREQSORT:", func(text string) string { return frequencyJSON(text, true) }},
+	{"BASE64ENC:", func(text string) string { return base64.StdEncoding.EncodeToString([]byte(text)) }},
+	{"BASE64DEC:", func(text string) string {
+		decoded, err := decodeBase64Text(text)
+		if err != nil {
+			return errorJSON(err.Error())
+		}
+		return decoded
+	}},
+	{"GZIP:", func(text string) string {
+		encoded, err := gzipBase64(text)
+		if err != nil {
+			return errorJSON(err.Error())
+		}
+		return encoded
+	}},
+	{"GUNZIP:", func(text string) string {
+		decoded, err := gunzipBase64(text, cfg().MaxWriteBytes)
+		if err != nil {
+			return errorJSON(err.Error())
+		}
+		return decoded
+	}},
+}
+
+// applyTransform runs the text transform whose prefix message starts with,
+// reporting false if none matches
+func applyTransform(message string) (string, bool) {
+	for _, t := range textTransforms {
+		if text, ok := strings.CutPrefix(message, t.prefix); ok {
+			return t.apply(text), true
+		}
+	}
+	return "", false
+}
+
+// statelessResponse computes the reply to message using only the transforms
+// and JSON commands that need no per-connection state; anything else is
+// echoed back as-is
+func statelessResponse(message string) string {
+	if body, ok := applyTransform(message); ok {
+		return body
+	}
+	if strings.HasPrefix(message, "{") {
+		atomic.AddUint64(&commandCounter, 1)
+		resp, err := processCommand([]byte(message))
+		if err != nil {
+			return errorJSON(err.Error())
+		}
+		return string(resp)
+	}
+	if strings.HasPrefix(message, "[") {
+		resp, err := processBatch([]byte(message))
+		if err != nil {
+			return errorJSON(err.Error())
+		}
+		return string(resp)
+	}
+	return message
+}
+
+// repeatText parses "n:text" and returns text repeated n times, refusing
+// results longer than limit bytes
+func repeatText(spec string, limit int) (string, error) {
+	countStr, text, ok := strings.Cut(spec, ":")
+	if !ok {
+		return "", errors.New("usage: REPEAT:<count>:<text>")
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return "", errors.New("repeat count must be a non-negative integer")
+	}
+	if len(text) > 0 && count > limit/len(text) {
+		return "", fmt.Errorf("repeated text would exceed %d bytes", limit)
+	}
+	return strings.Repeat(text, count), nil
+}
+
+// reverseText reverses text by rune so multi-byte characters stay intact
+func reverseText(text string) string {
+	runes := []rune(text)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// rot13 rotates ASCII letters by 13 places; everything else, including
+// multi-byte runes, is left as is
+func rot13(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return 'a' + (r-'a'+13)%26
+		case r >= 'A' && r <= 'Z':
+			return 'A' + (r-'A'+13)%26
+		}
+		return r
+	}, text)
+}
+
+// lengthJSON reports the length of text in bytes and in runes
+func lengthJSON(text string) string {
+	return fmt.Sprintf(`{"bytes":%d,"runes":%d}`, len(text), utf8.RuneCountInString(text))
+}
+
+// CharCount is one entry of a frequency-sorted character histogram
+type CharCount struct {
+	Char  string `json:"char"`
+	Count int    `json:"count"`
+}
+
+// charFrequencies counts how many times each rune appears in text
+func charFrequencies(text string) map[string]int {
+	counts := make(map[string]int)
+	for _, r := range text {
+		counts[string(r)]++
+	}
+	return counts
+}
+
+// sortedFrequencies orders a histogram by descending count, breaking ties by character
+func sortedFrequencies(counts map[string]int) []CharCount {
+	sorted := make([]CharCount, 0, len(counts))
+	for c, n := range counts {
+		sorted = append(sorted, CharCount{Char: c, Count: n})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Char < sorted[j].Char
+	})
+	return sorted
+}
+
+// frequencyJSON returns the character histogram of text as JSON, either as
+// a char → count map or, when sorted is set, as a list ordered by count
+func frequencyJSON(text string, sorted bool) string {
+	counts := charFrequencies(text)
+	var v interface{} = counts
+	if sorted {
+		v = sortedFrequencies(counts)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return `{"error":"failed to marshal frequencies"}`
+	}
+	return string(data)
+}
+
+// decodeBase64Text decodes standard base64, refusing results that aren't
+// UTF-8 since they're sent back in a text frame
+func decodeBase64Text(encoded string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("invalid base64")
+	}
+	if !utf8.Valid(decoded) {
+		return "", errors.New("decoded data is not valid UTF-8")
+	}
+	return string(decoded), nil
+}
+
+// gzipBase64 compresses text with gzip and returns it base64-encoded
+func gzipBase64(text string) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(text)); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// gunzipBase64 reverses gzipBase64. Output larger than limit bytes is
+// rejected so a small compressed input can't expand without bound.
+func gunzipBase64(encoded string, limit int) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("invalid base64")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", errors.New("not gzip data")
+	}
+	defer zr.Close()
+
+	// Read one byte past the limit to detect oversized output
+	out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return "", fmt.Errorf("corrupt gzip data: %v", err)
+	}
+	if len(out) > limit {
+		return "", fmt.Errorf("decompressed data exceeds %d bytes", limit)
+	}
+	return string(out), nil
+}
+
+// errorJSON formats msg as a {"error":...} response body
+func errorJSON(msg string) string {
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	return string(data)
+}
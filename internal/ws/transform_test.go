@@ -0,0 +1,173 @@
+// Filename: internal/ws/transform_test.go
+
+package ws
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestFrequencyJSON(t *testing.T) {
+	tests := []struct {
+		text   string
+		sorted bool
+		want   string
+	}{
+		{"hello", false, `{"e":1,"h":1,"l":2,"o":1}`},
+		{"hello", true, `[{"char":"l","count":2},{"char":"e","count":1},{"char":"h","count":1},{"char":"o","count":1}]`},
+		{"ñaña", false, `{"a":2,"ñ":2}`},
+		{"", false, `{}`},
+	}
+	for _, tt := range tests {
+		if got := frequencyJSON(tt.text, tt.sorted); got != tt.want {
+			t.Errorf("frequencyJSON(%q, %v) got %s expected %s", tt.text, tt.sorted, got, tt.want)
+		}
+	}
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	text := strings.Repeat("hello, wörld ", 50)
+	encoded, err := gzipBase64(text)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	decoded, err := gunzipBase64(encoded, 1<<20)
+	if err != nil {
+		t.Fatalf("gunzip: %v", err)
+	}
+	if decoded != text {
+		t.Errorf("round trip got %q expected %q", decoded, text)
+	}
+}
+
+func TestGunzipRejectsBadInput(t *testing.T) {
+	bomb, _ := gzipBase64(strings.Repeat("a", 10000))
+	tests := map[string]string{
+		"not base64!": "invalid base64",
+		base64.StdEncoding.EncodeToString([]byte("hi")): "not gzip",
+		bomb: "exceeds",
+	}
+	for input, want := range tests {
+		_, err := gunzipBase64(input, 1000)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("gunzipBase64(%.20q) got error %v expected it to mention %q", input, err, want)
+		}
+	}
+}
+
+func TestRepeatText(t *testing.T) {
+	tests := []struct {
+		spec, want, err string
+	}{
+		{"3:hello", "hellohellohello", ""},
+		{"0:hello", "", ""},
+		{"2:a:b", "a:ba:b", ""},
+		{"x:hello", "", "repeat count must be a non-negative integer"},
+		{"-1:hello", "", "repeat count must be a non-negative integer"},
+		{"3", "", "usage: REPEAT:<count>:<text>"},
+		{"11:abcdefghij", "", "repeated text would exceed 100 bytes"},
+		{"10:abcdefghij", strings.Repeat("abcdefghij", 10), ""},
+	}
+	for _, tt := range tests {
+		got, err := repeatText(tt.spec, 100)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("repeatText(%q) got error %v expected %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("repeatText(%q) got %q, %v expected %q", tt.spec, got, err, tt.want)
+		}
+	}
+
+	if got, _ := applyTransform("REPEAT:99999999:x"); !strings.HasPrefix(got, `{"error":`) {
+		t.Errorf("got %.40q expected the size cap error", got)
+	}
+}
+
+func TestLowerTransform(t *testing.T) {
+	tests := []struct {
+		message, want string
+	}{
+		{"LOWER:Hello WORLD", "hello world"},
+		{"LOWER:ÀÉÎ", "àéî"},
+		// strings.ToLower uses simple, language-neutral case mappings: Turkish
+		// dotted capital I becomes plain "i" and dotless I becomes "i", not "ı"
+		{"LOWER:İSTANBUL", "istanbul"},
+		{"LOWER:DIŞ", "diş"},
+		{"LOWER:", ""},
+	}
+	for _, tt := range tests {
+		got, ok := applyTransform(tt.message)
+		if !ok || got != tt.want {
+			t.Errorf("applyTransform(%q) got %q expected %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestRot13Transform(t *testing.T) {
+	tests := []struct {
+		message, want string
+	}{
+		{"ROT13:Hello, World!", "Uryyb, Jbeyq!"},
+		{"ROT13:abcxyz ABCXYZ", "nopklm NOPKLM"},
+		{"ROT13:123 +-*/", "123 +-*/"},
+		{"ROT13:naïve café 日本", "anïir pnsé 日本"},
+		{"ROT13:", ""},
+	}
+	for _, tt := range tests {
+		got, ok := applyTransform(tt.message)
+		if !ok || got != tt.want {
+			t.Errorf("applyTransform(%q) got %q expected %q", tt.message, got, tt.want)
+		}
+		text := strings.TrimPrefix(tt.message, "ROT13:")
+		if twice := rot13(rot13(text)); twice != text {
+			t.Errorf("rot13 twice got %q expected %q", twice, text)
+		}
+	}
+}
+
+func TestBase64RoundTrip(t *testing.T) {
+	for _, text := range []string{"hello, world", "wörld 日本", ""} {
+		encoded, ok := applyTransform("BASE64ENC:" + text)
+		if !ok || encoded != base64.StdEncoding.EncodeToString([]byte(text)) {
+			t.Errorf("encode %q got %q", text, encoded)
+		}
+		if decoded, _ := applyTransform("BASE64DEC:" + encoded); decoded != text {
+			t.Errorf("round trip got %q expected %q", decoded, text)
+		}
+	}
+}
+
+func TestBase64DecodeRejectsBadInput(t *testing.T) {
+	tests := map[string]string{
+		"BASE64DEC:not base64!": `{"error":"invalid base64"}`,
+		"BASE64DEC:aGVsbG8":     `{"error":"invalid base64"}`, // missing padding
+		"BASE64DEC:/w==":        `{"error":"decoded data is not valid UTF-8"}`,
+	}
+	for message, want := range tests {
+		if got, _ := applyTransform(message); got != want {
+			t.Errorf("applyTransform(%q) got %s expected %s", message, got, want)
+		}
+	}
+}
+
+func TestLengthTransform(t *testing.T) {
+	tests := []struct {
+		message, want string
+	}{
+		{"LENGTH:hello", `{"bytes":5,"runes":5}`},
+		{"LENGTH:", `{"bytes":0,"runes":0}`},
+		{"LENGTH:héllo", `{"bytes":6,"runes":5}`},
+		{"LENGTH:日本語", `{"bytes":9,"runes":3}`},
+		{"LENGTH:👋🏽", `{"bytes":8,"runes":2}`},
+	}
+	for _, tt := range tests {
+		got, ok := applyTransform(tt.message)
+		if !ok || got != tt.want {
+			t.Errorf("applyTransform(%q) got %s expected %s", tt.message, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Filename: internal/ws/variants.go
+
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ResponseVariant is one response format in an A/B rotation. Template may use
+// the placeholders {id}, {body} and {variant}.
+type ResponseVariant struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Weight   int    `json:"weight"`
+}
+
+// Response template used until Config.ResponseTemplate is changed
+const defaultTemplate = "#{id} {body}"
+
+// responseTemplate returns the format used when no variants are configured
+func responseTemplate() string {
+	if t := cfg().ResponseTemplate; t != "" {
+		return t
+	}
+	return "{body}"
+}
+
+// Configured variants; variantsGen changes whenever they are replaced so
+// connections know to restart their rotation
+var (
+	responseVariants []ResponseVariant
+	variantsGen      uint64
+	variantsMu       sync.RWMutex
+)
+
+// SetResponseVariants replaces the rotation; an empty list restores the configured format
+func SetResponseVariants(vs []ResponseVariant) error {
+	seen := make(map[string]bool)
+	for _, v := range vs {
+		if v.Name == "" {
+			return errors.New("variant name must not be empty")
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("duplicate variant name %q", v.Name)
+		}
+		seen[v.Name] = true
+		if v.Weight < 1 {
+			return fmt.Errorf("variant %q must have a positive weight", v.Name)
+		}
+		if !strings.Contains(v.Template, "{body}") {
+			return fmt.Errorf("variant %q template must contain {body}", v.Name)
+		}
+	}
+
+	variantsMu.Lock()
+	defer variantsMu.Unlock()
+	responseVariants = append([]ResponseVariant(nil), vs...)
+	variantsGen++
+	return nil
+}
+
+// ResponseVariants returns the configured rotation
+func ResponseVariants() []ResponseVariant {
+	variantsMu.RLock()
+	defer variantsMu.RUnlock()
+	return append([]ResponseVariant{}, responseVariants...)
+}
+
+// VariantRotator picks the variant for each response on one connection using
+// smooth weighted round-robin, so a 3:1 weighting yields A A B A rather than
+// A A A B
+type VariantRotator struct {
+	gen      uint64
+	variants []ResponseVariant
+	current  []int
+	mu       sync.Mutex
+}
+
+// NewVariantRotator creates a rotator over the configured variants
+func NewVariantRotator() *VariantRotator {
+	return &VariantRotator{}
+}
+
+// Next returns the variant for the next response, or false when no variants are configured
+func (vr *VariantRotator) Next() (ResponseVariant, bool) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	// Pick up configuration changes made through the admin endpoint
+	variantsMu.RLock()
+	if vr.gen != variantsGen || vr.variants == nil {
+		vr.gen = variantsGen
+		vr.variants = append([]ResponseVariant{}, responseVariants...)
+		vr.current = make([]int, len(vr.variants))
+	}
+	variantsMu.RUnlock()
+
+	if len(vr.variants) == 0 {
+		return ResponseVariant{}, false
+	}
+
+	total, best := 0, 0
+	for i, v := range vr.variants {
+		vr.current[i] += v.Weight
+		total += v.Weight
+		if vr.current[i] > vr.current[best] {
+			best = i
+		}
+	}
+	vr.current[best] -= total
+	return vr.variants[best], true
+}
+
+// Largest buffer formatResponse returns to its pool; bigger ones, from
+// unusually large bodies, are left for the garbage collector
+const maxPooledFormatBuffer = 64 * 1024
+
+// Buffers formatResponse builds responses in, reused across messages
+var formatBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// formatResponse fills in a response template. Placeholders in the values
+// themselves are left alone. The response is built in a pooled buffer and
+// copied out once, so the frame handed to the writer never shares memory
+// with a buffer that is reused.
+func formatResponse(template string, id uint64, body, variant string) []byte {
+	bp := formatBuffers.Get().(*[]byte)
+	buf := appendResponse((*bp)[:0], template, id, body, variant)
+	out := bytes.Clone(buf)
+	if cap(buf) <= maxPooledFormatBuffer {
+		*bp = buf
+		formatBuffers.Put(bp)
+	}
+	return out
+}
+
+// appendResponse appends template to dst with its placeholders filled in
+func appendResponse(dst []byte, template string, id uint64, body, variant string) []byte {
+	for {
+		i := strings.IndexByte(template, '{')
+		if i < 0 {
+			break
+		}
+		dst = append(dst, template[:i]...)
+		template = template[i:]
+		switch {
+		case strings.HasPrefix(template, "{id}"):
+			dst = strconv.AppendUint(dst, id, 10)
+			template = template[len("{id}"):]
+		case strings.HasPrefix(template, "{body}"):
+			dst = append(dst, body...)
+			template = template[len("{body}"):]
+		case strings.HasPrefix(template, "{variant}"):
+			dst = append(dst, variant...)
+			template = template[len("{variant}"):]
+		default:
+			dst = append(dst, '{')
+			template = template[1:]
+		}
+	}
+	return append(dst, template...)
+}
+
+// HandleAdminVariants reads (GET) or replaces (PUT/POST) the response variant
+// rotation as a JSON array of {"name","template","weight"} objects. It
+// takes the same token as the WebSocket endpoint.
+func HandleAdminVariants(w http.ResponseWriter, r *http.Request) {
+	if !requireToken(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var vs []ResponseVariant
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&vs); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := SetResponseVariants(vs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ResponseVariants())
+}
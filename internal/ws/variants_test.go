@@ -0,0 +1,235 @@
+// Filename: internal/ws/variants_test.go
+
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestVariantRotatorWeightedOrder(t *testing.T) {
+	err := SetResponseVariants([]ResponseVariant{
+		{Name: "a", Template: "#{id} {body}", Weight: 3},
+		{Name: "b", Template: "[{variant}:{id}] {body}", Weight: 1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { _ = SetResponseVariants(nil) })
+
+	vr := NewVariantRotator()
+	var got []string
+	for i := 0; i < 8; i++ {
+		v, ok := vr.Next()
+		if !ok {
+			t.Fatal("expected a variant")
+		}
+		got = append(got, v.Name)
+	}
+	if want := "a a b a a a b a"; strings.Join(got, " ") != want {
+		t.Errorf("got order %q expected %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestVariantRotatorWithoutVariants(t *testing.T) {
+	if _, ok := NewVariantRotator().Next(); ok {
+		t.Error("expected no variant when none are configured")
+	}
+}
+
+func TestFormatResponse(t *testing.T) {
+	if got := string(formatResponse(defaultTemplate, 7, "hi", "")); got != "#7 hi" {
+		t.Errorf("got %q expected %q", got, "#7 hi")
+	}
+	if got := string(formatResponse("[{variant}:{id}] {body}", 7, "hi", "b")); got != "[b:7] hi" {
+		t.Errorf("got %q expected %q", got, "[b:7] hi")
+	}
+}
+
+func TestFormatResponseMatchesReplacer(t *testing.T) {
+	for _, tt := range []struct{ template, body string }{
+		{"", "hi"},
+		{"{body}", ""},
+		{"{id}{body}{id}", "x"},
+		{"{ {id} {nope} {body} }", "hi"},
+		{"{body", "hi"},
+		{"#{id} {body}", "{id} and {body} are not expanded twice"},
+	} {
+		want := strings.NewReplacer("{id}", "42", "{body}", tt.body, "{variant}", "v").Replace(tt.template)
+		if got := string(formatResponse(tt.template, 42, tt.body, "v")); got != want {
+			t.Errorf("template %q: got %q expected %q", tt.template, got, want)
+		}
+	}
+}
+
+func TestFormatResponseCopiesOutOfPool(t *testing.T) {
+	first := formatResponse(defaultTemplate, 1, strings.Repeat("a", 100), "")
+	for i := range 10 {
+		_ = formatResponse(defaultTemplate, uint64(i), strings.Repeat("b", 200), "")
+	}
+	if want := "#1 " + strings.Repeat("a", 100); string(first) != want {
+		t.Errorf("earlier response changed after its buffer was reused: got %q", first)
+	}
+
+	// Responses formatted concurrently never share a buffer
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := strings.Repeat(string(rune('a'+g)), 50)
+			for i := range 200 {
+				want := "#" + strconv.Itoa(i) + " " + body
+				if got := string(formatResponse(defaultTemplate, uint64(i), body, "")); got != want {
+					t.Errorf("got %q expected %q", got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWriteBufferPoolEchoes(t *testing.T) {
+	c := DefaultConfig()
+	c.WriteBufferPool = true
+	withConfig(t, c)
+	srv := newTestServer(t)
+	a := dialTestServer(t, srv)
+	b := dialTestServer(t, srv)
+	for _, msg := range []string{"hello", strings.Repeat("x", 2000), "bye"} {
+		for _, conn := range []*websocket.Conn{a, b} {
+			if got := roundTrip(t, conn, msg); got != msg {
+				t.Errorf("got %q expected %q", got, msg)
+			}
+		}
+	}
+}
+
+func BenchmarkFormatResponse(b *testing.B) {
+	body := strings.Repeat("hello ", 20)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = formatResponse(defaultTemplate, uint64(i), body, "")
+		}
+	})
+	// The same formatting growing a fresh slice each time
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = appendResponse(nil, defaultTemplate, uint64(i), body, "")
+		}
+	})
+	// How responses were built before pooling, for comparison
+	b.Run("replacer", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s := strings.NewReplacer("{id}", strconv.FormatUint(uint64(i), 10), "{body}", body, "{variant}", "").Replace(defaultTemplate)
+			_ = []byte(s)
+		}
+	})
+}
+
+func TestHandleAdminVariants(t *testing.T) {
+	t.Cleanup(func() { _ = SetResponseVariants(nil) })
+
+	body := `[{"name":"plain","template":"{body}","weight":1}]`
+	rr := httptest.NewRecorder()
+	HandleAdminVariants(rr, httptest.NewRequest(http.MethodPut, "/admin/variants", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %v expected %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if got := strings.TrimSpace(rr.Body.String()); got != body {
+		t.Errorf("got body %s expected %s", got, body)
+	}
+
+	rr = httptest.NewRecorder()
+	bad := `[{"name":"x","template":"no body","weight":1}]`
+	HandleAdminVariants(rr, httptest.NewRequest(http.MethodPut, "/admin/variants", strings.NewReader(bad)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %v expected %v", rr.Code, http.StatusBadRequest)
+	}
+	if vs := ResponseVariants(); len(vs) != 1 || vs[0].Name != "plain" {
+		t.Errorf("rejected update changed the rotation: %+v", vs)
+	}
+}
+
+func TestHandleAdminVariantsRequiresToken(t *testing.T) {
+	t.Cleanup(func() { _ = SetResponseVariants(nil) })
+	c := DefaultConfig()
+	c.AuthToken = "s3cret"
+	withConfig(t, c)
+
+	body := `[{"name":"plain","template":"{body}","weight":1}]`
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/admin/variants", strings.NewReader(body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rr := httptest.NewRecorder()
+		HandleAdminVariants(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("token %q: got status %d expected %d", tt.token, rr.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && len(ResponseVariants()) != 0 {
+			t.Errorf("token %q: unauthorized request changed the rotation", tt.token)
+		}
+	}
+}
+
+func TestResponseTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		template  string
+		text, bin string
+	}{
+		{defaultTemplate, "#1 hello", "#2 \x00\x01"},
+		{"[{id}] {body}", "[1] hello", "[2] \x00\x01"},
+		{"{body} ({id})", "hello (1)", "\x00\x01 (2)"},
+		{"", "hello", "\x00\x01"},
+	} {
+		c := DefaultConfig()
+		c.ResponseTemplate = tt.template
+		c.PerConnectionCounter = true
+		withConfig(t, c)
+		conn := dialTestServer(t, newTestServer(t))
+
+		for _, msg := range []struct {
+			kind       int
+			data, want string
+		}{
+			{websocket.TextMessage, "hello", tt.text},
+			{websocket.BinaryMessage, "\x00\x01", tt.bin},
+		} {
+			if err := conn.WriteMessage(msg.kind, []byte(msg.data)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, got, err := conn.ReadMessage(); err != nil || string(got) != msg.want {
+				t.Errorf("template %q: got %q, %v expected %q", tt.template, got, err, msg.want)
+			}
+		}
+	}
+}
+
+func TestConfigureRejectsTemplateWithoutBody(t *testing.T) {
+	c := DefaultConfig()
+	c.ResponseTemplate = "#{id}"
+	if err := Configure(c); err == nil {
+		t.Error("expected an error for a response template without {body}")
+	}
+}
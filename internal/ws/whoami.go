@@ -0,0 +1,35 @@
+// Filename: internal/ws/whoami.go
+
+package ws
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// whoami describes a connection to its own client
+type whoami struct {
+	ID                 uint64    `json:"connection_id"` // "id" is reserved for request ids
+	RemoteAddr         string    `json:"remote_addr"`
+	ConnectedSince     time.Time `json:"connected_since"`
+	Messages           uint64    `json:"messages"`
+	RateLimitRemaining int       `json:"rate_limit_remaining"`
+}
+
+// whoamiJSON returns the connection's id, address, connect time, messages
+// received (including this one) and how many more the rate limit allows
+// right now. With a per-IP limit the tighter of the two is reported.
+func (c *Connection) whoamiJSON() string {
+	remaining := c.rateLimiter.Remaining()
+	if c.ipLimiter != nil {
+		remaining = min(remaining, c.ipLimiter.Remaining())
+	}
+	data, _ := json.Marshal(whoami{
+		ID:                 c.ID,
+		RemoteAddr:         c.RemoteAddr,
+		ConnectedSince:     c.connected,
+		Messages:           c.Metrics().MessagesIn,
+		RateLimitRemaining: remaining,
+	})
+	return string(data)
+}
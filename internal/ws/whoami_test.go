@@ -0,0 +1,32 @@
+// Filename: internal/ws/whoami_test.go
+
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWhoami(t *testing.T) {
+	conn := dialTestServer(t, newTestServer(t))
+	for _, msg := range []string{"one", "two", "three"} {
+		roundTrip(t, conn, msg)
+	}
+
+	for i, msg := range []string{"WHOAMI", `{"command":"whoami","id":"me"}`} {
+		var got whoami
+		body := roundTrip(t, conn, msg)
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatalf("%s: decode %q: %v", msg, body, err)
+		}
+		// The WHOAMI message itself is counted and used up part of the limit
+		wantMessages := uint64(4 + i)
+		if got.Messages != wantMessages || got.RateLimitRemaining != DevProfile.MaxMessages-int(wantMessages) {
+			t.Errorf("%s: got %s expected %d messages and %d remaining", msg, body, wantMessages, DevProfile.MaxMessages-int(wantMessages))
+		}
+		if got.ID == 0 || got.RemoteAddr == "" || time.Since(got.ConnectedSince) > time.Minute {
+			t.Errorf("%s: got %s expected the connection's id, address and connect time", msg, body)
+		}
+	}
+}